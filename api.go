@@ -7,132 +7,723 @@
 package genact
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os"
+	"log/slog"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
 )
 
+// ApiResponse is the parsed response to a request, including the full
+// history with the latest response appended.
 type ApiResponse struct {
-	TokenCount     int32
+	TokenCount     int32 // the prompt token count
 	LatestResponse string
 	FullHistory    string
+	Thoughts       string // thought summaries, if any
+	Usage          Usage
+	FinishReason   string
+	Truncated      bool          // the response was stopped at the output token limit
+	Model          string        // the model used
+	RequestedModel string        // the model requested, if the request fell back to Model
+	ModelVersion   string        // the model version reported by the api
+	Latency        time.Duration // the duration of the successful requests
+	Preflight      *TokenCount   // the pre-flight token count, if made
+	Cache          *CacheInfo    // the cache used for the history, if any
+	ToolCalls      int           // the number of function calls run
+	Continuations  int           // the number of times the response was continued
+	Cost           float64       // the estimated cost in US dollars, zero if the model is not priced
+
+	// Candidates are the candidate responses, the first being that above,
+	// when several were requested with the "candidateCount" setting. Use
+	// Select to choose the candidate kept in the history.
+	Candidates []ApiCandidate
+	Selected   int // the candidate selected, numbered from zero
 }
 
-var logger *log.Logger
+// ApiCandidate is one of several candidate responses, with the full
+// history including the candidate.
+type ApiCandidate struct {
+	LatestResponse string
+	FullHistory    string
+	Thoughts       string
+	FinishReason   string
+}
 
-// initalise logging
-func newLogger(enabled bool) {
-	writer := io.Discard
-	if enabled {
-		writer = os.Stdout
+// Select chooses the candidate, numbered from zero, used for the latest
+// response and history of r.
+func (r *ApiResponse) Select(i int) error {
+	if i < 0 || i >= len(r.Candidates) {
+		return fmt.Errorf("candidate %d not found in %d candidates", i+1, len(r.Candidates))
 	}
-	logger = log.New(writer, "", log.LstdFlags)
+	c := r.Candidates[i]
+	r.LatestResponse, r.FullHistory, r.Thoughts, r.FinishReason = c.LatestResponse, c.FullHistory, c.Thoughts, c.FinishReason
+	r.Truncated = c.FinishReason == "MAX_TOKENS"
+	r.Selected = i
+	return nil
 }
 
-// startChat starts a client/model/chat.
-func startChat(ctx context.Context, settings map[string]string) (*genai.Client, *genai.ChatSession, error) {
-	client, err := genai.NewClient(ctx, option.WithAPIKey(settings["apiKey"]))
+// parseResponse puts the final backend response to a request into a
+// local ApiResponse struct for easier handling, with contents, the full
+// history including the latest response, encoded as json.
+//
+// Thoughts are returned separately from the response. They are only
+// added to the history, as the first part of the latest model turn, if
+// keepThoughts is set.
+func parseResponse(contents []*genai.Content, resp *BackendResponse, keepThoughts bool) (*ApiResponse, error) {
+
+	thisResponse := ApiResponse{
+		Thoughts:     resp.Thoughts,
+		Usage:        resp.Usage,
+		FinishReason: resp.FinishReason,
+		Truncated:    resp.FinishReason == "MAX_TOKENS",
+		ModelVersion: resp.ModelVersion,
+		Cache:        resp.Cache,
+	}
+	thisResponse.TokenCount = thisResponse.Usage.PromptTokens
+
+	thisResponse.LatestResponse = resp.text()
+	if thisResponse.LatestResponse == "" {
+		return nil, finishReasonError(resp.FinishReason, true, nil)
+	}
+	var err error
+	thisResponse.FullHistory, err = historyJSON(contents, resp.Thoughts, keepThoughts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not create client: %v", err)
+		return nil, err
+	}
+
+	if len(resp.Candidates) < 2 {
+		return &thisResponse, nil
 	}
-	model := client.GenerativeModel(settings["modelName"])
-	chat := model.StartChat()
-	return client, chat, nil
+	history := contents[:len(contents)-1]
+	for _, c := range resp.Candidates {
+		ac := ApiCandidate{
+			LatestResponse: partsText(c.Content),
+			Thoughts:       c.Thoughts,
+			FinishReason:   c.FinishReason,
+		}
+		ac.FullHistory, err = historyJSON(append(slices.Clone(history), c.Content), c.Thoughts, keepThoughts)
+		if err != nil {
+			return nil, err
+		}
+		thisResponse.Candidates = append(thisResponse.Candidates, ac)
+	}
+	return &thisResponse, nil
 }
 
-// endChat closes a client session.
-func endChat(client *genai.Client) {
-	_ = client.Close()
+// historyJSON encodes contents as a json api history. If keepThoughts
+// is set, thoughts are added as the first part of the latest turn.
+func historyJSON(contents []*genai.Content, thoughts string, keepThoughts bool) (string, error) {
+	FullHistory := contents
+	if keepThoughts && thoughts != "" && len(FullHistory) > 0 {
+		FullHistory = slices.Clone(contents)
+		latest := FullHistory[len(FullHistory)-1]
+		FullHistory[len(FullHistory)-1] = &genai.Content{
+			Role:  latest.Role,
+			Parts: append([]genai.Part{genai.Text(thoughts)}, latest.Parts...),
+		}
+	}
+	apiHistory, err := aiContentToAPI(FullHistory)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(apiHistory, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal new history: %v", err)
+	}
+	return string(b), nil
+}
+
+// jsonReaskPrompt is the prompt sent to re-ask for a JSON output
+// response which failed validation.
+const jsonReaskPrompt = "The response was not valid for the required JSON schema: %v. Reply again with only the corrected JSON."
+
+// continuePrompt is the prompt sent to continue a response stopped at
+// the output token limit.
+const continuePrompt = "Continue exactly where the response stopped, without repeating or introducing it."
+
+// continueContent joins a response stopped at the output token limit
+// with its continuation into a single model turn, joining adjacent text
+// parts.
+func continueContent(stopped, next *genai.Content) *genai.Content {
+	joined := &genai.Content{Role: stopped.Role, Parts: slices.Clone(stopped.Parts)}
+	for _, p := range next.Parts {
+		t, ok := p.(genai.Text)
+		if n := len(joined.Parts); ok && n > 0 {
+			if last, ok := joined.Parts[n-1].(genai.Text); ok {
+				joined.Parts[n-1] = last + t
+				continue
+			}
+		}
+		joined.Parts = append(joined.Parts, p)
+	}
+	return joined
 }
 
-// runAPI runs the api given a *genai.ChatSession, history (if any) and
-// a prompt string.
-func runAPI(ctx context.Context, chat *genai.ChatSession, history []*genai.Content, prompt string) (*genai.GenerateContentResponse, error) {
+// Option configures a request made with APIGetResponseContext.
+type Option func(*requestOptions)
 
-	chat.History = history
+// requestOptions are the optional parameters of a request.
+type requestOptions struct {
+	chunkFunc         func(string) error
+	systemInstruction *string
+	confirm           func(TokenCount) bool
+	cache             *CacheInfo
+	attachments       []genai.Blob
+	uploads           Uploads
+	tools             *ToolRegistry
+	jsonOutput        bool
+	schema            *ResponseSchema
+	backend           Backend
+	cassette          *Cassette
+	logger            *slog.Logger
+	rateLimiter       *RateLimiter
+	spending          *Spending
+	spendingChat      string
+	ledger            *Ledger
+	ledgerChat        string
+}
+
+// cost returns the estimated cost of a call to model with usage, zero
+// if the model is not priced.
+func (ro *requestOptions) cost(settings *Settings, model string, usage Usage) float64 {
+	c, ok := settings.Pricing.Cost(model, usage)
+	if !ok {
+		ro.logger.Debug("model not priced, cost not estimated", "model", model)
+	}
+	return c
+}
 
-	logger.Println("Sending prompt to Gemini API...")
-	resp, err := chat.SendMessage(ctx, genai.Text(prompt))
+// record appends the record of an api call to the ledger, if any.
+func (ro *requestOptions) record(start time.Time, model string, usage Usage, cost float64, duration time.Duration, err error) {
+	if ro.ledger == nil {
+		return
+	}
+	r := LedgerRecord{
+		Time:       start.UTC().Truncate(time.Millisecond),
+		Chat:       ro.ledgerChat,
+		Model:      model,
+		Usage:      usage,
+		Cost:       cost,
+		DurationMS: duration.Milliseconds(),
+		Status:     LedgerOK,
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to send message: %v", err)
+		r.Status, r.Error = LedgerError, err.Error()
 	}
-	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason > 0 {
-		return nil, fmt.Errorf("received BlockReason: %d", resp.PromptFeedback.BlockReason)
+	if lerr := ro.ledger.Append(r); lerr != nil {
+		ro.logger.Warn("could not record api call in the ledger", "error", lerr)
 	}
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, errors.New("received an empty response from the API")
+}
+
+// backendRequest returns the backend request for contents, the history
+// followed by the latest user turn.
+func (ro *requestOptions) backendRequest(settings *Settings, contents []*genai.Content) *BackendRequest {
+	return &BackendRequest{
+		Model:             settings.Model(),
+		SystemInstruction: ro.instruction(settings),
+		Contents:          contents,
+		Tools:             ro.tools.genaiTools(),
+		JSONOutput:        ro.jsonOutput,
+		Schema:            ro.schema.genaiSchema(),
 	}
-	logger.Println("response ok")
+}
 
-	return resp, nil
+// promptParts returns the parts of a prompt, the prompt text followed
+// by any attachments.
+func (ro *requestOptions) promptParts(prompt string) []genai.Part {
+	parts := []genai.Part{genai.Text(prompt)}
+	for _, b := range ro.attachments {
+		parts = append(parts, b)
+	}
+	return parts
 }
 
-// parseResponse takes a *genai.ChatSession and a
-// *genai.GenerateContentResponse to parse a responseinto a local
-// ApiResponse struct for easier handling. Presently only the first
-// Candidate is considered (resp.Candidates[0]).
-//
-// Todo: deal with "isThinking"/"Thinking" responses from the AI API,
-// which may not be useful to put into history.
-func parseResponse(chat *genai.ChatSession, resp *genai.GenerateContentResponse) (*ApiResponse, error) {
+// instruction returns the system instruction for a request, from
+// the options if provided or otherwise from settings.
+func (ro *requestOptions) instruction(settings *Settings) string {
+	if ro.systemInstruction != nil {
+		return *ro.systemInstruction
+	}
+	return settings.SystemInstruction
+}
 
-	thisResponse := ApiResponse{
-		TokenCount: resp.UsageMetadata.PromptTokenCount,
+// WithStream streams the response, calling chunkFunc with each text
+// chunk as it arrives. An error returned from chunkFunc stops the
+// stream.
+func WithStream(chunkFunc func(chunk string) error) Option {
+	return func(ro *requestOptions) {
+		ro.chunkFunc = chunkFunc
 	}
+}
 
-	// expecting only 1 candidate in this code
-	if len(resp.Candidates) != 1 {
-		return nil, fmt.Errorf("expected only 1 candidate, got %d", len(resp.Candidates))
+// WithSystemInstruction sets the system instruction for the request,
+// overriding any system instruction in settings. An empty string
+// removes the system instruction.
+func WithSystemInstruction(systemInstruction string) Option {
+	return func(ro *requestOptions) {
+		ro.systemInstruction = &systemInstruction
 	}
+}
 
-	var LatestResponse strings.Builder
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if txt, ok := part.(genai.Text); ok {
-			LatestResponse.WriteString(string(txt))
-		}
+// WithConfirm sets the function called to confirm sending a request
+// whose pre-flight token count exceeds the token budget, when the
+// "overBudget" setting is "prompt". The request is sent if confirm
+// returns true. Without a confirm function such requests are refused.
+func WithConfirm(confirm func(TokenCount) bool) Option {
+	return func(ro *requestOptions) {
+		ro.confirm = confirm
 	}
-	thisResponse.LatestResponse = LatestResponse.String()
-	if thisResponse.LatestResponse == "" {
-		return nil, errors.New("latest response had no text content")
+}
+
+// WithCache provides the cache used by a previous request in the chat,
+// normally saved from ApiResponse.Cache, for reuse when the "cache"
+// setting is true. The cache is reused while it is unexpired and holds
+// the start of the history; otherwise a new cache is made.
+func WithCache(cache *CacheInfo) Option {
+	return func(ro *requestOptions) {
+		ro.cache = cache
 	}
+}
 
-	FullHistory := chat.History
-	historyJSON, err := json.MarshalIndent(FullHistory, "", "  ")
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal new history: %v", err)
+// WithAttachments adds attachments, such as those loaded with
+// LoadAttachments, to the prompt. Attachments are recorded in the
+// history by reference and should be saved alongside the history file
+// with SaveAttachments.
+func WithAttachments(blobs ...genai.Blob) Option {
+	return func(ro *requestOptions) {
+		ro.attachments = append(ro.attachments, blobs...)
+	}
+}
+
+// WithUploads provides the record of attachments uploaded with the File
+// API by previous requests in the chat. Attachments larger than the
+// "uploadThreshold" setting are uploaded rather than sent inline, and
+// uploads are reused until they expire. New uploads are added to
+// uploads, which the caller may then save for later requests.
+func WithUploads(uploads Uploads) Option {
+	return func(ro *requestOptions) {
+		ro.uploads = uploads
+	}
+}
+
+// WithTools provides tools, such as those from BuiltinTools, which the
+// model may call. Function calls from the model are run and their
+// responses sent back to the model until it provides a text response,
+// for up to the "maxToolRounds" setting rounds of calls. The function
+// calls and responses are recorded in the history.
+func WithTools(tools *ToolRegistry) Option {
+	return func(ro *requestOptions) {
+		ro.tools = tools
+	}
+}
+
+// WithJSONOutput requests a JSON response matching schema, which may be
+// nil to request JSON output without a schema. The response is
+// validated locally and, if invalid, the model is asked again up to the
+// "jsonReasks" setting times before an ErrInvalidJSON error is
+// returned.
+func WithJSONOutput(schema *ResponseSchema) Option {
+	return func(ro *requestOptions) {
+		ro.jsonOutput = true
+		ro.schema = schema
+	}
+}
+
+// WithBackend sends the request with backend rather than the backend
+// selected by the "backend" setting, such as a Backend for another api
+// or a fake for testing. The backend is not closed after the request.
+func WithBackend(backend Backend) Option {
+	return func(ro *requestOptions) {
+		ro.backend = backend
+	}
+}
+
+// WithCassette records or replays the http interactions of the request
+// with cassette, such as one opened with OpenCassette, in place of the
+// "cassette" setting. A cassette may be shared between requests, for
+// example to replay the requests of a test in turn.
+func WithCassette(cassette *Cassette) Option {
+	return func(ro *requestOptions) {
+		ro.cassette = cassette
+	}
+}
+
+// WithRateLimiter limits the requests and tokens per minute with
+// rateLimiter, such as one made with NewRateLimiter, in place of the
+// "requestsPerMinute" and "tokensPerMinute" settings. A RateLimiter may
+// be shared between requests, or between processes with a file.
+func WithRateLimiter(rateLimiter *RateLimiter) Option {
+	return func(ro *requestOptions) {
+		ro.rateLimiter = rateLimiter
+	}
+}
+
+// WithSpending records the estimated cost of the request in spending
+// under the name of the chat. The request is refused with an ErrCostCap
+// error if the costs of the chat, or of today, have reached the
+// "costCapChat" or "costCapDay" setting.
+func WithSpending(spending *Spending, chat string) Option {
+	return func(ro *requestOptions) {
+		ro.spending, ro.spendingChat = spending, chat
+	}
+}
+
+// WithLedger records each api call of the request, including retries
+// and the rounds of function calls, continuations and re-asks, in the
+// ledger, under the name of the chat.
+func WithLedger(ledger *Ledger, chat string) Option {
+	return func(ro *requestOptions) {
+		ro.ledger, ro.ledgerChat = ledger, chat
+	}
+}
+
+// WithLogger logs the progress of the request, such as retries, tool
+// calls and token usage, to logger. By default requests log to
+// slog.Default if the "logging" setting is true.
+func WithLogger(logger *slog.Logger) Option {
+	return func(ro *requestOptions) {
+		ro.logger = logger
 	}
-	thisResponse.FullHistory = string(historyJSON)
-	return &thisResponse, nil
 }
 
 // APIGetResponse creates a genai client and chat session, runs the api
 // to receive a response, and then puts the response into a local
 // ApiResponse struct for convenient processing.
-func APIGetResponse(settings map[string]string, history []*genai.Content, prompt string) (*ApiResponse, error) {
+func APIGetResponse(settings *Settings, history []*genai.Content, prompt string) (*ApiResponse, error) {
+	return APIGetResponseContext(context.Background(), settings, history, prompt)
+}
+
+// APIGetResponseStream is like APIGetResponse but streams the response,
+// calling chunkFunc with each text chunk as it arrives. An error
+// returned from chunkFunc stops the stream. The resulting ApiResponse is
+// the same as that provided by APIGetResponse.
+func APIGetResponseStream(settings *Settings, history []*genai.Content, prompt string, chunkFunc func(chunk string) error) (*ApiResponse, error) {
+	if chunkFunc == nil {
+		return nil, errors.New("stream chunk function not provided")
+	}
+	return APIGetResponseContext(context.Background(), settings, history, prompt, WithStream(chunkFunc))
+}
+
+// APIGetResponseContext is like APIGetResponse but runs the request
+// under the provided context, allowing callers to cancel the request or
+// set a deadline. If a RequestTimeout is set in settings it is applied
+// in addition to any deadline on ctx. Cancellation and timeout
+// errors can be detected with errors.Is against context.Canceled and
+// context.DeadlineExceeded.
+func APIGetResponseContext(ctx context.Context, settings *Settings, history []*genai.Content, prompt string, opts ...Option) (*ApiResponse, error) {
+
+	ro, err := prepareRequest(settings, opts)
+	if err != nil {
+		return nil, err
+	}
+	if settings.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.RequestTimeout)
+		defer cancel()
+	}
+
+	backend, closeBackend, err := newBackend(ctx, settings, ro)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBackend()
+
+	promptContent := genai.NewUserContent(ro.promptParts(prompt)...)
+	req := ro.backendRequest(settings, append(slices.Clone(history), promptContent))
+
+	var tokenCount *TokenCount
+	if settings.Preflight {
+		tc, err := preflight(ctx, backend, settings, req, ro.confirm, ro.logger)
+		if err != nil {
+			return nil, fmt.Errorf("pre-flight check: %w", err)
+		}
+		tokenCount = &tc
+	}
+
+	// Retry transient errors. A stream is not retried once text has been
+	// passed to the caller. Each attempt waits for the rate limit, if any,
+	// with an estimate of its tokens from the pre-flight count, the size
+	// of the request or the last response, which is then replaced by the
+	// tokens used. The cost of each response is estimated from its usage.
+	// The cost of the input tokens and of the maxOutputTokens setting, if
+	// any, is reserved in the spending, if any, until the cost of the
+	// request is known.
+	var latency time.Duration
+	var cost float64
+	var estimate int32
+	switch {
+	case tokenCount != nil:
+		estimate = tokenCount.Tokens
+	case ro.rateLimiter.enabled() || ro.spending != nil:
+		estimate = estimateTokens(req)
+	}
+	var reserve float64
+	if ro.spending != nil {
+		usage := Usage{PromptTokens: estimate, TotalTokens: estimate}
+		if settings.MaxOutputTokens != nil {
+			usage.CandidatesTokens = *settings.MaxOutputTokens
+			usage.TotalTokens += *settings.MaxOutputTokens
+		}
+		reserve = ro.cost(settings, req.Model, usage)
+	}
+	reservation, err := ro.spending.Reserve(settings, ro.spendingChat, reserve)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := ro.spending.Record(reservation, ro.spendingChat, cost); err != nil {
+			ro.logger.Warn("could not record spending", "error", err)
+		}
+	}()
+	var streamed bool
+	sendModel := func() (*BackendResponse, error) {
+		var response *BackendResponse
+		var duration time.Duration
+		attempt := 0
+		err := withRetry(ctx, settings.Retry, ro.logger, func() error {
+			attempt++
+			id, err := ro.rateLimiter.Wait(ctx, estimate, ro.logger)
+			if err != nil {
+				return noRetryError{err}
+			}
+			ro.logger.Debug("sending request", "model", req.Model, "attempt", attempt, "stream", ro.chunkFunc != nil)
+			start := time.Now()
+			defer func() {
+				duration = time.Since(start)
+				var usage Usage
+				var callCost float64
+				if err == nil {
+					usage = response.Usage
+					callCost = ro.cost(settings, req.Model, usage)
+					cost += callCost
+				}
+				if rerr := ro.rateLimiter.Record(id, usage.TotalTokens); rerr != nil {
+					ro.logger.Warn("could not record rate limit usage", "error", rerr)
+				}
+				ro.record(start, req.Model, usage, callCost, duration, err)
+			}()
+			if ro.chunkFunc == nil {
+				response, err = backend.Send(ctx, req)
+				return err
+			}
+			response, err = backend.Stream(ctx, req, func(chunk string) error {
+				streamed = true
+				return ro.chunkFunc(chunk)
+			})
+			if err != nil && streamed {
+				return noRetryError{err}
+			}
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("chat response error: %w", err)
+		}
+		ro.logger.Debug("response received",
+			"model", req.Model,
+			"attempt", attempt,
+			"duration", duration.Round(time.Millisecond),
+			"finishReason", response.FinishReason,
+		)
+		latency += duration
+		estimate = response.Usage.TotalTokens
+		return response, nil
+	}
 
+	// Fall back to the next of the "fallbackModels", if any, when the
+	// model is unavailable once retries are exhausted, unless text has
+	// been streamed. The later rounds of the request use the fallback
+	// model.
+	models := settings.Models()
+	fallbacks := 0
+	send := func() (*BackendResponse, error) {
+		streamed = false
+		for {
+			response, err := sendModel()
+			if err == nil || streamed || fallbacks+1 >= len(models) || !modelUnavailable(err) {
+				return response, err
+			}
+			fallbacks++
+			ro.logger.Warn("falling back to model", "model", models[fallbacks], "from", req.Model, "error", err)
+			req.Model = models[fallbacks]
+		}
+	}
+
+	// Run the function calls of the model, if any, sending the function
+	// responses back until a text response is received. A response
+	// stopped at the output token limit is continued, if
+	// "maxContinuations" allows, and joined with its continuation so that
+	// the history records a single model turn. A JSON output response
+	// failing validation is re-asked if "jsonReasks" allows. The thoughts
+	// and usage of the earlier rounds are kept.
+	response, err := send()
+	if err != nil {
+		return nil, err
+	}
+	var roundThoughts []string
+	var roundUsage Usage
+	toolRounds, toolCalls, reasks, continuations := 0, 0, 0, 0
+rounds:
+	for {
+		var parts []genai.Part
+		calls := response.functionCalls()
+		switch {
+		case len(calls) > 0:
+			toolRounds++
+			if toolRounds > cmp.Or(settings.MaxToolRounds, defaultMaxToolRounds) {
+				return nil, fmt.Errorf("model made more than %d rounds of function calls", cmp.Or(settings.MaxToolRounds, defaultMaxToolRounds))
+			}
+			if ro.tools.Len() == 0 {
+				return nil, fmt.Errorf("model called function %s but no tools were provided", calls[0].Name)
+			}
+			for _, fc := range calls {
+				parts = append(parts, ro.tools.call(ctx, fc, ro.logger.With("call", toolCalls+1)))
+				toolCalls++
+			}
+		case response.FinishReason == "MAX_TOKENS" && continuations < settings.MaxContinuations && len(response.Candidates) == 0:
+			continuations++
+			ro.logger.Info("continuing response stopped at the output token limit",
+				"continuation", continuations,
+				"maxContinuations", settings.MaxContinuations,
+			)
+			req.Contents = append(req.Contents, response.Content, genai.NewUserContent(genai.Text(continuePrompt)))
+			next, err := send()
+			req.Contents = req.Contents[:len(req.Contents)-2]
+			if errors.Is(err, ErrMaxTokens) {
+				ro.logger.Warn("continuation empty at the output token limit", "error", err)
+				break rounds
+			}
+			if err != nil {
+				return nil, err
+			}
+			if response.Thoughts != "" {
+				roundThoughts = append(roundThoughts, response.Thoughts)
+			}
+			roundUsage = roundUsage.Add(response.Usage)
+			next.Content = continueContent(response.Content, next.Content)
+			response = next
+			continue
+		case ro.jsonOutput:
+			err := ro.schema.Validate([]byte(response.text()))
+			if err == nil {
+				break rounds
+			}
+			if reasks >= settings.JSONReasks {
+				return nil, err
+			}
+			reasks++
+			ro.logger.Info("re-asking for JSON output", "reask", reasks, "jsonReasks", settings.JSONReasks, "error", err)
+			parts = []genai.Part{genai.Text(fmt.Sprintf(jsonReaskPrompt, err))}
+		default:
+			break rounds
+		}
+		if response.Thoughts != "" {
+			roundThoughts = append(roundThoughts, response.Thoughts)
+		}
+		roundUsage = roundUsage.Add(response.Usage)
+		req.Contents = append(req.Contents, response.Content, genai.NewUserContent(parts...))
+		response, err = send()
+		if err != nil {
+			return nil, err
+		}
+	}
+	apiResponse, err := parseResponse(append(req.Contents, response.Content), response, settings.KeepThoughts)
+	if err != nil {
+		return nil, err
+	}
+	apiResponse.Model = req.Model
+	if fallbacks > 0 {
+		apiResponse.RequestedModel = models[0]
+	}
+	apiResponse.Latency = latency
+	apiResponse.Preflight = tokenCount
+	apiResponse.ToolCalls = toolCalls
+	apiResponse.Continuations = continuations
+	apiResponse.Cost = cost
+	apiResponse.Usage = roundUsage.Add(apiResponse.Usage)
+	apiResponse.TokenCount = apiResponse.Usage.PromptTokens
+	if len(roundThoughts) > 0 {
+		apiResponse.Thoughts = strings.Join(append(roundThoughts, apiResponse.Thoughts), "\n\n")
+		for i, c := range apiResponse.Candidates {
+			apiResponse.Candidates[i].Thoughts = strings.Join(append(roundThoughts, c.Thoughts), "\n\n")
+		}
+	}
+	ro.logger.Info("usage",
+		"model", apiResponse.Model,
+		"modelVersion", apiResponse.ModelVersion,
+		"promptTokens", apiResponse.Usage.PromptTokens,
+		"cachedTokens", apiResponse.Usage.CachedContentTokens,
+		"outputTokens", apiResponse.Usage.CandidatesTokens,
+		"thoughtsTokens", apiResponse.Usage.ThoughtsTokens,
+		"totalTokens", apiResponse.Usage.TotalTokens,
+		"cost", apiResponse.Cost,
+		"duration", latency.Round(time.Millisecond),
+	)
+	return apiResponse, nil
+}
+
+// prepareRequest validates settings and applies the request options,
+// logging to slog.Default if no logger is provided and the "logging"
+// setting is true, and otherwise discarding logs.
+func prepareRequest(settings *Settings, opts []Option) (*requestOptions, error) {
 	if settings == nil {
 		return nil, errors.New("settings not provided")
 	}
-	logging := settings["logging"] != "false"
-	newLogger(logging)
+	if err := settings.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+
+	ro := requestOptions{}
+	for _, o := range opts {
+		o(&ro)
+	}
+	switch {
+	case ro.logger != nil:
+	case settings.Logging:
+		ro.logger = slog.Default()
+	default:
+		ro.logger = slog.New(slog.DiscardHandler)
+	}
+	if ro.rateLimiter == nil && (settings.RequestsPerMinute > 0 || settings.TokensPerMinute > 0) {
+		ro.rateLimiter = NewRateLimiter(settings.RequestsPerMinute, settings.TokensPerMinute, "")
+	}
+	return &ro, nil
+}
+
+// APICountTokens counts the tokens of the history and prompt, including
+// any system instruction, without generating a response. The
+// TokenCount reports the context limit of the model and the token
+// budget from settings, which may be checked with TokenCount.Check. Of
+// the options only WithSystemInstruction, WithAttachments and
+// WithUploads are relevant.
+func APICountTokens(ctx context.Context, settings *Settings, history []*genai.Content, prompt string, opts ...Option) (*TokenCount, error) {
+
+	ro, err := prepareRequest(settings, opts)
+	if err != nil {
+		return nil, err
+	}
+	if settings.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.RequestTimeout)
+		defer cancel()
+	}
 
-	ctx := context.Background()
-	client, chat, err := startChat(ctx, settings)
-	defer endChat(client)
+	backend, closeBackend, err := newBackend(ctx, settings, ro)
 	if err != nil {
-		return nil, fmt.Errorf("could not start chat: %w", err)
+		return nil, err
 	}
-	response, err := runAPI(ctx, chat, history, prompt)
+	defer closeBackend()
+
+	req := ro.backendRequest(settings, append(slices.Clone(history), genai.NewUserContent(ro.promptParts(prompt)...)))
+	tc, err := countTokens(ctx, backend, settings, req, ro.logger)
 	if err != nil {
-		return nil, fmt.Errorf("chat response error: %w", err)
+		return nil, err
 	}
-	return parseResponse(chat, response)
+	return &tc, nil
 }
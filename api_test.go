@@ -0,0 +1,645 @@
+package genact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/googleapi"
+)
+
+// TestAPIGetResponseContextCancelled checks that a cancelled or timed
+// out request is reported as such, without reaching the network.
+func TestAPIGetResponseContextCancelled(t *testing.T) {
+
+	settings := &Settings{
+		APIKey:    "testkey",
+		ModelName: "gemini-2.5-pro",
+		Retry:     DefaultRetryPolicy,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := APIGetResponseContext(ctx, settings, nil, "hi")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled error, got %v", err)
+	}
+
+	settings.RequestTimeout = time.Nanosecond
+	_, err = APIGetResponseContext(context.Background(), settings, nil, "hi")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded error, got %v", err)
+	}
+}
+
+// TestParseResponse tests parsing a response, including the usage
+// metadata and the handling of thoughts.
+func TestParseResponse(t *testing.T) {
+
+	resp := &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{
+			Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text("Hello there")}},
+			FinishReason: genai.FinishReasonStop,
+		}},
+		UsageMetadata: &genai.UsageMetadata{PromptTokenCount: 3, CandidatesTokenCount: 1, TotalTokenCount: 4},
+	}
+	parse := func(record *wireRecord, keep bool) (*ApiResponse, error) {
+		br, err := geminiResponse(resp, record, slog.New(slog.DiscardHandler))
+		if err != nil {
+			return nil, err
+		}
+		contents := []*genai.Content{
+			{Role: "user", Parts: []genai.Part{genai.Text("Hi")}},
+			{Role: "model", Parts: []genai.Part{genai.Text("Hello there")}},
+		}
+		return parseResponse(contents, br, keep)
+	}
+
+	// without a wire record the genai usage metadata is used
+	r, err := parse(&wireRecord{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.LatestResponse, "Hello there"; got != want {
+		t.Errorf("response got %q want %q", got, want)
+	}
+	if got, want := r.Usage, (Usage{PromptTokens: 3, CandidatesTokens: 1, TotalTokens: 4}); got != want {
+		t.Errorf("usage got %+v want %+v", got, want)
+	}
+	if got, want := r.TokenCount, int32(3); got != want {
+		t.Errorf("token count got %d want %d", got, want)
+	}
+	if got, want := r.FinishReason, "STOP"; got != want {
+		t.Errorf("finish reason got %s want %s", got, want)
+	}
+
+	// with a wire record, thoughts and usage are taken from the record
+	record := &wireRecord{
+		usage:        &Usage{PromptTokens: 3, CandidatesTokens: 1, ThoughtsTokens: 9, TotalTokens: 13},
+		modelVersion: "gemini-2.5-pro-001",
+	}
+	record.thoughts = map[int]string{0: "Thinking about greetings."}
+	for _, keep := range []bool{false, true} {
+		r, err = parse(record, keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := r.Usage.ThoughtsTokens, int32(9); got != want {
+			t.Errorf("thought tokens got %d want %d", got, want)
+		}
+		if got, want := r.ModelVersion, "gemini-2.5-pro-001"; got != want {
+			t.Errorf("model version got %s want %s", got, want)
+		}
+		if got, want := r.Thoughts, "Thinking about greetings."; got != want {
+			t.Errorf("thoughts got %q want %q", got, want)
+		}
+		if got, want := strings.Contains(r.FullHistory, "Thinking about greetings."), keep; got != want {
+			t.Errorf("keepThoughts %t: thoughts in history got %t want %t", keep, got, want)
+		}
+	}
+}
+
+// fakeSettings returns settings for requests to a FakeBackend, without
+// retry delays.
+func fakeSettings() *Settings {
+	settings := defaultSettings()
+	settings.Backend, settings.ModelName = BackendFake, "gemini-2.5-pro"
+	settings.Retry.InitialDelay, settings.Retry.MaxDelay = 0, 0
+	return &settings
+}
+
+// TestAPIGetResponse tests APIGetResponse and APIGetResponseStream with
+// the echoing fake backend selected by the "backend" setting.
+func TestAPIGetResponse(t *testing.T) {
+
+	history := []*genai.Content{
+		{Role: "user", Parts: []genai.Part{genai.Text("Hi")}},
+		{Role: "model", Parts: []genai.Part{genai.Text("Hello")}},
+	}
+	settings := fakeSettings()
+	settings.Preflight = true
+	r, err := APIGetResponse(settings, history, "How are you?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.LatestResponse, "echo: How are you?"; got != want {
+		t.Errorf("response got %q want %q", got, want)
+	}
+	if got, want := r.Usage, (Usage{PromptTokens: 5, CandidatesTokens: 4, TotalTokens: 9}); got != want {
+		t.Errorf("usage got %+v want %+v", got, want)
+	}
+	if got, want := r.Preflight.Tokens, int32(5); got != want {
+		t.Errorf("pre-flight tokens got %d want %d", got, want)
+	}
+	var fullHistory []APIConversation
+	if err := json.Unmarshal([]byte(r.FullHistory), &fullHistory); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fullHistory), len(history)+2; got != want {
+		t.Errorf("got %d history turns want %d", got, want)
+	}
+
+	var chunks []string
+	r, err = APIGetResponseStream(fakeSettings(), nil, "How are you?", func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(chunks, "|"), "echo: |How |are |you?"; got != want {
+		t.Errorf("chunks got %q want %q", got, want)
+	}
+	if got, want := r.LatestResponse, "echo: How are you?"; got != want {
+		t.Errorf("response got %q want %q", got, want)
+	}
+	if r.Preflight != nil {
+		t.Errorf("pre-flight count %s made by default", r.Preflight)
+	}
+}
+
+// TestAPIGetResponseFake tests requests with scripted responses, errors
+// and block reasons, including the retry of transient errors.
+func TestAPIGetResponseFake(t *testing.T) {
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "overloaded"}
+	tests := []struct {
+		desc     string
+		replies  []FakeReply
+		stream   bool
+		settings func(*Settings)
+		response string
+		usage    Usage
+		requests int
+		errText  string
+	}{
+		{
+			desc:     "scripted response",
+			replies:  []FakeReply{{Text: "Fine.", FinishReason: "MAX_TOKENS", Usage: &Usage{PromptTokens: 7, CandidatesTokens: 2, TotalTokens: 9}}},
+			response: "Fine.",
+			usage:    Usage{PromptTokens: 7, CandidatesTokens: 2, TotalTokens: 9},
+			requests: 1,
+		},
+		{
+			desc:     "transient error retried",
+			replies:  []FakeReply{{Err: unavailable}, {Err: unavailable}, {Text: "Fine."}},
+			response: "Fine.",
+			usage:    Usage{PromptTokens: 3, CandidatesTokens: 1, TotalTokens: 4},
+			requests: 3,
+		},
+		{
+			desc:     "transient error retried while streaming",
+			replies:  []FakeReply{{Err: unavailable}, {Text: "Fine."}},
+			stream:   true,
+			response: "Fine.",
+			usage:    Usage{PromptTokens: 3, CandidatesTokens: 1, TotalTokens: 4},
+			requests: 2,
+		},
+		{
+			desc:     "broken stream not retried",
+			replies:  []FakeReply{{Chunks: []string{"Fi"}, Err: unavailable}, {Text: "Fine."}},
+			stream:   true,
+			requests: 1,
+			errText:  "overloaded",
+		},
+		{
+			desc:     "retries exhausted",
+			replies:  []FakeReply{{Err: unavailable}, {Err: unavailable}, {Err: unavailable}},
+			requests: 3,
+			errText:  "overloaded",
+		},
+		{
+			desc:     "permanent error",
+			replies:  []FakeReply{{Err: &googleapi.Error{Code: http.StatusBadRequest, Message: "API key not valid"}}},
+			requests: 1,
+			errText:  "API key not valid",
+		},
+		{
+			desc:     "blocked",
+			replies:  []FakeReply{{BlockReason: "SAFETY"}},
+			requests: 1,
+			errText:  "response blocked: prompt block reason SAFETY",
+		},
+		{
+			desc:     "empty response",
+			replies:  []FakeReply{{}},
+			requests: 1,
+			errText:  "empty response",
+		},
+		{
+			desc:     "over budget",
+			settings: func(s *Settings) { s.Preflight, s.TokenBudget = true, 2 },
+			errText:  "token budget exceeded",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			settings := fakeSettings()
+			if tt.settings != nil {
+				tt.settings(settings)
+			}
+			fake := NewFakeBackend(tt.replies...)
+			opts := []Option{WithBackend(fake)}
+			if tt.stream {
+				opts = append(opts, WithStream(func(string) error { return nil }))
+			}
+			r, err := APIGetResponseContext(context.Background(), settings, nil, "How are you?", opts...)
+			if got, want := len(fake.Requests()), tt.requests; got != want {
+				t.Errorf("got %d requests want %d", got, want)
+			}
+			if tt.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errText) {
+					t.Fatalf("got error %v want %q", err, tt.errText)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := r.LatestResponse, tt.response; got != want {
+				t.Errorf("response got %q want %q", got, want)
+			}
+			if got, want := r.Usage, tt.usage; got != want {
+				t.Errorf("usage got %+v want %+v", got, want)
+			}
+		})
+	}
+}
+
+// TestAPIGetResponseContinue tests continuing responses stopped at the
+// output token limit, joining the parts into a single model turn.
+func TestAPIGetResponseContinue(t *testing.T) {
+
+	tests := []struct {
+		desc          string
+		replies       []FakeReply
+		max           int
+		response      string
+		finishReason  string
+		continuations int
+		requests      int
+	}{
+		{
+			desc:         "not continued",
+			replies:      []FakeReply{{Text: "func main() {", FinishReason: "MAX_TOKENS"}},
+			response:     "func main() {",
+			finishReason: "MAX_TOKENS",
+			requests:     1,
+		},
+		{
+			desc: "continued",
+			replies: []FakeReply{
+				{Text: "func main() {", FinishReason: "MAX_TOKENS"},
+				{Text: "\n\tfmt.Println(", FinishReason: "MAX_TOKENS"},
+				{Text: "\"hi\")\n}"},
+			},
+			max:           3,
+			response:      "func main() {\n\tfmt.Println(\"hi\")\n}",
+			finishReason:  "STOP",
+			continuations: 2,
+			requests:      3,
+		},
+		{
+			desc: "continuation limit",
+			replies: []FakeReply{
+				{Text: "func main() {", FinishReason: "MAX_TOKENS"},
+				{Text: "\n\tfmt.Println(", FinishReason: "MAX_TOKENS"},
+			},
+			max:           1,
+			response:      "func main() {\n\tfmt.Println(",
+			finishReason:  "MAX_TOKENS",
+			continuations: 1,
+			requests:      2,
+		},
+		{
+			desc: "empty continuation",
+			replies: []FakeReply{
+				{Text: "func main() {", FinishReason: "MAX_TOKENS"},
+				{Thoughts: "Thinking.", FinishReason: "MAX_TOKENS"},
+			},
+			max:           2,
+			response:      "func main() {",
+			finishReason:  "MAX_TOKENS",
+			continuations: 1,
+			requests:      2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			settings := fakeSettings()
+			settings.MaxContinuations = tt.max
+			fake := NewFakeBackend(tt.replies...)
+			var chunks strings.Builder
+			r, err := APIGetResponseContext(context.Background(), settings, nil, "Write a programme.",
+				WithBackend(fake),
+				WithStream(func(chunk string) error {
+					chunks.WriteString(chunk)
+					return nil
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := r.LatestResponse, tt.response; got != want {
+				t.Errorf("response got %q want %q", got, want)
+			}
+			if got, want := chunks.String(), tt.response; got != want {
+				t.Errorf("streamed got %q want %q", got, want)
+			}
+			if got, want := r.FinishReason, tt.finishReason; got != want {
+				t.Errorf("finish reason got %s want %s", got, want)
+			}
+			if got, want := r.Truncated, tt.finishReason == "MAX_TOKENS"; got != want {
+				t.Errorf("truncated got %t want %t", got, want)
+			}
+			if got, want := r.Continuations, tt.continuations; got != want {
+				t.Errorf("got %d continuations want %d", got, want)
+			}
+			requests := fake.Requests()
+			if got, want := len(requests), tt.requests; got != want {
+				t.Fatalf("got %d requests want %d", got, want)
+			}
+			if tt.requests > 1 {
+				last := requests[len(requests)-1].Contents
+				if got, want := contentText(last[len(last)-1]), continuePrompt; got != want {
+					t.Errorf("continuation prompt got %q want %q", got, want)
+				}
+			}
+
+			var fullHistory []APIConversation
+			if err := json.Unmarshal([]byte(r.FullHistory), &fullHistory); err != nil {
+				t.Fatal(err)
+			}
+			want := []APIConversation{
+				{Role: "user", Parts: []string{"Write a programme."}},
+				{Role: "model", Parts: []string{tt.response}},
+			}
+			if diff := cmp.Diff(want, fullHistory); diff != "" {
+				t.Errorf("history mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestAPIGetResponseCandidates tests the selection of one of several
+// candidate responses for the history.
+func TestAPIGetResponseCandidates(t *testing.T) {
+
+	fake := NewFakeBackend(FakeReply{Text: "First draft.", Thoughts: "Drafting.", Candidates: []string{"Second draft."}})
+	settings := fakeSettings()
+	settings.KeepThoughts = true
+	r, err := APIGetResponseContext(context.Background(), settings, nil, "Write a draft.", WithBackend(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.LatestResponse, "First draft."; got != want {
+		t.Errorf("response got %q want %q", got, want)
+	}
+	if got, want := len(r.Candidates), 2; got != want {
+		t.Fatalf("got %d candidates want %d", got, want)
+	}
+	if got, want := r.FullHistory, r.Candidates[0].FullHistory; got != want {
+		t.Errorf("history of the response differs from that of the first candidate:\n%s\n%s", got, want)
+	}
+
+	if err := r.Select(1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.LatestResponse, "Second draft."; got != want {
+		t.Errorf("selected response got %q want %q", got, want)
+	}
+	if got, want := r.Thoughts, ""; got != want {
+		t.Errorf("selected thoughts got %q want %q", got, want)
+	}
+	var fullHistory []APIConversation
+	if err := json.Unmarshal([]byte(r.FullHistory), &fullHistory); err != nil {
+		t.Fatal(err)
+	}
+	want := []APIConversation{
+		{Role: "user", Parts: []string{"Write a draft."}},
+		{Role: "model", Parts: []string{"Second draft."}},
+	}
+	if diff := cmp.Diff(want, fullHistory); diff != "" {
+		t.Errorf("history mismatch (-want +got):\n%s", diff)
+	}
+	if got, want := r.Metadata().Candidate, 2; got != want {
+		t.Errorf("metadata candidate got %d want %d", got, want)
+	}
+
+	if err := r.Select(2); err == nil {
+		t.Error("expected an error selecting a missing candidate")
+	}
+}
+
+// TestAPIGetResponseFallback tests falling back to the fallback models
+// when the model is unavailable once retries are exhausted.
+func TestAPIGetResponseFallback(t *testing.T) {
+
+	overloaded := FakeReply{Err: &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "overloaded"}}
+	notFound := FakeReply{Err: &googleapi.Error{Code: http.StatusNotFound, Message: "model not found"}}
+	badRequest := FakeReply{Err: &googleapi.Error{Code: http.StatusBadRequest, Message: "bad request"}}
+	ok := FakeReply{Text: "Fine."}
+
+	tests := []struct {
+		name      string
+		fallbacks []string
+		replies   []FakeReply
+		models    []string // the models of each request
+		model     string
+		requested string
+		err       bool
+	}{
+		{
+			name:    "no fallback needed",
+			replies: []FakeReply{ok},
+			models:  []string{"gemini-2.5-pro"},
+			model:   "gemini-2.5-pro",
+		},
+		{
+			name:      "overloaded",
+			fallbacks: []string{"fast", "gemini-2.0-flash"},
+			replies:   []FakeReply{overloaded, overloaded, ok},
+			models:    []string{"gemini-2.5-pro", "gemini-2.5-pro", "gemini-2.5-flash"},
+			model:     "gemini-2.5-flash",
+			requested: "gemini-2.5-pro",
+		},
+		{
+			name:      "not found",
+			fallbacks: []string{"fast", "gemini-2.0-flash"},
+			replies:   []FakeReply{notFound, overloaded, overloaded, ok},
+			models:    []string{"gemini-2.5-pro", "gemini-2.5-flash", "gemini-2.5-flash", "gemini-2.0-flash"},
+			model:     "gemini-2.0-flash",
+			requested: "gemini-2.5-pro",
+		},
+		{
+			name:      "bad request",
+			fallbacks: []string{"fast"},
+			replies:   []FakeReply{badRequest},
+			models:    []string{"gemini-2.5-pro"},
+			err:       true,
+		},
+		{
+			name:      "all unavailable",
+			fallbacks: []string{"fast"},
+			replies:   []FakeReply{overloaded, overloaded, notFound},
+			models:    []string{"gemini-2.5-pro", "gemini-2.5-pro", "gemini-2.5-flash"},
+			err:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := fakeSettings()
+			settings.Retry.MaxAttempts = 2
+			settings.ModelName = "deep"
+			settings.ModelAliases = map[string]string{"fast": "gemini-2.5-flash", "deep": "gemini-2.5-pro"}
+			settings.FallbackModels = tt.fallbacks
+			fake := NewFakeBackend(tt.replies...)
+			response, err := APIGetResponseContext(context.Background(), settings, nil, "How are you?", WithBackend(fake))
+			var models []string
+			for _, r := range fake.Requests() {
+				models = append(models, r.Model)
+			}
+			if diff := cmp.Diff(tt.models, models); diff != "" {
+				t.Errorf("request models mismatch (-want +got):\n%s", diff)
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := response.Model, tt.model; got != want {
+				t.Errorf("model got %s want %s", got, want)
+			}
+			if got, want := response.Metadata().RequestedModel, tt.requested; got != want {
+				t.Errorf("requested model got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestAPIGetResponseCost tests the estimated cost of a response and
+// refusing requests once a cost cap is reached.
+func TestAPIGetResponseCost(t *testing.T) {
+
+	usage := &Usage{PromptTokens: 100_000, CandidatesTokens: 1000, ThoughtsTokens: 1000, TotalTokens: 102_000}
+	fake := NewFakeBackend(FakeReply{Text: "Fine.", Usage: usage})
+	settings := fakeSettings()
+	settings.CostCapChat, settings.CostCapDay = 0.1, 10
+	spending := OpenSpending("")
+	response, err := APIGetResponseContext(context.Background(), settings, nil, "How are you?",
+		WithBackend(fake), WithSpending(spending, "chat1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := (100_000*1.25 + 2000*10.0) / 1e6
+	if got := response.Cost; math.Abs(got-want) > 1e-9 {
+		t.Errorf("cost got %g want %g", got, want)
+	}
+	if got := response.Metadata().Cost; got != response.Cost {
+		t.Errorf("metadata cost got %g want %g", got, response.Cost)
+	}
+
+	chatCost, dayCost, err := spending.Spent("chat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chatCost != response.Cost || dayCost != response.Cost {
+		t.Errorf("spent got %g and %g want %g", chatCost, dayCost, response.Cost)
+	}
+
+	// the chat has passed its cap of $0.10, so its requests are refused
+	_, err = APIGetResponseContext(context.Background(), settings, nil, "How are you?",
+		WithBackend(fake), WithSpending(spending, "chat1"))
+	if !errors.Is(err, ErrCostCap) {
+		t.Errorf("got error %v want ErrCostCap", err)
+	}
+	if got, want := len(fake.Requests()), 1; got != want {
+		t.Errorf("got %d requests want %d", got, want)
+	}
+}
+
+// TestAPIGetResponseReserve tests that the cost of the prompt and of
+// the maxOutputTokens setting is reserved while a request is sent.
+func TestAPIGetResponseReserve(t *testing.T) {
+
+	usage := &Usage{PromptTokens: 1000, CandidatesTokens: 10, TotalTokens: 1010}
+	fake := NewFakeBackend(FakeReply{Text: "Fine.", Usage: usage})
+	settings := fakeSettings()
+	settings.MaxOutputTokens = genai.Ptr[int32](8000)
+	spending := OpenSpending("")
+	prompt := strings.Repeat("word ", 800)
+	var reserved float64
+	_, err := APIGetResponseContext(context.Background(), settings, nil, prompt,
+		WithBackend(fake), WithSpending(spending, "chat1"),
+		WithStream(func(string) error {
+			var err error
+			reserved, _, err = spending.Spent("chat1")
+			return err
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := (float64(len(prompt)/estimateCharsPerToken)*1.25 + 8000*10.0) / 1e6
+	if math.Abs(reserved-want) > 1e-9 {
+		t.Errorf("reserved got %g want %g", reserved, want)
+	}
+}
+
+// TestAPIGetResponseLogger tests the structured logging of a request to
+// a logger provided with WithLogger.
+func TestAPIGetResponseLogger(t *testing.T) {
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "overloaded"}
+	fake := NewFakeBackend(FakeReply{Err: unavailable}, FakeReply{Text: "Fine."})
+	settings := fakeSettings()
+	settings.Logging = false // ignored when a logger is provided
+	_, err := APIGetResponseContext(context.Background(), settings, nil, "How are you?", WithBackend(fake), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[string]map[string]any{}
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records[record["msg"].(string)] = record
+	}
+	for msg, fields := range map[string]map[string]any{
+		"attempt failed, retrying": {"attempt": float64(1), "maxAttempts": float64(3)},
+		"response received":        {"model": "gemini-2.5-pro", "attempt": float64(2)},
+		"usage":                    {"model": "gemini-2.5-pro", "promptTokens": float64(3), "outputTokens": float64(1)},
+	} {
+		record, ok := records[msg]
+		if !ok {
+			t.Errorf("%q not logged", msg)
+			continue
+		}
+		for k, want := range fields {
+			if got := record[k]; got != want {
+				t.Errorf("%q %s got %v want %v", msg, k, got, want)
+			}
+		}
+		if _, ok := record["duration"]; !ok && msg != "attempt failed, retrying" {
+			t.Errorf("%q duration not logged", msg)
+		}
+	}
+}
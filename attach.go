@@ -0,0 +1,162 @@
+package genact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// MaxInlineSize is the maximum total size of the attachments sent inline
+// with a request. The Gemini api limits inline requests to 20MB; larger
+// attachments are uploaded with the File API.
+const MaxInlineSize = 20 << 20
+
+// MaxAttachmentSize is the maximum size of an attachment, the File API
+// limit.
+const MaxAttachmentSize = 2 << 30
+
+// attachmentDir is the directory, relative to a history file, in which
+// attachments referenced by the history are saved.
+const attachmentDir = "attachments"
+
+// mimeExtensions are the supported attachment MIME types and the file
+// extensions used when saving them.
+var mimeExtensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/webp":      ".webp",
+	"image/heic":      ".heic",
+	"image/heif":      ".heif",
+	"application/pdf": ".pdf",
+	"audio/wav":       ".wav",
+	"audio/mp3":       ".mp3",
+	"audio/aiff":      ".aiff",
+	"audio/aac":       ".aac",
+	"audio/ogg":       ".ogg",
+	"audio/flac":      ".flac",
+	"text/plain":      ".txt",
+	"text/markdown":   ".md",
+	"text/csv":        ".csv",
+	"text/html":       ".html",
+}
+
+// mimeAliases maps sniffed or extension derived MIME types to those
+// accepted by the api.
+var mimeAliases = map[string]string{
+	"audio/wave":      "audio/wav",
+	"audio/x-wav":     "audio/wav",
+	"audio/mpeg":      "audio/mp3",
+	"audio/x-aiff":    "audio/aiff",
+	"audio/x-flac":    "audio/flac",
+	"application/ogg": "audio/ogg",
+}
+
+// sniffMIMEType determines the MIME type of an attachment from its
+// content, falling back to the file extension for content, such as
+// text, which cannot be identified reliably.
+func sniffMIMEType(path string, data []byte) (string, error) {
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if mimeType == "application/octet-stream" || strings.HasPrefix(mimeType, "text/") {
+		if ext, _, _ := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(path))); ext != "" {
+			mimeType = ext
+		}
+	}
+	if alias, ok := mimeAliases[mimeType]; ok {
+		mimeType = alias
+	}
+	if _, ok := mimeExtensions[mimeType]; !ok {
+		return "", fmt.Errorf("attachment %s has unsupported type %s", path, mimeType)
+	}
+	return mimeType, nil
+}
+
+// LoadAttachment reads a local file as a genai.Blob for sending as part
+// of a prompt, such as an image, pdf or audio file. The MIME type is
+// sniffed from the file content.
+func LoadAttachment(path string) (genai.Blob, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return genai.Blob{}, fmt.Errorf("could not read attachment: %w", err)
+	}
+	switch {
+	case info.IsDir():
+		return genai.Blob{}, fmt.Errorf("attachment %s is a directory", path)
+	case info.Size() == 0:
+		return genai.Blob{}, fmt.Errorf("attachment %s is empty", path)
+	case info.Size() > MaxAttachmentSize:
+		return genai.Blob{}, fmt.Errorf("attachment %s size %d exceeds the %d byte limit", path, info.Size(), MaxAttachmentSize)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return genai.Blob{}, fmt.Errorf("could not read attachment: %w", err)
+	}
+	mimeType, err := sniffMIMEType(path, data)
+	if err != nil {
+		return genai.Blob{}, err
+	}
+	return genai.Blob{MIMEType: mimeType, Data: data}, nil
+}
+
+// LoadAttachments loads each attachment with LoadAttachment.
+func LoadAttachments(paths ...string) ([]genai.Blob, error) {
+	blobs := []genai.Blob{}
+	for _, p := range paths {
+		b, err := LoadAttachment(p)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, nil
+}
+
+// attachmentPath returns the path of an attachment relative to the
+// history file referencing it. Attachments are named by a hash of their
+// content, so the same attachment is only saved once in a chat.
+func attachmentPath(b genai.Blob) string {
+	sum := sha256.Sum256(b.Data)
+	ext, ok := mimeExtensions[b.MIMEType]
+	if !ok {
+		ext = ".bin"
+	}
+	return filepath.ToSlash(filepath.Join(attachmentDir, hex.EncodeToString(sum[:8])+ext))
+}
+
+// SaveAttachments saves attachments in dir, normally a chat directory,
+// so that they can be replayed with the history saved in dir.
+func SaveAttachments(dir string, blobs []genai.Blob) error {
+	for _, b := range blobs {
+		path := filepath.Join(dir, filepath.FromSlash(attachmentPath(b)))
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("could not make attachment directory: %w", err)
+		}
+		if err := os.WriteFile(path, b.Data, 0644); err != nil {
+			return fmt.Errorf("could not save attachment: %w", err)
+		}
+	}
+	return nil
+}
+
+// readAttachment reads an attachment referenced by a history file in
+// dir.
+func readAttachment(dir string, a APIAttachment) (genai.Blob, error) {
+	if a.Path == "" || a.MIMEType == "" {
+		return genai.Blob{}, errors.New("attachment reference missing path or MIME type")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(a.Path)))
+	if err != nil {
+		return genai.Blob{}, fmt.Errorf("could not read history attachment: %w", err)
+	}
+	return genai.Blob{MIMEType: a.MIMEType, Data: data}, nil
+}
@@ -0,0 +1,112 @@
+package genact
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestLoadAttachment tests loading attachments, including MIME type
+// sniffing and size checks.
+func TestLoadAttachment(t *testing.T) {
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	tests := []struct {
+		desc     string
+		path     string
+		mimeType string
+		errText  string
+	}{
+		{"png", write("diagram.png", png), "image/png", ""},
+		{"png with wrong extension", write("diagram.txt", png), "image/png", ""},
+		{"pdf", write("spec.pdf", []byte("%PDF-1.7\n%âãÏÓ\n")), "application/pdf", ""},
+		{"wav", write("note.wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt ")), "audio/wav", ""},
+		{"markdown", write("notes.md", []byte("# Notes\n")), "text/markdown", ""},
+		{"text", write("notes.txt", []byte("some notes\n")), "text/plain", ""},
+		{"empty", write("empty.png", nil), "", "is empty"},
+		{"unsupported", write("archive.zip", []byte("PK\x03\x04\x14\x00\x00\x00")), "", "unsupported type application/zip"},
+		{"directory", dir, "", "is a directory"},
+		{"missing", filepath.Join(dir, "missing.png"), "", "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			b, err := LoadAttachment(tt.path)
+			if tt.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errText) {
+					t.Fatalf("expected error containing %q, got %v", tt.errText, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := b.MIMEType, tt.mimeType; got != want {
+				t.Errorf("MIME type got %s want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestAttachmentHistory tests that attachments are referenced in a
+// history file and replayed when it is read.
+func TestAttachmentHistory(t *testing.T) {
+
+	dir := t.TempDir()
+	blob := genai.Blob{MIMEType: "image/png", Data: []byte("\x89PNG\r\n\x1a\nimage data")}
+	history := []*genai.Content{
+		{Role: "user", Parts: []genai.Part{genai.Text("What is in this image?"), blob}},
+		{Role: "model", Parts: []genai.Part{genai.Text("A diagram.")}},
+	}
+
+	apiHistory, err := aiContentToAPI(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(apiHistory[0].Attachments), 1; got != want {
+		t.Fatalf("got %d attachments want %d", got, want)
+	}
+	if got, want := apiHistory[0].Attachments[0].Path, attachmentPath(blob); got != want {
+		t.Errorf("attachment path got %s want %s", got, want)
+	}
+	if err := SaveAttachments(dir, []genai.Blob{blob}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(apiHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyFile := filepath.Join(dir, "history.json")
+	if err := os.WriteFile(historyFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := HistoryAPIToAIContent(historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(history, got); diff != "" {
+		t.Errorf("history mismatch (-want +got):\n%s", diff)
+	}
+
+	// a missing attachment is an error
+	if err := os.RemoveAll(filepath.Join(dir, attachmentDir)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HistoryAPIToAIContent(historyFile); err == nil {
+		t.Error("expected missing attachment error")
+	}
+}
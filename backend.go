@@ -0,0 +1,146 @@
+package genact
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Backends, for the "backend" setting.
+const (
+	BackendGemini = "gemini" // the Gemini api, the default
+	BackendOpenAI = "openai" // an OpenAI-compatible chat completions api
+	BackendFake   = "fake"   // a FakeBackend echoing prompts, for demonstrations
+)
+
+// Backend sends requests to a language model api. Requests and
+// responses are expressed with genai types, which are also used for
+// histories, so that chats and history files may be used with any
+// backend. A Backend is used for a single call of APIGetResponseContext
+// or APICountTokens, which handle retries, function calls and JSON
+// validation.
+type Backend interface {
+
+	// Send sends a request, returning the model response.
+	Send(ctx context.Context, req *BackendRequest) (*BackendResponse, error)
+
+	// Stream is like Send but streams the response, calling chunkFunc
+	// with each text chunk as it arrives. An error returned from
+	// chunkFunc stops the stream.
+	Stream(ctx context.Context, req *BackendRequest, chunkFunc func(string) error) (*BackendResponse, error)
+
+	// CountTokens counts the input tokens of a request, reporting the
+	// context limit of the model if known.
+	CountTokens(ctx context.Context, req *BackendRequest) (TokenCount, error)
+
+	// Close releases the resources of the backend.
+	Close() error
+}
+
+// BackendRequest is a request to a Backend.
+type BackendRequest struct {
+	Model             string
+	SystemInstruction string
+	Contents          []*genai.Content // the history followed by the latest user turn
+	Tools             []*genai.Tool
+	JSONOutput        bool          // request a JSON response
+	Schema            *genai.Schema // the JSON response schema, if any
+}
+
+// BackendResponse is the response to a BackendRequest.
+type BackendResponse struct {
+	Content      *genai.Content // the model turn, without thoughts
+	FinishReason string
+	Usage        Usage
+	Thoughts     string     // thought summaries, if any
+	ModelVersion string     // the model version reported by the api
+	Cache        *CacheInfo // the Gemini cache used, if any
+
+	// Candidates are the candidate responses, the first being that above,
+	// when several were requested with the "candidateCount" setting.
+	// Candidates which were stopped or empty are omitted.
+	Candidates []BackendCandidate
+}
+
+// BackendCandidate is one of several candidate responses to a request.
+type BackendCandidate struct {
+	Content      *genai.Content
+	FinishReason string
+	Thoughts     string
+}
+
+// functionCalls returns the function calls of a response.
+func (r *BackendResponse) functionCalls() []genai.FunctionCall {
+	var calls []genai.FunctionCall
+	for _, p := range r.Content.Parts {
+		if fc, ok := p.(genai.FunctionCall); ok {
+			calls = append(calls, fc)
+		}
+	}
+	return calls
+}
+
+// text returns the text of a response.
+func (r *BackendResponse) text() string {
+	return partsText(r.Content)
+}
+
+// partsText returns the text parts of a content joined together.
+func partsText(c *genai.Content) string {
+	var text string
+	for _, p := range c.Parts {
+		if t, ok := p.(genai.Text); ok {
+			text += string(t)
+		}
+	}
+	return text
+}
+
+// newBackend returns the backend for a request, that provided with
+// WithBackend or otherwise that selected by the "backend" setting. The
+// returned close function closes the backend unless it was provided
+// by the caller.
+func newBackend(ctx context.Context, settings *Settings, ro *requestOptions) (Backend, func(), error) {
+	if ro.backend != nil {
+		return ro.backend, func() {}, nil
+	}
+	base, err := ro.transport(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+	var backend Backend
+	switch settings.Backend {
+	case "", BackendGemini:
+		backend, err = newGeminiBackend(ctx, settings, base, ro.uploads, ro.cache, ro.logger)
+	case BackendOpenAI:
+		backend = newOpenAIBackend(settings, base, ro.logger)
+	case BackendFake:
+		backend = NewFakeBackend()
+	default:
+		err = fmt.Errorf("unknown backend %q", settings.Backend)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not start chat: %w", err)
+	}
+	return backend, func() { _ = backend.Close() }, nil
+}
+
+// transport returns the http transport used by backends, which records
+// or replays requests if a cassette is provided with WithCassette or by
+// the "cassette" setting.
+func (ro *requestOptions) transport(settings *Settings) (http.RoundTripper, error) {
+	cassette := ro.cassette
+	if cassette == nil && settings.Cassette != "" {
+		var err error
+		cassette, err = OpenCassette(settings.Cassette, settings.CassetteMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cassette == nil {
+		return http.DefaultTransport, nil
+	}
+	return cassette.transport(http.DefaultTransport, settings.APIKey), nil
+}
@@ -0,0 +1,127 @@
+package genact
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// cacheExpiryMargin is the time before its expiry after which a cache is
+// no longer reused, allowing for the duration of the request.
+const cacheExpiryMargin = 2 * time.Minute
+
+// CacheInfo records a Gemini cached content entry holding the system
+// instruction and the leading contents of a chat history, so that the
+// cache may be reused by later requests in the same chat. CacheInfo is
+// suitable for saving as json in a chat directory.
+type CacheInfo struct {
+	Name     string    `json:"name"`     // the cache name, such as cachedContents/xyz
+	Model    string    `json:"model"`    // the model the cache was made for
+	Expires  time.Time `json:"expires"`  // the cache expiry time
+	Contents int       `json:"contents"` // the number of history contents cached
+	Hash     string    `json:"hash"`     // a hash of the cached model, instruction and contents
+}
+
+// cacheHash returns a hash of the model, system instruction and
+// contents, used to check that a cache matches the start of a history.
+func cacheHash(model, systemInstruction string, contents []*genai.Content) (string, error) {
+	b, err := json.Marshal(struct {
+		Model             string
+		SystemInstruction string
+		Contents          []*genai.Content
+	}{model, systemInstruction, contents})
+	if err != nil {
+		return "", fmt.Errorf("could not encode cache contents: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// reusable reports whether the cache is unexpired and holds the system
+// instruction and the leading contents of history for model.
+func (c *CacheInfo) reusable(model, systemInstruction string, history []*genai.Content, now time.Time) bool {
+	if c == nil || c.Name == "" || c.Model != model || c.Contents < 1 || c.Contents > len(history) {
+		return false
+	}
+	if now.Add(cacheExpiryMargin).After(c.Expires) {
+		return false
+	}
+	hash, err := cacheHash(model, systemInstruction, history[:c.Contents])
+	return err == nil && hash == c.Hash
+}
+
+// modelResourceName returns the resource name of a model, such as
+// models/gemini-2.5-pro.
+func modelResourceName(model string) string {
+	if strings.Contains(model, "/") {
+		return model
+	}
+	return "models/" + model
+}
+
+// cacheContents returns a cache holding the system instruction and
+// history for model. The previous cache, prev, is reused if it is
+// unexpired and matches the start of history, in which case only the
+// history following the cached contents needs to be sent. Otherwise a
+// new cache is made for the whole history and any previous cache, which
+// no longer matches the history, is deleted.
+func cacheContents(ctx context.Context, client *genai.Client, settings *Settings, model, systemInstruction string, history []*genai.Content, prev *CacheInfo, logger *slog.Logger) (*CacheInfo, error) {
+
+	if prev.reusable(model, systemInstruction, history, time.Now()) {
+		logger.Info("using cache", "cache", prev.Name, "contents", prev.Contents)
+		return prev, nil
+	}
+	if len(history) == 0 {
+		return nil, errors.New("no history to cache")
+	}
+
+	hash, err := cacheHash(model, systemInstruction, history)
+	if err != nil {
+		return nil, err
+	}
+	cc := &genai.CachedContent{
+		Model:      model,
+		Contents:   history,
+		Expiration: genai.ExpireTimeOrTTL{TTL: settings.CacheTTL},
+	}
+	if systemInstruction != "" {
+		cc.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(systemInstruction)}}
+	}
+	var created *genai.CachedContent
+	err = withRetry(ctx, settings.Retry, logger, func() error {
+		var err error
+		created, err = client.CreateCachedContent(ctx, cc)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create cache: %w", err)
+	}
+	info := &CacheInfo{
+		Name:     created.Name,
+		Model:    model,
+		Expires:  created.Expiration.ExpireTime,
+		Contents: len(history),
+		Hash:     hash,
+	}
+	if info.Expires.IsZero() {
+		info.Expires = time.Now().Add(settings.CacheTTL)
+	}
+	logger.Info("created cache", "cache", info.Name, "contents", info.Contents, "expires", info.Expires.Format(time.RFC3339))
+
+	if prev != nil && prev.Name != "" && time.Now().Before(prev.Expires) {
+		if err := client.DeleteCachedContent(ctx, prev.Name); err != nil {
+			logger.Warn("could not delete previous cache", "cache", prev.Name, "error", err)
+		} else {
+			logger.Info("deleted previous cache", "cache", prev.Name)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,120 @@
+package genact
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/rorycl/genact/genacttest"
+)
+
+// TestCacheReusable tests whether a previous cache is reused for a
+// history.
+func TestCacheReusable(t *testing.T) {
+
+	turn := func(role, text string) *genai.Content {
+		return &genai.Content{Role: role, Parts: []genai.Part{genai.Text(text)}}
+	}
+	history := []*genai.Content{
+		turn("user", "Tell me about tennis."),
+		turn("model", "Tennis is a racket sport."),
+	}
+	longer := append(history[:2:2], turn("user", "And squash?"), turn("model", "Squash is played indoors."))
+	compacted := []*genai.Content{turn("user", "Tennis summary."), turn("model", "A racket sport.")}
+
+	now := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	hash, err := cacheHash("gemini-2.5-pro", "Be brief.", history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &CacheInfo{
+		Name:     "cachedContents/abc",
+		Model:    "gemini-2.5-pro",
+		Expires:  now.Add(time.Hour),
+		Contents: 2,
+		Hash:     hash,
+	}
+
+	tests := []struct {
+		desc              string
+		cache             *CacheInfo
+		model             string
+		systemInstruction string
+		history           []*genai.Content
+		now               time.Time
+		reusable          bool
+	}{
+		{"same history", cache, "gemini-2.5-pro", "Be brief.", history, now, true},
+		{"extended history", cache, "gemini-2.5-pro", "Be brief.", longer, now, true},
+		{"no cache", nil, "gemini-2.5-pro", "Be brief.", history, now, false},
+		{"compacted history", cache, "gemini-2.5-pro", "Be brief.", compacted, now, false},
+		{"shorter history", cache, "gemini-2.5-pro", "Be brief.", history[:1], now, false},
+		{"changed instruction", cache, "gemini-2.5-pro", "Be verbose.", history, now, false},
+		{"changed model", cache, "gemini-2.5-flash", "Be brief.", history, now, false},
+		{"expired", cache, "gemini-2.5-pro", "Be brief.", history, now.Add(2 * time.Hour), false},
+		{"nearly expired", cache, "gemini-2.5-pro", "Be brief.", history, now.Add(59 * time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := tt.cache.reusable(tt.model, tt.systemInstruction, tt.history, tt.now)
+			if want := tt.reusable; got != want {
+				t.Errorf("reusable got %t want %t", got, want)
+			}
+		})
+	}
+}
+
+// TestPrepareCacheMinTokens tests that, without a pre-flight count, the
+// tokens of a request are estimated to decide whether it is cached.
+func TestPrepareCacheMinTokens(t *testing.T) {
+
+	srv := genacttest.NewServer()
+	defer srv.Close()
+
+	settings := defaultSettings()
+	settings.APIKey, settings.ModelName, settings.Endpoint = "key", "gemini-2.5-pro", srv.URL
+	settings.Retry.MaxAttempts = 1
+	settings.Cache, settings.CacheMinTokens = true, 1000
+
+	tests := []struct {
+		desc    string
+		text    string
+		logText string
+	}{
+		{"small request", "hello", "below cacheMinTokens"},
+		// the stand-in has no caching, so the attempt to cache fails
+		{"large request", strings.Repeat("hello ", 1000), "not using cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			b, err := newGeminiBackend(context.Background(), &settings, nil, nil, nil, slog.New(slog.NewTextHandler(&buf, nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = b.Close() }()
+			req := &BackendRequest{
+				Model: settings.ModelName,
+				Contents: []*genai.Content{
+					{Role: "user", Parts: []genai.Part{genai.Text(tt.text)}},
+					{Role: "model", Parts: []genai.Part{genai.Text("hi")}},
+					{Role: "user", Parts: []genai.Part{genai.Text("again")}},
+				},
+			}
+			_, _, _, info, err := b.prepare(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info != nil {
+				t.Errorf("unexpected cache %+v", info)
+			}
+			if !strings.Contains(buf.String(), tt.logText) {
+				t.Errorf("log %q does not contain %q", buf.String(), tt.logText)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package genact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Cassette modes, for the "cassetteMode" setting.
+const (
+	CassetteRecord = "record" // record interactions with the api
+	CassetteReplay = "replay" // replay recorded interactions without network access
+)
+
+// redacted replaces the api key in recorded interactions. Keys shorter
+// than minRedactLength, such as the placeholder keys used when
+// replaying, are not redacted since they may match other text.
+const (
+	redacted        = "REDACTED"
+	minRedactLength = 16
+)
+
+// ErrCassetteMismatch is returned when replaying a cassette if a request
+// does not match any of the unused recorded interactions.
+var ErrCassetteMismatch = errors.New("request does not match the cassette")
+
+// Cassette is a record of the http interactions of requests with an
+// api, saved as a json file. In record mode each request and response
+// is added to the cassette file, with the api key redacted, as the
+// response is read. In replay mode the recorded responses are served
+// byte-for-byte, without network access, to matching requests.
+//
+// A request matches an interaction if it has the same method, url and
+// body, json bodies being compared by value since the genai package
+// does not encode requests consistently. Each interaction is replayed
+// once, in the order recorded when several match.
+//
+// Set the "cassette" and "cassetteMode" settings to record or replay
+// requests, or provide a Cassette with WithCassette to share it between
+// requests.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+
+	path string
+	mode string
+	mu   sync.Mutex
+	used []bool // the interactions replayed
+}
+
+// Interaction is a recorded request and response.
+type Interaction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+// CassetteRequest is a recorded request.
+type CassetteRequest struct {
+	Method string        `json:"method"`
+	URL    string        `json:"url"`
+	Header http.Header   `json:"header,omitempty"`
+	Body   *CassetteBody `json:"body,omitempty"`
+}
+
+// CassetteResponse is a recorded response.
+type CassetteResponse struct {
+	StatusCode int           `json:"statusCode"`
+	Header     http.Header   `json:"header,omitempty"`
+	Body       *CassetteBody `json:"body,omitempty"`
+}
+
+// CassetteBody is a recorded request or response body. Bodies which are
+// not valid utf-8, such as those of file uploads, are base64 encoded.
+type CassetteBody struct {
+	Text   string `json:"text,omitempty"`
+	Base64 string `json:"base64,omitempty"`
+}
+
+// newCassetteBody returns the body for b, or nil if b is empty.
+func newCassetteBody(b []byte) *CassetteBody {
+	switch {
+	case len(b) == 0:
+		return nil
+	case utf8.Valid(b):
+		return &CassetteBody{Text: string(b)}
+	}
+	return &CassetteBody{Base64: base64.StdEncoding.EncodeToString(b)}
+}
+
+// bytes returns the body content.
+func (cb *CassetteBody) bytes() ([]byte, error) {
+	switch {
+	case cb == nil:
+		return nil, nil
+	case cb.Base64 != "":
+		return base64.StdEncoding.DecodeString(cb.Base64)
+	}
+	return []byte(cb.Text), nil
+}
+
+// OpenCassette opens the cassette file at path in CassetteRecord or
+// CassetteReplay mode. A cassette to be replayed must exist; when
+// recording, new interactions are added to the existing cassette, if
+// any.
+func OpenCassette(path, mode string) (*Cassette, error) {
+	if mode != CassetteRecord && mode != CassetteReplay {
+		return nil, fmt.Errorf("cassette mode %q must be %s or %s", mode, CassetteRecord, CassetteReplay)
+	}
+	c := &Cassette{path: path, mode: mode}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && mode == CassetteRecord:
+	case err != nil:
+		return nil, fmt.Errorf("could not read cassette: %w", err)
+	default:
+		if err := json.Unmarshal(b, c); err != nil {
+			return nil, fmt.Errorf("could not decode cassette %s: %w", path, err)
+		}
+	}
+	c.used = make([]bool, len(c.Interactions))
+	return c, nil
+}
+
+// Unused returns the number of interactions not yet replayed. A test
+// replaying a cassette may check that all interactions were used.
+func (c *Cassette) Unused() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, u := range c.used {
+		if !u {
+			n++
+		}
+	}
+	return n
+}
+
+// transport returns an http.RoundTripper recording the requests made
+// with base, or replaying them, according to the cassette mode. The
+// apiKey is redacted from recorded requests and responses.
+func (c *Cassette) transport(base http.RoundTripper, apiKey string) http.RoundTripper {
+	return &cassetteTransport{cassette: c, base: base, apiKey: apiKey}
+}
+
+// add adds an interaction to the cassette, saving the cassette file.
+func (c *Cassette) add(i Interaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, i)
+	c.used = append(c.used, true)
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode cassette: %w", err)
+	}
+	if err := os.WriteFile(c.path, b, 0644); err != nil {
+		return fmt.Errorf("could not write cassette: %w", err)
+	}
+	return nil
+}
+
+// match returns the first unused interaction matching a request, marking
+// it as used. If none match, the error describes the closest
+// interaction, if any, with the same method and url.
+func (c *Cassette) match(req CassetteRequest) (Interaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var closest *Interaction
+	for i, in := range c.Interactions {
+		if c.used[i] || in.Request.Method != req.Method || in.Request.URL != req.URL {
+			continue
+		}
+		if bodiesEqual(in.Request.Body, req.Body) {
+			c.used[i] = true
+			return in, nil
+		}
+		if closest == nil {
+			closest = &c.Interactions[i]
+		}
+	}
+	if closest == nil {
+		return Interaction{}, fmt.Errorf("%w %s: no unused interaction for %s %s", ErrCassetteMismatch, c.path, req.Method, req.URL)
+	}
+	recorded, _ := closest.Request.Body.bytes()
+	got, _ := req.Body.bytes()
+	return Interaction{}, fmt.Errorf("%w %s: %s %s body differs from that recorded at byte %d",
+		ErrCassetteMismatch, c.path, req.Method, req.URL, firstDifference(recorded, got))
+}
+
+// bodiesEqual reports if two request bodies are equal, comparing json
+// bodies by value.
+func bodiesEqual(a, b *CassetteBody) bool {
+	ab, errA := a.bytes()
+	bb, errB := b.bytes()
+	if errA != nil || errB != nil {
+		return false
+	}
+	if bytes.Equal(ab, bb) {
+		return true
+	}
+	var av, bv any
+	if json.Unmarshal(ab, &av) != nil || json.Unmarshal(bb, &bv) != nil {
+		return false
+	}
+	ac, _ := json.Marshal(av)
+	bc, _ := json.Marshal(bv)
+	return bytes.Equal(ac, bc)
+}
+
+// firstDifference returns the offset of the first difference between a
+// and b.
+func firstDifference(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// cassetteTransport is the http.RoundTripper of a Cassette.
+type cassetteTransport struct {
+	cassette *Cassette
+	base     http.RoundTripper
+	apiKey   string
+}
+
+// redact removes the api key from s.
+func (t *cassetteTransport) redact(s string) string {
+	if len(t.apiKey) < minRedactLength {
+		return s
+	}
+	return strings.ReplaceAll(s, t.apiKey, redacted)
+}
+
+// request returns the redacted record of a request, reading its body.
+func (t *cassetteTransport) request(req *http.Request) (CassetteRequest, error) {
+	cr := CassetteRequest{Method: req.Method, URL: t.redact(req.URL.String())}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		cr.Header = http.Header{"Content-Type": {ct}}
+	}
+	if req.Body == nil {
+		return cr, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return cr, fmt.Errorf("could not read request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	cr.Body = newCassetteBody([]byte(t.redact(string(body))))
+	return cr, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	cr, err := t.request(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.cassette.mode == CassetteReplay {
+		return t.replay(req, cr)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	header := resp.Header.Clone()
+	for k, vs := range header {
+		for i, v := range vs {
+			header[k][i] = t.redact(v)
+		}
+	}
+	in := Interaction{
+		Request:  cr,
+		Response: CassetteResponse{StatusCode: resp.StatusCode, Header: header},
+	}
+	resp.Body = &recordingBody{ReadCloser: resp.Body, done: func(body []byte) error {
+		in.Response.Body = newCassetteBody([]byte(t.redact(string(body))))
+		return t.cassette.add(in)
+	}}
+	return resp, nil
+}
+
+// replay returns the recorded response to a request.
+func (t *cassetteTransport) replay(req *http.Request, cr CassetteRequest) (*http.Response, error) {
+	in, err := t.cassette.match(cr)
+	if err != nil {
+		return nil, err
+	}
+	body, err := in.Response.Body.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("could not decode cassette response: %w", err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Response.StatusCode, http.StatusText(in.Response.StatusCode)),
+		StatusCode:    in.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        in.Response.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// recordingBody is a response body which records the body as it is
+// read, calling done with the body once it has been read or closed.
+type recordingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func([]byte) error
+	once sync.Once
+	err  error
+}
+
+func (r *recordingBody) finish() error {
+	r.once.Do(func() { r.err = r.done(r.buf.Bytes()) })
+	return r.err
+}
+
+func (r *recordingBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	if err == io.EOF {
+		if ferr := r.finish(); ferr != nil {
+			return n, ferr
+		}
+	}
+	return n, err
+}
+
+func (r *recordingBody) Close() error {
+	err := r.ReadCloser.Close()
+	if ferr := r.finish(); ferr != nil {
+		return ferr
+	}
+	return err
+}
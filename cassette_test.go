@@ -0,0 +1,115 @@
+package genact
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/genact/genacttest"
+)
+
+// TestCassette tests recording requests to the genacttest stand-in
+// with the api key redacted, replaying them without the stand-in and
+// the failure of a request which does not match the cassette.
+func TestCassette(t *testing.T) {
+
+	srv := genacttest.NewServer()
+	const apiKey = "AIzaTestKey0123456789"
+	settings := defaultSettings()
+	settings.APIKey, settings.ModelName, settings.Endpoint = apiKey, "gemini-2.5-pro", srv.URL
+	settings.Cassette = filepath.Join(t.TempDir(), "cassette.json")
+	settings.CassetteMode = CassetteRecord
+
+	history := []*genai.Content{
+		{Role: "user", Parts: []genai.Part{genai.Text("Hi")}},
+		{Role: "model", Parts: []genai.Part{genai.Text("Hello")}},
+	}
+	prompt := "Is my key " + apiKey + " secret?"
+	recorded, err := APICountTokens(context.Background(), &settings, history, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	b, err := os.ReadFile(settings.Cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), apiKey) {
+		t.Error("api key not redacted from cassette")
+	}
+	if !strings.Contains(string(b), "Is my key REDACTED secret?") {
+		t.Error("prompt not recorded in cassette")
+	}
+
+	cassette, err := OpenCassette(settings.Cassette, CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(cassette.Interactions), 2; got != want {
+		t.Fatalf("got %d interactions want %d", got, want)
+	}
+	settings.CassetteMode = CassetteReplay
+	replayed, err := APICountTokens(context.Background(), &settings, history, prompt, WithCassette(cassette))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(recorded, replayed); diff != "" {
+		t.Errorf("token count mismatch (-recorded +replayed):\n%s", diff)
+	}
+	if got := cassette.Unused(); got != 0 {
+		t.Errorf("%d interactions not replayed", got)
+	}
+
+	// a changed request fails without retries
+	settings.APIKey = "k"
+	_, err = APICountTokens(context.Background(), &settings, history, "Is my key secret?")
+	if !errors.Is(err, ErrCassetteMismatch) {
+		t.Fatalf("expected ErrCassetteMismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "body differs from that recorded at byte") {
+		t.Errorf("unexpected mismatch error %v", err)
+	}
+}
+
+// TestCassetteStream tests recording and replaying a streamed response
+// from an OpenAI-compatible server.
+func TestCassetteStream(t *testing.T) {
+
+	srv := newOpenAIServer(t, openAIReply{chunks: []string{
+		`{"model": "qwen3:8b", "choices": [{"delta": {"content": "Hi "}}]}`,
+		`{"choices": [{"delta": {"content": "there"}, "finish_reason": "stop"}]}`,
+	}})
+	settings := defaultSettings()
+	settings.Backend, settings.ModelName, settings.Endpoint = BackendOpenAI, "qwen3:8b", srv.URL+"/v1"
+	settings.Cassette = filepath.Join(t.TempDir(), "cassette.json")
+
+	send := func(mode string) ([]string, *ApiResponse) {
+		t.Helper()
+		settings.CassetteMode = mode
+		var chunks []string
+		r, err := APIGetResponseContext(context.Background(), &settings, nil, "Hi", WithStream(func(s string) error {
+			chunks = append(chunks, s)
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chunks, r
+	}
+	recordedChunks, recorded := send(CassetteRecord)
+	srv.Close()
+	replayedChunks, replayed := send(CassetteReplay)
+
+	if diff := cmp.Diff(recordedChunks, replayedChunks); diff != "" {
+		t.Errorf("chunks mismatch (-recorded +replayed):\n%s", diff)
+	}
+	if got, want := replayed.FullHistory, recorded.FullHistory; got != want {
+		t.Errorf("history got %s want %s", got, want)
+	}
+}
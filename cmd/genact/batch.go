@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/genact"
+)
+
+var batchUsage string = fmt.Sprintf(`batch [options] input
+
+version %s
+
+Run many prompts, each in its own chat, from a JSONL file or a
+directory of prompt files. Each line of a JSONL file is a json object
+with a "chat" name, the "prompt" text or a "promptFile" and, optionally,
+a list of "attach" files, for example:
+
+	{"chat": "report-1", "promptFile": "prompts/report-1.txt", "attach": ["data/1.pdf"]}
+	{"chat": "report-2", "prompt": "Summarise the attached report.", "attach": ["data/2.pdf"]}
+
+Relative paths are relative to the JSONL file. In a directory, each
+file is a prompt run in the chat named after the file without its
+extension. The files in a sub-directory of the same name, if any, are
+attached to the prompt:
+
+	prompts/
+	├── report-1.txt
+	├── report-1
+	│   └── 1.pdf
+	└── report-2.txt
+
+Each prompt continues its chat from the latest history, if any, and
+the turn is saved in the chat directory as genact does for a single
+prompt, except that output.md is not written. A prompt which fails is
+kept as a pending turn and the remaining prompts are run.
+
+Prompts are run by a pool of --workers, their requests being started
+no more often than --rpm requests per minute, if set. A summary of the
+successes, failures and tokens of each chat is printed and written as
+json to a timestamped _batch.json file in the conversations directory,
+or to the --report file. genact exits with 1 if any prompt failed.
+
+./genact batch [-d directory] [-y yaml] [-m model] [-i systemInstruction] \
+         [--preflight] [--workers n] [--rpm n] [--report file] \
+         [--log-format text|json] `, genact.Version)
+
+// BatchOptions are the flag options of the batch command.
+type BatchOptions struct {
+	Directory  string `short:"d" long:"directory" description:"directory" default:"current working directory"`
+	YamlFile   string `short:"y" long:"yamlFile" description:"settings yaml file" default:"settings.yaml"`
+	Model      string `short:"m" long:"model" description:"model name or alias, in place of the modelName setting"`
+	SystemFile string `short:"i" long:"systemInstruction" description:"path to system instruction text file"`
+	Preflight  bool   `long:"preflight" description:"count and check the tokens of each request before sending it"`
+	Workers    int    `short:"w" long:"workers" description:"number of prompts run at once" default:"4"`
+	RPM        int    `long:"rpm" description:"maximum requests started per minute, 0 for no limit" default:"0"`
+	Report     string `long:"report" description:"path of the json summary report"`
+	LogFormat  string `long:"log-format" description:"format of the log written to stderr" choice:"text" choice:"json" default:"text"`
+	Args       struct {
+		Input string `description:"JSONL file or directory of prompt files"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// batchJob is a prompt run in a chat in batch mode.
+type batchJob struct {
+	Chat       string   `json:"chat"`
+	Prompt     string   `json:"prompt,omitempty"`
+	PromptFile string   `json:"promptFile,omitempty"`
+	Attach     []string `json:"attach,omitempty"`
+}
+
+// batchResult is the outcome of a batchJob.
+type batchResult struct {
+	Chat         string       `json:"chat"`
+	OK           bool         `json:"ok"`
+	Error        string       `json:"error,omitempty"`
+	Output       string       `json:"output,omitempty"`
+	Model        string       `json:"model,omitempty"`
+	Cost         float64      `json:"cost,omitempty"`
+	FinishReason string       `json:"finishReason,omitempty"`
+	Truncated    bool         `json:"truncated,omitempty"`
+	LatencyMS    int64        `json:"latencyMs,omitempty"`
+	Usage        genact.Usage `json:"usage"`
+}
+
+// batchReport is the summary report of a batch run.
+type batchReport struct {
+	Input     string            `json:"input"`
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Usage     genact.UsageTotal `json:"usage"`
+	Cost      float64           `json:"cost,omitempty"`
+	Results   []batchResult     `json:"results"`
+}
+
+// ParseBatchOptions parses the batch command options in args, the
+// command line arguments following "batch".
+func ParseBatchOptions(args []string) (*BatchOptions, error) {
+
+	var options BatchOptions
+	var parser = flags.NewParser(&options, flags.Default)
+	parser.Name = "genact"
+	parser.Usage = batchUsage
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, ParserError{err}
+	}
+
+	if options.SystemFile != "" && !checkFileExists(options.SystemFile) {
+		return nil, fmt.Errorf("system instruction file %s could not be found", options.SystemFile)
+	}
+	if options.Workers < 1 {
+		return nil, fmt.Errorf("workers %d must be at least 1", options.Workers)
+	}
+	if options.RPM < 0 {
+		return nil, fmt.Errorf("rpm %d cannot be negative", options.RPM)
+	}
+	if options.Directory == "" || options.Directory == "current working directory" {
+		var err error
+		options.Directory, err = os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("could not get current working directory: %s", err)
+		}
+	} else if !checkDirExists(options.Directory) {
+		return nil, fmt.Errorf("could not find directory %s", options.Directory)
+	}
+	if !checkFileExists(options.Args.Input) && !checkDirExists(options.Args.Input) {
+		return nil, fmt.Errorf("batch input %s could not be found", options.Args.Input)
+	}
+	return &options, nil
+}
+
+// readBatchJobs reads the jobs of a JSONL file or directory of prompt
+// files. Chat names must be unique, since the turns of a chat cannot be
+// run at once.
+func readBatchJobs(path string) ([]batchJob, error) {
+	var jobs []batchJob
+	var err error
+	if checkDirExists(path) {
+		jobs, err = readBatchDir(path)
+	} else {
+		jobs, err = readBatchJSONL(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no prompts found in %s", path)
+	}
+	seen := map[string]bool{}
+	for i, j := range jobs {
+		name, err := chatName(j.Chat)
+		if err != nil {
+			return nil, fmt.Errorf("prompt %d: %w", i+1, err)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("prompt %d: chat %s is used more than once", i+1, name)
+		}
+		seen[name] = true
+		jobs[i].Chat = name
+	}
+	return jobs, nil
+}
+
+// readBatchJSONL reads the jobs of a JSONL file, resolving relative
+// paths against the directory of the file.
+func readBatchJSONL(path string) ([]batchJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open batch file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	var jobs []batchJob
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var j batchJob
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&j); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+		switch {
+		case j.Prompt == "" && j.PromptFile == "":
+			return nil, fmt.Errorf("%s line %d: prompt or promptFile not provided", path, n)
+		case j.Prompt != "" && j.PromptFile != "":
+			return nil, fmt.Errorf("%s line %d: both prompt and promptFile provided", path, n)
+		}
+		j.PromptFile = resolve(j.PromptFile)
+		for i, a := range j.Attach {
+			j.Attach[i] = resolve(a)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read batch file: %w", err)
+	}
+	return jobs, nil
+}
+
+// readBatchDir reads the jobs of a directory of prompt files, attaching
+// the files of a sub-directory with the name of the chat, if any.
+// Hidden files are ignored.
+func readBatchDir(dir string) ([]batchJob, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read batch directory: %w", err)
+	}
+	var jobs []batchJob
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		chat := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		j := batchJob{Chat: chat, PromptFile: filepath.Join(dir, e.Name())}
+		attachDir := filepath.Join(dir, chat)
+		if checkDirExists(attachDir) {
+			attachments, err := os.ReadDir(attachDir)
+			if err != nil {
+				return nil, fmt.Errorf("could not read attachments directory: %w", err)
+			}
+			for _, a := range attachments {
+				if !a.IsDir() && !strings.HasPrefix(a.Name(), ".") {
+					j.Attach = append(j.Attach, filepath.Join(attachDir, a.Name()))
+				}
+			}
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// batchLimiter spaces the start of requests at least interval apart.
+type batchLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait waits until the next request may start.
+func (l *batchLimiter) wait(ctx context.Context) error {
+	if l == nil || l.interval == 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	start := time.Now()
+	if l.next.After(start) {
+		start = l.next
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(start)):
+		return nil
+	}
+}
+
+// batchRunner runs batch jobs with shared settings.
+type batchRunner struct {
+	settings    *genact.Settings
+	directory   string
+	system      string // the system instruction file contents, if any
+	logger      *slog.Logger
+	limiter     *batchLimiter
+	rateLimiter *genact.RateLimiter // shared with other genact processes
+	ledger      *genact.Ledger
+	spending    *genact.Spending
+}
+
+// run runs jobs with a pool of workers, returning the result of each
+// job in order.
+func (r *batchRunner) run(ctx context.Context, jobs []batchJob, workers int) []batchResult {
+	results := make([]batchResult, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(jobs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = r.runJob(ctx, jobs[i])
+			}
+		}()
+	}
+	for i := range jobs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+// runJob runs a job, continuing its chat from the latest history and
+// saving the turn in the chat directory.
+func (r *batchRunner) runJob(ctx context.Context, job batchJob) batchResult {
+	result := batchResult{Chat: job.Chat}
+	fail := func(err error) batchResult {
+		result.Error = err.Error()
+		r.logger.Warn("prompt failed", "chat", job.Chat, "error", err)
+		return result
+	}
+
+	prompt := []byte(job.Prompt)
+	if job.PromptFile != "" {
+		var err error
+		prompt, err = os.ReadFile(job.PromptFile)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	attachments, err := genact.LoadAttachments(job.Attach...)
+	if err != nil {
+		return fail(err)
+	}
+	files, err := NewFiles(r.directory, job.Chat)
+	if err != nil {
+		return fail(err)
+	}
+	files.UseChatOutputOnly()
+
+	history := []*genai.Content{}
+	if historyFile := LatestHistoryFile(files.chatDir); historyFile != "" {
+		history, err = genact.HistoryAPIToAIContent(historyFile)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	recordedSystem, err := files.ReadSystem()
+	if err != nil {
+		return fail(err)
+	}
+	systemInstruction := cmp.Or(r.system, recordedSystem, r.settings.SystemInstruction)
+	uploads, err := files.ReadUploads()
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := files.WritePending(prompt); err != nil {
+		return fail(err)
+	}
+	if err := genact.SaveAttachments(files.chatDir, attachments); err != nil {
+		return fail(err)
+	}
+	apiOptions := []genact.Option{
+		genact.WithSystemInstruction(systemInstruction),
+		genact.WithAttachments(attachments...),
+		genact.WithUploads(uploads),
+		genact.WithLogger(r.logger.With("chat", job.Chat)),
+		genact.WithRateLimiter(r.rateLimiter),
+		genact.WithLedger(r.ledger, job.Chat),
+		genact.WithSpending(r.spending, job.Chat),
+	}
+	if r.settings.Cache {
+		cache, err := files.ReadCache()
+		if err != nil {
+			return fail(err)
+		}
+		apiOptions = append(apiOptions, genact.WithCache(cache))
+	}
+
+	if err := r.limiter.wait(ctx); err != nil {
+		return fail(err)
+	}
+	response, err := genact.APIGetResponseContext(ctx, r.settings, history, string(prompt), apiOptions...)
+	if uerr := files.WriteUploads(uploads); uerr != nil && err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return fail(fmt.Errorf("%w; prompt saved as pending turn %s", err, files.chatPendingFile))
+	}
+	if err := files.WriteTurn(prompt, systemInstruction, recordedSystem, response, r.settings.Cache); err != nil {
+		return fail(err)
+	}
+	result.OK = true
+	result.Output = files.chatOutputFile
+	result.Model = response.Model
+	result.Cost = response.Cost
+	result.FinishReason = response.FinishReason
+	result.Truncated = response.Truncated
+	result.LatencyMS = response.Latency.Milliseconds()
+	result.Usage = response.Usage
+	return result
+}
+
+// newBatchReport summarises the results of a batch run.
+func newBatchReport(input string, started time.Time, results []batchResult) batchReport {
+	report := batchReport{
+		Input:    input,
+		Started:  started.UTC().Truncate(time.Second),
+		Finished: time.Now().UTC().Truncate(time.Second),
+		Results:  results,
+	}
+	for _, r := range results {
+		if r.OK {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+		report.Usage = report.Usage.Add(r.Usage.Total())
+		report.Cost += r.Cost
+	}
+	return report
+}
+
+// print prints the summary report.
+func (b batchReport) print() {
+	for _, r := range b.Results {
+		if r.OK {
+			truncated := ""
+			if r.Truncated {
+				truncated = " (truncated)"
+			}
+			fmt.Printf("ok      %s: %d tokens, %s%s\n", r.Chat, r.Usage.TotalTokens, r.Output, truncated)
+		} else {
+			fmt.Printf("failed  %s: %s\n", r.Chat, r.Error)
+		}
+	}
+	u := b.Usage
+	fmt.Printf("%d succeeded, %d failed in %s\n", b.Succeeded, b.Failed, b.Finished.Sub(b.Started))
+	fmt.Printf("tokens: prompt %d (cached %d), output %d, thoughts %d, total %d\n",
+		u.PromptTokens, u.CachedContentTokens, u.CandidatesTokens, u.ThoughtsTokens, u.TotalTokens)
+	if b.Cost > 0 {
+		fmt.Printf("estimated cost: $%.4f\n", b.Cost)
+	}
+}
+
+// runBatch runs the batch command with the command line arguments
+// following "batch", returning the exit code.
+func runBatch(args []string) int {
+
+	options, err := ParseBatchOptions(args)
+	if err != nil {
+		var pe ParserError
+		if !errors.As(err, &pe) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return exitError
+	}
+	f, err := os.ReadFile(options.YamlFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	settings, err := LoadYaml(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if options.Model != "" {
+		settings.ModelName = options.Model
+	}
+	if options.Preflight {
+		settings.Preflight = true
+	}
+	jobs, err := readBatchJobs(options.Args.Input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	runner := &batchRunner{
+		settings:    settings,
+		directory:   options.Directory,
+		logger:      newLogger(options.LogFormat, settings.Logging),
+		rateLimiter: NewRateLimiter(options.Directory, settings),
+		ledger:      NewLedger(options.Directory),
+		spending:    NewSpending(options.Directory),
+	}
+	if options.SystemFile != "" {
+		b, err := os.ReadFile(options.SystemFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		runner.system = string(b)
+	}
+	if options.RPM > 0 {
+		runner.limiter = &batchLimiter{interval: time.Minute / time.Duration(options.RPM)}
+	}
+
+	// cancel the remaining requests on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	started := time.Now()
+	report := newBatchReport(options.Args.Input, started, runner.run(ctx, jobs, options.Workers))
+	report.print()
+
+	path := options.Report
+	if path == "" {
+		path = filepath.Join(options.Directory, conversationDir, started.Format(timeFormat)+"_batch.json")
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path, b, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write batch report %s: %v\n", path, err)
+		return exitError
+	}
+	fmt.Printf("report written to %s\n", path)
+	if report.Failed > 0 {
+		return exitError
+	}
+	return 0
+}
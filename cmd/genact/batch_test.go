@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/genact"
+)
+
+// writeFiles writes files, keyed by path relative to dir, making their
+// directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestReadBatchJobs reads jobs from JSONL files and directories of
+// prompt files.
+func TestReadBatchJobs(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		input string
+		want  []batchJob
+		err   string
+	}{
+		{
+			name: "jsonl",
+			files: map[string]string{
+				"in/batch.jsonl": `{"chat": "Report One", "promptFile": "p/1.txt", "attach": ["a.png", "/abs/b.pdf"]}
+
+{"chat": "two", "prompt": "hello"}`,
+			},
+			input: "in/batch.jsonl",
+			want: []batchJob{
+				{Chat: "report_one", PromptFile: "in/p/1.txt", Attach: []string{"in/a.png", "/abs/b.pdf"}},
+				{Chat: "two", Prompt: "hello"},
+			},
+		},
+		{
+			name: "directory",
+			files: map[string]string{
+				"in/one.txt":      "first",
+				"in/one/a.png":    "png",
+				"in/one/.hidden":  "x",
+				"in/two.md":       "second",
+				"in/.DS_Store":    "x",
+				"in/empty/ignore": "x",
+			},
+			input: "in",
+			want: []batchJob{
+				{Chat: "one", PromptFile: "in/one.txt", Attach: []string{"in/one/a.png"}},
+				{Chat: "two", PromptFile: "in/two.md"},
+			},
+		},
+		{
+			name:  "duplicate chat",
+			files: map[string]string{"batch.jsonl": "{\"chat\": \"a\", \"prompt\": \"x\"}\n{\"chat\": \"A\", \"prompt\": \"y\"}\n"},
+			input: "batch.jsonl",
+			err:   "prompt 2: chat a is used more than once",
+		},
+		{
+			name:  "no prompt",
+			files: map[string]string{"batch.jsonl": `{"chat": "a"}`},
+			input: "batch.jsonl",
+			err:   "line 1: prompt or promptFile not provided",
+		},
+		{
+			name:  "unknown field",
+			files: map[string]string{"batch.jsonl": `{"chat": "a", "prompt": "x", "attachments": []}`},
+			input: "batch.jsonl",
+			err:   `unknown field "attachments"`,
+		},
+		{
+			name:  "empty",
+			files: map[string]string{"batch.jsonl": "\n"},
+			input: "batch.jsonl",
+			err:   "no prompts found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+			got, err := readBatchJobs(filepath.Join(dir, tt.input))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, j := range tt.want {
+				if j.PromptFile != "" {
+					tt.want[i].PromptFile = filepath.Join(dir, j.PromptFile)
+				}
+				for k, a := range j.Attach {
+					if !filepath.IsAbs(a) {
+						tt.want[i].Attach[k] = filepath.Join(dir, a)
+					}
+				}
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("jobs mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestBatchLimiter checks that requests are started at least the
+// interval apart.
+func TestBatchLimiter(t *testing.T) {
+
+	limiter := &batchLimiter{interval: 20 * time.Millisecond}
+	start := time.Now()
+	for range 4 {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := time.Since(start), 60*time.Millisecond; got < want {
+		t.Errorf("4 requests started in %s, want at least %s", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.wait(ctx); err == nil {
+		t.Error("expected an error waiting with a cancelled context")
+	}
+}
+
+// TestRunBatch runs a batch end-to-end with the fake backend, in which
+// one prompt file is missing.
+func TestRunBatch(t *testing.T) {
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"settings.yaml": "modelName: gemini-2.5-pro\nbackend: fake\nlogging: false\n",
+		"batch.jsonl": `{"chat": "one", "prompt": "first"}
+{"chat": "two", "promptFile": "two.txt"}
+{"chat": "three", "promptFile": "missing.txt"}`,
+		"two.txt": "second",
+	})
+	report := filepath.Join(dir, "report.json")
+
+	code := runBatch([]string{
+		"-d", dir, "-y", filepath.Join(dir, "settings.yaml"), "--workers", "2",
+		"--rpm", "6000", "--report", report, filepath.Join(dir, "batch.jsonl"),
+	})
+	if got, want := code, exitError; got != want {
+		t.Errorf("exit code got %d want %d", got, want)
+	}
+
+	for chat, want := range map[string]string{"one": "echo: first", "two": "echo: second"} {
+		outputs, err := filepath.Glob(filepath.Join(dir, conversationDir, chat, "*_"+outputFileBaseName))
+		if err != nil || len(outputs) != 1 {
+			t.Fatalf("chat %s outputs %v: %v", chat, outputs, err)
+		}
+		b, err := os.ReadFile(outputs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("chat %s output got %q want %q", chat, got, want)
+		}
+		if LatestHistoryFile(filepath.Join(dir, conversationDir, chat)) == "" {
+			t.Errorf("chat %s history file not written", chat)
+		}
+	}
+	if checkFileExists(filepath.Join(dir, outputFileBaseName)) {
+		t.Errorf("%s should not be written in batch mode", outputFileBaseName)
+	}
+
+	b, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got batchReport
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Succeeded != 2 || got.Failed != 1 {
+		t.Errorf("got %d succeeded and %d failed, want 2 and 1", got.Succeeded, got.Failed)
+	}
+	chats := []string{}
+	for _, r := range got.Results {
+		chats = append(chats, r.Chat)
+	}
+	if diff := cmp.Diff([]string{"one", "two", "three"}, chats); diff != "" {
+		t.Errorf("results mismatch (-want +got):\n%s", diff)
+	}
+	if got.Results[2].OK || !strings.Contains(got.Results[2].Error, "missing.txt") {
+		t.Errorf("unexpected result for missing prompt %+v", got.Results[2])
+	}
+	if got.Usage.TotalTokens != int64(got.Results[0].Usage.TotalTokens+got.Results[1].Usage.TotalTokens) {
+		t.Errorf("total usage %d is not the sum of the results", got.Usage.TotalTokens)
+	}
+}
+
+// TestBatchReportLarge tests that the total usage of a large batch does
+// not overflow.
+func TestBatchReportLarge(t *testing.T) {
+
+	usage := genact.Usage{CandidatesTokens: math.MaxInt32, TotalTokens: math.MaxInt32}
+	results := []batchResult{{Chat: "a", OK: true, Usage: usage}, {Chat: "b", OK: true, Usage: usage}}
+	report := newBatchReport("input", time.Now(), results)
+	if got, want := report.Usage.TotalTokens, int64(2*math.MaxInt32); got != want {
+		t.Errorf("total tokens got %d want %d", got, want)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rorycl/genact"
+)
+
+// Exit codes for requests which fail. Other errors exit with 1.
+const (
+	exitError      = 1 // an error, cancellation or timeout
+	exitBlocked    = 3 // the prompt or response was blocked
+	exitEmpty      = 4 // the response was empty
+	exitMaxTokens  = 5 // the output token limit was reached without a response
+	exitRecitation = 6 // the response was stopped for recitation
+)
+
+// responseErrorExit returns a readable message and exit code for a
+// blocked, empty or stopped response, reporting false for other errors.
+func responseErrorExit(err error) (string, int, bool) {
+	switch {
+	case errors.Is(err, genact.ErrBlocked):
+		return fmt.Sprintf("%v\nrephrase the prompt or remove the content flagged by the safety ratings", err), exitBlocked, true
+	case errors.Is(err, genact.ErrRecitation):
+		return fmt.Sprintf("%v\nthe response recited existing material; rephrase the prompt", err), exitRecitation, true
+	case errors.Is(err, genact.ErrMaxTokens):
+		return fmt.Sprintf("%v\nincrease the maxOutputTokens setting or reduce the thinkingBudget", err), exitMaxTokens, true
+	case errors.Is(err, genact.ErrEmptyResponse):
+		return fmt.Sprintf("%v\nthe model returned no content; try sending the prompt again", err), exitEmpty, true
+	}
+	return "", exitError, false
+}
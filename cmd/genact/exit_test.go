@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rorycl/genact"
+)
+
+// TestResponseErrorExit tests the messages and exit codes of blocked,
+// empty and stopped responses.
+func TestResponseErrorExit(t *testing.T) {
+
+	tests := []struct {
+		desc    string
+		err     error
+		code    int
+		ok      bool
+		message string
+	}{
+		{
+			desc:    "blocked",
+			err:     fmt.Errorf("chat response error: %w", &genact.ResponseError{Err: genact.ErrBlocked, BlockReason: "SAFETY"}),
+			code:    exitBlocked,
+			ok:      true,
+			message: "prompt block reason SAFETY\nrephrase the prompt",
+		},
+		{
+			desc:    "recitation",
+			err:     &genact.ResponseError{Err: genact.ErrRecitation, FinishReason: "RECITATION"},
+			code:    exitRecitation,
+			ok:      true,
+			message: "recited existing material",
+		},
+		{
+			desc:    "max tokens",
+			err:     &genact.ResponseError{Err: genact.ErrMaxTokens, FinishReason: "MAX_TOKENS"},
+			code:    exitMaxTokens,
+			ok:      true,
+			message: "increase the maxOutputTokens setting",
+		},
+		{
+			desc:    "empty",
+			err:     &genact.ResponseError{Err: genact.ErrEmptyResponse},
+			code:    exitEmpty,
+			ok:      true,
+			message: "the model returned no content",
+		},
+		{
+			desc: "other",
+			err:  errors.New("network down"),
+			code: exitError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			message, code, ok := responseErrorExit(tt.err)
+			if got, want := code, tt.code; got != want {
+				t.Errorf("got exit code %d want %d", got, want)
+			}
+			if got, want := ok, tt.ok; got != want {
+				t.Errorf("got ok %t want %t", got, want)
+			}
+			if !strings.Contains(message, tt.message) {
+				t.Errorf("message %q does not contain %q", message, tt.message)
+			}
+		})
+	}
+}
@@ -1,31 +1,66 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"time"
+
+	"github.com/rorycl/genact"
 )
 
 const (
-	promptFileBaseName  = "prompt.txt"
-	outputFileBaseName  = "output.md"
-	historyFileBaseName = "history.json"
-	conversationDir     = "conversations"
-	timeFormat          = "20060102T150405"
+	promptFileBaseName   = "prompt.txt"
+	pendingFileBaseName  = "pending.txt"
+	outputFileBaseName   = "output.md"
+	jsonOutputBaseName   = "output.json"
+	thoughtsFileBaseName = "thoughts.md"
+	historyFileBaseName  = "history.json"
+	metaFileBaseName     = "meta.json"
+	systemFileBaseName   = "system.txt"
+	cacheFileBaseName    = "cache.json"
+	uploadsFileBaseName  = "uploads.json"
+	conversationDir      = "conversations"
+	rateLimitFileName    = "ratelimit.json"
+	ledgerFileName       = "ledger.jsonl"
+	spendingFileName     = "spending.json"
+	timeFormat           = "20060102T150405"
 )
 
 // files are the file and directory paths for the programme output.
 type files struct {
-	workingDir      string
-	conversationDir string
-	chatDir         string
-	outputFile      string
-	chatPromptFile  string
-	chatHistoryFile string
-	chatOutputFile  string
-	timestamp       string
+	workingDir       string
+	conversationDir  string
+	chatDir          string
+	outputFile       string
+	chatPromptFile   string
+	chatPendingFile  string
+	chatHistoryFile  string
+	chatOutputFile   string
+	chatThoughtsFile string
+	chatMetaFile     string
+	chatSystemFile   string // not timestamped
+	chatCacheFile    string // not timestamped
+	chatUploadsFile  string // not timestamped
+	timestamp        string
+}
+
+// UseJSONOutput uses json output and chat output files, for JSON
+// output mode, rather than markdown.
+func (f *files) UseJSONOutput() {
+	f.outputFile = filepath.Join(f.workingDir, jsonOutputBaseName)
+	f.chatOutputFile = filepath.Join(f.chatDir, fmt.Sprintf("%s_%s", f.timestamp, jsonOutputBaseName))
+}
+
+// UseChatOutputOnly writes the output only to the chat output file,
+// not the output file in the working directory, as in batch mode where
+// the outputs of several chats would otherwise overwrite each other.
+func (f *files) UseChatOutputOnly() {
+	f.outputFile = ""
 }
 
 // makeDirs simply tries to make the chatDir and parents in workingDir.
@@ -33,28 +68,105 @@ func (f *files) makeDirs() error {
 	return os.MkdirAll(f.chatDir, 0755)
 }
 
-// writePrompt writes the chat prompt file.
+// WritePending writes the prompt as a pending turn before it is sent to
+// the api, so that the prompt is not lost if the request fails or is
+// cancelled.
+func (f *files) WritePending(b []byte) error {
+	err := os.WriteFile(f.chatPendingFile, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write chat pending file %s: %s", f.chatPendingFile, err)
+	}
+	return nil
+}
+
+// writePrompt writes the chat prompt file, removing the pending file if
+// it exists.
 func (f *files) WritePrompt(b []byte) error {
 	err := os.WriteFile(f.chatPromptFile, b, 0644)
 	if err != nil {
 		return fmt.Errorf("could not write chat prompt file %s: %s", f.chatPromptFile, err)
 	}
+	err = os.Remove(f.chatPendingFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove chat pending file %s: %s", f.chatPendingFile, err)
+	}
 	return nil
 }
 
-// writeOutput writes the output and chat output files.
+// writeOutput writes the output, if used, and chat output files.
 func (f *files) WriteOutput(b []byte) error {
-	err := os.WriteFile(f.outputFile, b, 0644)
-	if err != nil {
-		return fmt.Errorf("could not write output file %s: %s", f.outputFile, err)
+	if f.outputFile != "" {
+		err := os.WriteFile(f.outputFile, b, 0644)
+		if err != nil {
+			return fmt.Errorf("could not write output file %s: %s", f.outputFile, err)
+		}
 	}
-	err = os.WriteFile(f.chatOutputFile, b, 0644)
+	err := os.WriteFile(f.chatOutputFile, b, 0644)
 	if err != nil {
 		return fmt.Errorf("could not write chat output file %s: %s", f.chatOutputFile, err)
 	}
 	return nil
 }
 
+// WriteCandidates writes each of several candidate responses to a
+// chat output file numbered from 1, such as 20250630T204842_output-2.md,
+// returning the file paths.
+func (f *files) WriteCandidates(candidates []genact.ApiCandidate) ([]string, error) {
+	ext := filepath.Ext(f.chatOutputFile)
+	base := strings.TrimSuffix(f.chatOutputFile, ext)
+	paths := make([]string, len(candidates))
+	for i, c := range candidates {
+		paths[i] = fmt.Sprintf("%s-%d%s", base, i+1, ext)
+		err := os.WriteFile(paths[i], []byte(c.LatestResponse), 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not write chat candidate file %s: %s", paths[i], err)
+		}
+	}
+	return paths, nil
+}
+
+// WriteThoughts writes the chat thoughts file, a companion to the chat
+// output file.
+func (f *files) WriteThoughts(b []byte) error {
+	err := os.WriteFile(f.chatThoughtsFile, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write chat thoughts file %s: %s", f.chatThoughtsFile, err)
+	}
+	return nil
+}
+
+// WriteMeta writes the chat metadata file, recording the model, usage
+// and timing of the turn.
+func (f *files) WriteMeta(b []byte) error {
+	err := os.WriteFile(f.chatMetaFile, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write chat meta file %s: %s", f.chatMetaFile, err)
+	}
+	return nil
+}
+
+// OutputStream opens the chat output file, truncating any previous
+// content, for writing streamed output. The caller is responsible for
+// closing the file, and for removing it with RemoveOutputStream if the
+// request fails.
+func (f *files) OutputStream() (*os.File, error) {
+	fh, err := os.OpenFile(f.chatOutputFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open chat output file %s: %s", f.chatOutputFile, err)
+	}
+	return fh, nil
+}
+
+// RemoveOutputStream removes the partial output streamed to the chat
+// output file by a request which failed or was cancelled.
+func (f *files) RemoveOutputStream() error {
+	err := os.Remove(f.chatOutputFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove chat output file %s: %s", f.chatOutputFile, err)
+	}
+	return nil
+}
+
 // writeHistory writes the chat history file.
 func (f *files) WriteHistory(b []byte) error {
 	err := os.WriteFile(f.chatHistoryFile, b, 0644)
@@ -64,6 +176,139 @@ func (f *files) WriteHistory(b []byte) error {
 	return f.makeDirs()
 }
 
+// WriteTurn writes the files of a completed turn: the prompt, replacing
+// the pending file, the system instruction if it differs from that
+// recorded, the output, thoughts, history and metadata and, if caching,
+// the cache.
+func (f *files) WriteTurn(prompt []byte, systemInstruction, recordedSystem string, response *genact.ApiResponse, cache bool) error {
+	if err := f.WritePrompt(prompt); err != nil {
+		return err
+	}
+	if systemInstruction != recordedSystem {
+		if err := f.WriteSystem([]byte(systemInstruction)); err != nil {
+			return err
+		}
+	}
+	if err := f.WriteOutput([]byte(response.LatestResponse)); err != nil {
+		return err
+	}
+	if response.Thoughts != "" {
+		if err := f.WriteThoughts([]byte(response.Thoughts)); err != nil {
+			return err
+		}
+	}
+	if err := f.WriteHistory([]byte(response.FullHistory)); err != nil {
+		return err
+	}
+	if cache {
+		if err := f.WriteCache(response.Cache); err != nil {
+			return err
+		}
+	}
+	meta, err := json.MarshalIndent(response.Metadata(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode metadata: %w", err)
+	}
+	return f.WriteMeta(meta)
+}
+
+// ReadSystem reads the system instruction recorded for the chat, if
+// any. An empty string is returned if no system instruction has been
+// recorded.
+func (f *files) ReadSystem() (string, error) {
+	b, err := os.ReadFile(f.chatSystemFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read chat system file %s: %s", f.chatSystemFile, err)
+	}
+	return string(b), nil
+}
+
+// WriteSystem records the system instruction for the chat so that it is
+// reused for later turns.
+func (f *files) WriteSystem(b []byte) error {
+	err := os.WriteFile(f.chatSystemFile, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write chat system file %s: %s", f.chatSystemFile, err)
+	}
+	return nil
+}
+
+// ReadCache reads the cache information recorded for the chat, if any.
+// Nil is returned if no cache has been recorded.
+func (f *files) ReadCache() (*genact.CacheInfo, error) {
+	b, err := os.ReadFile(f.chatCacheFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read chat cache file %s: %s", f.chatCacheFile, err)
+	}
+	var cache genact.CacheInfo
+	if err := json.Unmarshal(b, &cache); err != nil {
+		return nil, fmt.Errorf("could not decode chat cache file %s: %s", f.chatCacheFile, err)
+	}
+	return &cache, nil
+}
+
+// WriteCache records the cache information for the chat so that the
+// cache is reused for later turns. A nil cache removes the record.
+func (f *files) WriteCache(cache *genact.CacheInfo) error {
+	if cache == nil {
+		err := os.Remove(f.chatCacheFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove chat cache file %s: %s", f.chatCacheFile, err)
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode chat cache file %s: %s", f.chatCacheFile, err)
+	}
+	err = os.WriteFile(f.chatCacheFile, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write chat cache file %s: %s", f.chatCacheFile, err)
+	}
+	return nil
+}
+
+// ReadUploads reads the File API uploads recorded for the chat. An empty
+// record is returned if no uploads have been recorded.
+func (f *files) ReadUploads() (genact.Uploads, error) {
+	uploads := genact.Uploads{}
+	b, err := os.ReadFile(f.chatUploadsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return uploads, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read chat uploads file %s: %s", f.chatUploadsFile, err)
+	}
+	if err := json.Unmarshal(b, &uploads); err != nil {
+		return nil, fmt.Errorf("could not decode chat uploads file %s: %s", f.chatUploadsFile, err)
+	}
+	return uploads, nil
+}
+
+// WriteUploads records the File API uploads for the chat so that
+// uploaded attachments are reused by later turns until they expire. The
+// file is not written if there are no uploads.
+func (f *files) WriteUploads(uploads genact.Uploads) error {
+	if len(uploads) == 0 {
+		return nil
+	}
+	b, err := json.MarshalIndent(uploads, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode chat uploads file %s: %s", f.chatUploadsFile, err)
+	}
+	err = os.WriteFile(f.chatUploadsFile, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write chat uploads file %s: %s", f.chatUploadsFile, err)
+	}
+	return nil
+}
+
 // LatestHistoryFile finds the latest history file, if any. This is a
 // package function. This returns an empty string if no history file is
 // found. An example history file name is `20250829T220640_history.json`
@@ -112,15 +357,63 @@ func NewFiles(workingDir, chat string) (*files, error) {
 		return nil, fmt.Errorf("workingDir %s or chat %s empty", workingDir, chat)
 	}
 	f := files{
-		workingDir:      workingDir,
-		conversationDir: filepath.Join(workingDir, conversationDir),
-		chatDir:         filepath.Join(workingDir, conversationDir, chat),
-		outputFile:      filepath.Join(workingDir, outputFileBaseName),
-		chatPromptFile:  filepath.Join(workingDir, conversationDir, chat, joinTS(promptFileBaseName)),
-		chatHistoryFile: filepath.Join(workingDir, conversationDir, chat, joinTS(historyFileBaseName)),
-		chatOutputFile:  filepath.Join(workingDir, conversationDir, chat, joinTS(outputFileBaseName)),
-		timestamp:       ts,
+		workingDir:       workingDir,
+		conversationDir:  filepath.Join(workingDir, conversationDir),
+		chatDir:          filepath.Join(workingDir, conversationDir, chat),
+		outputFile:       filepath.Join(workingDir, outputFileBaseName),
+		chatPromptFile:   filepath.Join(workingDir, conversationDir, chat, joinTS(promptFileBaseName)),
+		chatPendingFile:  filepath.Join(workingDir, conversationDir, chat, joinTS(pendingFileBaseName)),
+		chatHistoryFile:  filepath.Join(workingDir, conversationDir, chat, joinTS(historyFileBaseName)),
+		chatOutputFile:   filepath.Join(workingDir, conversationDir, chat, joinTS(outputFileBaseName)),
+		chatThoughtsFile: filepath.Join(workingDir, conversationDir, chat, joinTS(thoughtsFileBaseName)),
+		chatMetaFile:     filepath.Join(workingDir, conversationDir, chat, joinTS(metaFileBaseName)),
+		chatSystemFile:   filepath.Join(workingDir, conversationDir, chat, systemFileBaseName),
+		chatCacheFile:    filepath.Join(workingDir, conversationDir, chat, cacheFileBaseName),
+		chatUploadsFile:  filepath.Join(workingDir, conversationDir, chat, uploadsFileBaseName),
+		timestamp:        ts,
 	}
 	err := f.makeDirs()
 	return &f, err
 }
+
+// NewRateLimiter returns the rate limiter of the "requestsPerMinute" and
+// "tokensPerMinute" settings, recording requests in the conversations
+// directory under workingDir so that the limits are shared by the
+// genact processes using it.
+func NewRateLimiter(workingDir string, settings *genact.Settings) *genact.RateLimiter {
+	path := filepath.Join(workingDir, conversationDir, rateLimitFileName)
+	return genact.NewRateLimiter(settings.RequestsPerMinute, settings.TokensPerMinute, path)
+}
+
+// NewLedger returns the usage ledger in the conversations directory
+// under workingDir, recording the api calls of all chats.
+func NewLedger(workingDir string) *genact.Ledger {
+	return genact.OpenLedger(filepath.Join(workingDir, conversationDir, ledgerFileName))
+}
+
+// NewSpending returns the running totals of the costs of the chats in
+// the conversations directory under workingDir, shared by all chats.
+func NewSpending(workingDir string) *genact.Spending {
+	return genact.OpenSpending(filepath.Join(workingDir, conversationDir, spendingFileName))
+}
+
+// toolDenied returns the paths, relative to the working directory,
+// which the built-in tools may not read: the conversations directory,
+// holding the chat histories, ledger and spending totals, and the
+// settings file, holding the api key, if it is in the working
+// directory.
+func toolDenied(workingDir, yamlFile string) []string {
+	denied := []string{conversationDir}
+	dir, err := filepath.Abs(workingDir)
+	if err != nil {
+		return denied
+	}
+	yamlFile, err = filepath.Abs(yamlFile)
+	if err != nil {
+		return denied
+	}
+	if rel, err := filepath.Rel(dir, yamlFile); err == nil && filepath.IsLocal(rel) {
+		denied = append(denied, rel)
+	}
+	return denied
+}
@@ -6,6 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/genact"
 )
 
 func chkFileExists(path string) bool {
@@ -39,16 +43,125 @@ func TestFiles(t *testing.T) {
 
 	b := []byte("hi there")
 
+	err = files.WritePending(b)
+	if err != nil {
+		t.Fatalf("writePending error %s", err)
+	}
+	if !chkFileExists(files.chatPendingFile) {
+		t.Errorf("pending file %s could not be found", files.chatPendingFile)
+	}
+
 	err = files.WritePrompt(b)
 	if err != nil {
 		t.Fatalf("writePrompt error %s", err)
 	}
+	if chkFileExists(files.chatPendingFile) {
+		t.Errorf("pending file %s should have been removed", files.chatPendingFile)
+	}
 
 	err = files.WriteOutput(b)
 	if err != nil {
 		t.Fatalf("writePrompt error %s", err)
 	}
 
+	stream, err := files.OutputStream()
+	if err != nil {
+		t.Fatalf("outputStream error %s", err)
+	}
+	for _, chunk := range []string{"hi ", "there"} {
+		if _, err = stream.WriteString(chunk); err != nil {
+			t.Fatalf("outputStream write error %s", err)
+		}
+	}
+	_ = stream.Close()
+	got, err := os.ReadFile(files.chatOutputFile)
+	if err != nil {
+		t.Fatalf("could not read streamed output %s", err)
+	}
+	// the stream replaces the previous output
+	if string(got) != string(b) {
+		t.Errorf("streamed output got %q want %q", got, string(b))
+	}
+	if err = files.RemoveOutputStream(); err != nil {
+		t.Fatalf("removeOutputStream error %s", err)
+	}
+	if chkFileExists(files.chatOutputFile) {
+		t.Errorf("streamed output file %s should have been removed", files.chatOutputFile)
+	}
+	if err = files.RemoveOutputStream(); err != nil {
+		t.Fatalf("removeOutputStream of removed file error %s", err)
+	}
+	if err = files.WriteOutput(b); err != nil {
+		t.Fatalf("writeOutput error %s", err)
+	}
+
+	err = files.WriteThoughts(b)
+	if err != nil {
+		t.Fatalf("writeThoughts error %s", err)
+	}
+
+	err = files.WriteMeta(b)
+	if err != nil {
+		t.Fatalf("writeMeta error %s", err)
+	}
+
+	system, err := files.ReadSystem()
+	if err != nil || system != "" {
+		t.Fatalf("readSystem expected empty instruction, got %q (%v)", system, err)
+	}
+	err = files.WriteSystem(b)
+	if err != nil {
+		t.Fatalf("writeSystem error %s", err)
+	}
+	system, err = files.ReadSystem()
+	if err != nil || system != string(b) {
+		t.Fatalf("readSystem got %q (%v) want %q", system, err, b)
+	}
+
+	cache, err := files.ReadCache()
+	if err != nil || cache != nil {
+		t.Fatalf("readCache expected no cache, got %v (%v)", cache, err)
+	}
+	wantCache := &genact.CacheInfo{
+		Name:     "cachedContents/abc",
+		Model:    "gemini-2.5-pro",
+		Expires:  time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC),
+		Contents: 4,
+		Hash:     "0123",
+	}
+	err = files.WriteCache(wantCache)
+	if err != nil {
+		t.Fatalf("writeCache error %s", err)
+	}
+	cache, err = files.ReadCache()
+	if err != nil || *cache != *wantCache {
+		t.Fatalf("readCache got %v (%v) want %v", cache, err, wantCache)
+	}
+
+	uploads, err := files.ReadUploads()
+	if err != nil || len(uploads) != 0 {
+		t.Fatalf("readUploads expected no uploads, got %v (%v)", uploads, err)
+	}
+	wantUploads := genact.Uploads{
+		"attachments/0123456789abcdef.pdf": {
+			Name:     "files/abc",
+			URI:      "https://generativelanguage.googleapis.com/v1beta/files/abc",
+			MIMEType: "application/pdf",
+			Expires:  time.Date(2025, 9, 2, 12, 0, 0, 0, time.UTC),
+		},
+	}
+	err = files.WriteUploads(wantUploads)
+	if err != nil {
+		t.Fatalf("writeUploads error %s", err)
+	}
+	uploads, err = files.ReadUploads()
+	if err != nil {
+		t.Fatalf("readUploads error %s", err)
+	}
+	if diff := cmp.Diff(wantUploads, uploads); diff != "" {
+		t.Errorf("readUploads mismatch (-want +got):\n%s", diff)
+	}
+
 	err = files.WriteHistory(b)
 	if err != nil {
 		t.Fatalf("writePrompt error %s", err)
@@ -59,6 +172,11 @@ func TestFiles(t *testing.T) {
 		files.chatPromptFile,
 		files.chatHistoryFile,
 		files.chatOutputFile,
+		files.chatSystemFile,
+		files.chatThoughtsFile,
+		files.chatMetaFile,
+		files.chatCacheFile,
+		files.chatUploadsFile,
 	} {
 		fmt.Println(f)
 		if !chkFileExists(f) {
@@ -69,6 +187,50 @@ func TestFiles(t *testing.T) {
 	}
 }
 
+// TestFilesJSONOutput tests that JSON output mode uses json output
+// files.
+func TestFilesJSONOutput(t *testing.T) {
+	files, err := NewFiles(t.TempDir(), "chat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files.UseJSONOutput()
+	if got, want := filepath.Base(files.outputFile), "output.json"; got != want {
+		t.Errorf("output file got %s want %s", got, want)
+	}
+	if got, want := filepath.Base(files.chatOutputFile), files.timestamp+"_output.json"; got != want {
+		t.Errorf("chat output file got %s want %s", got, want)
+	}
+	if got, want := filepath.Dir(files.chatOutputFile), files.chatDir; got != want {
+		t.Errorf("chat output directory got %s want %s", got, want)
+	}
+}
+
+// TestFilesWriteCandidates tests that candidate responses are written
+// to numbered chat output files.
+func TestFilesWriteCandidates(t *testing.T) {
+	files, err := NewFiles(t.TempDir(), "chat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := files.WriteCandidates([]genact.ApiCandidate{{LatestResponse: "one"}, {LatestResponse: "two"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"one", "two"} {
+		if got, want := filepath.Base(paths[i]), fmt.Sprintf("%s_output-%d.md", files.timestamp, i+1); got != want {
+			t.Errorf("candidate file got %s want %s", got, want)
+		}
+		b, err := os.ReadFile(paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("candidate %d got %q want %q", i+1, got, want)
+		}
+	}
+}
+
 // TestLatestHistoryFile tests to check if the latest history file is
 // extracted from a directory.
 func TestLatestHistoryFile(t *testing.T) {
@@ -84,3 +246,23 @@ func TestLatestHistoryFile(t *testing.T) {
 		t.Fatal("expected file reading from /dev/null to be an empty string")
 	}
 }
+
+// TestToolDenied tests the paths denied to the built-in tools, which
+// include the settings file only when it is in the working directory.
+func TestToolDenied(t *testing.T) {
+	tests := []struct {
+		workingDir string
+		yamlFile   string
+		want       []string
+	}{
+		{".", "settings.yaml", []string{"conversations", "settings.yaml"}},
+		{"/tmp/work", "/tmp/work/conf/settings.yaml", []string{"conversations", "conf/settings.yaml"}},
+		{"/tmp/work", "/etc/settings.yaml", []string{"conversations"}},
+	}
+	for _, tt := range tests {
+		got := toolDenied(tt.workingDir, tt.yamlFile)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s %s: denied mismatch (-want +got):\n%s", tt.workingDir, tt.yamlFile, diff)
+		}
+	}
+}
@@ -4,10 +4,17 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/generative-ai-go/genai"
@@ -18,6 +25,16 @@ func main() {
 
 	start := time.Now()
 
+	// run a batch of prompts or report usage
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "batch":
+			os.Exit(runBatch(os.Args[2:]))
+		case "report":
+			os.Exit(runReport(os.Args[2:], os.Stdout))
+		}
+	}
+
 	// options
 	options, err := ParseOptions()
 	if err != nil {
@@ -37,6 +54,25 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	switch {
+	case options.Record != "":
+		settings.Cassette, settings.CassetteMode = options.Record, genact.CassetteRecord
+	case options.Replay != "":
+		settings.Cassette, settings.CassetteMode = options.Replay, genact.CassetteReplay
+	}
+	if options.Model != "" {
+		settings.ModelName = options.Model
+	}
+	if options.Preflight {
+		settings.Preflight = true
+	}
+	if options.Candidates > 0 {
+		settings.CandidateCount = genai.Ptr(int32(options.Candidates))
+	}
+	if err := checkPick(options.Pick, settings); err != nil {
+		log.Fatal(err)
+	}
+	logger := newLogger(options.LogFormat, settings.Logging)
 
 	// load history if required
 	history := []*genai.Content{}
@@ -49,7 +85,7 @@ func main() {
 		if historyFile == "" {
 			break
 		}
-		log.Printf("Using history file %s for chat", historyFile)
+		logger.Info("using history file for chat", "path", historyFile)
 		history, err = genact.HistoryAPIToAIContent(historyFile)
 		if err != nil {
 			log.Fatal(err)
@@ -59,6 +95,11 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
+	case options.StudioHistory != "" && settings.KeepThoughts:
+		history, err = genact.HistoryStudioToAIContentWithThoughts(options.StudioHistory)
+		if err != nil {
+			log.Fatal(err)
+		}
 	case options.StudioHistory != "":
 		history, err = genact.HistoryStudioToAIContent(options.StudioHistory)
 		if err != nil {
@@ -72,8 +113,8 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// run api
-	response, err := genact.APIGetResponse(settings, history, string(prompt))
+	// load attachments
+	attachments, err := genact.LoadAttachments(options.Attach...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -83,19 +124,330 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = files.WritePrompt(prompt)
+
+	// system instruction: the file flag takes precedence over a studio
+	// export, which takes precedence over that recorded for the chat and
+	// then the settings
+	recordedSystem, err := files.ReadSystem()
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = files.WriteOutput([]byte(response.LatestResponse))
+	systemInstruction := recordedSystem
+	switch {
+	case options.SystemFile != "":
+		b, err := os.ReadFile(options.SystemFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		systemInstruction = string(b)
+	case options.StudioHistory != "":
+		si, err := genact.StudioSystemInstruction(options.StudioHistory)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if si != "" {
+			systemInstruction = si
+		}
+	}
+	if systemInstruction == "" {
+		systemInstruction = settings.SystemInstruction
+	}
+
+	// attachments previously uploaded with the File API
+	uploads, err := files.ReadUploads()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// tools the model may call
+	var tools *genact.ToolRegistry
+	if len(options.Tools) > 0 {
+		tools, err = genact.BuiltinTools(options.Directory, settings.ToolCommands, toolDenied(options.Directory, options.YamlFile)...).Select(options.Tools...)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// JSON output, optionally matching a schema
+	var schema *genact.ResponseSchema
+	if options.Schema != "" {
+		schema, err = genact.LoadResponseSchema(options.Schema)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if options.JSON {
+		files.UseJSONOutput()
+	}
+
+	// cancel the request on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// only report the token count if required
+	if options.CountOnly {
+		tc, err := genact.APICountTokens(ctx, settings, history, string(prompt),
+			genact.WithSystemInstruction(systemInstruction),
+			genact.WithAttachments(attachments...),
+			genact.WithUploads(uploads),
+			genact.WithTools(tools),
+			genact.WithLogger(logger),
+		)
+		if uerr := files.WriteUploads(uploads); uerr != nil {
+			log.Fatal(uerr)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("token count: %s\n", tc)
+		if err := tc.Check(); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	// save the prompt as a pending turn in case the request fails, with
+	// its attachments
+	err = files.WritePending(prompt)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = files.WriteHistory([]byte(response.FullHistory))
+	err = genact.SaveAttachments(files.chatDir, attachments)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// run api
+	apiOptions := []genact.Option{
+		genact.WithSystemInstruction(systemInstruction),
+		genact.WithConfirm(confirmBudget(ctx)),
+		genact.WithAttachments(attachments...),
+		genact.WithUploads(uploads),
+		genact.WithTools(tools),
+		genact.WithLogger(logger),
+		genact.WithRateLimiter(NewRateLimiter(options.Directory, settings)),
+		genact.WithLedger(NewLedger(options.Directory), options.Chat),
+		genact.WithSpending(NewSpending(options.Directory), options.Chat),
+	}
+	if options.JSON {
+		apiOptions = append(apiOptions, genact.WithJSONOutput(schema))
+	}
+	if settings.Cache {
+		cache, err := files.ReadCache()
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiOptions = append(apiOptions, genact.WithCache(cache))
+	}
+	var stream *os.File
+	if options.Stream {
+		stream, err = files.OutputStream()
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiOptions = append(apiOptions, genact.WithStream(func(chunk string) error {
+			fmt.Print(chunk)
+			_, err := stream.WriteString(chunk)
+			return err
+		}))
+	}
+	response, err := genact.APIGetResponseContext(ctx, settings, history, string(prompt), apiOptions...)
+	if stream != nil {
+		_ = stream.Close()
+		fmt.Println()
+		if err != nil {
+			if rerr := files.RemoveOutputStream(); rerr != nil {
+				logger.Warn("could not remove partial output", "error", rerr)
+			}
+		}
+	}
+	if uerr := files.WriteUploads(uploads); uerr != nil {
+		log.Fatal(uerr)
+	}
+	switch {
+	case errors.Is(err, context.Canceled), err != nil && ctx.Err() != nil:
+		fmt.Printf("request cancelled; prompt saved as pending turn %s\n", files.chatPendingFile)
+		os.Exit(1)
+	case errors.Is(err, context.DeadlineExceeded):
+		fmt.Printf("request timed out; prompt saved as pending turn %s\n", files.chatPendingFile)
+		os.Exit(1)
+	case errors.Is(err, genact.ErrContextLimit), errors.Is(err, genact.ErrTokenBudget), errors.Is(err, genact.ErrCostCap):
+		fmt.Printf("request not sent: %v\nprompt saved as pending turn %s\n", err, files.chatPendingFile)
+		os.Exit(1)
+	case errors.Is(err, genact.ErrInvalidJSON):
+		fmt.Printf("%v\nprompt saved as pending turn %s\n", err, files.chatPendingFile)
+		os.Exit(1)
+	case err != nil:
+		if message, code, ok := responseErrorExit(err); ok {
+			fmt.Printf("%s\nprompt saved as pending turn %s\n", message, files.chatPendingFile)
+			os.Exit(code)
+		}
+		log.Fatalf("%v\nprompt saved as pending turn %s", err, files.chatPendingFile)
+	}
+
+	// write each candidate, if several, choosing that for the history
+	if len(response.Candidates) > 0 {
+		paths, err := files.WriteCandidates(response.Candidates)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pick, err := pickCandidate(ctx, options.Pick, response.Candidates, paths)
+		if err != nil {
+			fmt.Printf("cancelled; prompt saved as pending turn %s\n", files.chatPendingFile)
+			os.Exit(1)
+		}
+		if err := response.Select(pick - 1); err != nil {
+			log.Fatalf("%v\nprompt saved as pending turn %s", err, files.chatPendingFile)
+		}
+	}
+
+	err = files.WriteTurn(prompt, systemInstruction, recordedSystem, response, settings.Cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	model := response.Model
+	if response.ModelVersion != "" {
+		model = response.ModelVersion
+	}
+	u := response.Usage
+	if response.Preflight != nil {
+		fmt.Printf("pre-flight count: %s\n", response.Preflight)
+	}
+	if response.Cache != nil {
+		fmt.Printf("cache %s holds %d history contents, expires %s\n",
+			response.Cache.Name, response.Cache.Contents, response.Cache.Expires.Local().Format(time.DateTime))
+	}
+	if response.ToolCalls > 0 {
+		fmt.Printf("tool calls: %d\n", response.ToolCalls)
+	}
+	if response.Continuations > 0 {
+		fmt.Printf("continuations: %d\n", response.Continuations)
+	}
+	if response.Truncated {
+		fmt.Println("response truncated at the output token limit; increase the maxOutputTokens or maxContinuations setting")
+	}
+	if len(response.Candidates) > 0 {
+		fmt.Printf("candidate %d of %d kept in the history\n", response.Selected+1, len(response.Candidates))
+	}
+	if response.RequestedModel != "" {
+		model += " (fallback from " + response.RequestedModel + ")"
+	}
+	fmt.Printf("model %s, finish reason %s, latency %s\n", model, response.FinishReason, response.Latency.Round(time.Millisecond))
+	fmt.Printf("tokens: prompt %d (cached %d), output %d, thoughts %d, total %d\n",
+		u.PromptTokens, u.CachedContentTokens, u.CandidatesTokens, u.ThoughtsTokens, u.TotalTokens)
+	if response.Cost > 0 {
+		fmt.Printf("estimated cost: $%.4f\n", response.Cost)
+	}
 	fmt.Printf("finished in %s, token count %d\n", time.Since(start), response.TokenCount)
 
 }
+
+// newLogger returns the logger for requests, writing records in the
+// text or json format to stderr, or discarding them if logging is not
+// enabled.
+func newLogger(format string, enabled bool) *slog.Logger {
+	switch {
+	case !enabled:
+		return slog.New(slog.DiscardHandler)
+	case format == "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, nil))
+}
+
+// checkPick checks that the candidate to pick, if any, is one of those
+// requested by the candidateCount setting.
+func checkPick(pick int, settings *genact.Settings) error {
+	count := 1
+	if settings.CandidateCount != nil {
+		count = int(*settings.CandidateCount)
+	}
+	if pick > count {
+		return fmt.Errorf("cannot pick candidate %d of %d", pick, count)
+	}
+	return nil
+}
+
+// pickCandidate returns the candidate to keep in the history, numbered
+// from 1, which is pick if set and received. Otherwise the candidate is
+// chosen interactively, since fewer candidates than requested may be
+// received once those blocked or stopped are removed.
+func pickCandidate(ctx context.Context, pick int, candidates []genact.ApiCandidate, paths []string) (int, error) {
+	if pick > len(candidates) {
+		fmt.Printf("candidate %d not received, only %d candidates were returned\n", pick, len(candidates))
+		pick = 0
+	}
+	if pick == 0 {
+		return chooseCandidate(ctx, candidates, paths)
+	}
+	return pick, nil
+}
+
+// chooseCandidate lists the candidate responses written to paths and
+// asks the user which to keep in the history, returning its number from
+// 1. The first candidate is chosen if no answer is given. An error is
+// returned if ctx is cancelled, such as by an interrupt, while waiting
+// for an answer.
+func chooseCandidate(ctx context.Context, candidates []genact.ApiCandidate, paths []string) (int, error) {
+	for i, c := range candidates {
+		preview, _, _ := strings.Cut(strings.TrimSpace(c.LatestResponse), "\n")
+		if r := []rune(preview); len(r) > 60 {
+			preview = string(r[:60]) + "..."
+		}
+		fmt.Printf("%d: %s\n   %s\n", i+1, paths[i], preview)
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("candidate to keep in the history [1-%d, default 1]: ", len(candidates))
+		answer, err := readLine(ctx, reader)
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			return 1, nil
+		}
+		n, perr := strconv.Atoi(answer)
+		if perr == nil && n >= 1 && n <= len(candidates) {
+			return n, nil
+		}
+		if err != nil {
+			return 1, nil
+		}
+	}
+}
+
+// confirmBudget returns a function asking the user to confirm sending a
+// request exceeding the token budget. The request is refused if ctx is
+// cancelled, such as by an interrupt, while waiting for an answer.
+func confirmBudget(ctx context.Context) func(genact.TokenCount) bool {
+	return func(tc genact.TokenCount) bool {
+		fmt.Printf("the request of %s exceeds the token budget; send it anyway? [y/N] ", tc)
+		answer, _ := readLine(ctx, bufio.NewReader(os.Stdin))
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
+
+// readLine reads a line from reader, returning early with the error of
+// ctx if it is done first. Reads from stdin cannot be interrupted, so
+// the read is made in a goroutine which is left waiting if ctx is done;
+// the program is expected to exit soon after.
+func readLine(ctx context.Context, reader *bufio.Reader) (string, error) {
+	type line struct {
+		s   string
+		err error
+	}
+	ch := make(chan line, 1)
+	go func() {
+		s, err := reader.ReadString('\n')
+		ch <- line{s, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case l := <-ch:
+		return l.s, l.err
+	}
+}
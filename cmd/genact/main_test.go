@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/rorycl/genact"
+)
+
+// TestMainFake runs genact end-to-end with the fake backend, which
+// echoes the prompt, continuing a conversation from an api history
+// file.
+func TestMainFake(t *testing.T) {
+
+	dir := t.TempDir()
+	settings := "modelName: gemini-2.5-pro\nbackend: fake\nlogging: false\n"
+	if err := os.WriteFile(filepath.Join(dir, "settings.yaml"), []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "prompt.txt"), []byte("And Murray?"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	historyFile := "../../testdata/api-history-tennis.json"
+	history, err := genact.HistoryAPIToAIContent(historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{
+		"genact", "-c", "tennis", "-d", dir, "-a", historyFile,
+		"-y", filepath.Join(dir, "settings.yaml"), filepath.Join(dir, "prompt.txt"),
+	}
+	main()
+
+	output, err := os.ReadFile(filepath.Join(dir, outputFileBaseName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(output), "echo: And Murray?"; got != want {
+		t.Errorf("output got %q want %q", got, want)
+	}
+
+	historyFile = LatestHistoryFile(filepath.Join(dir, conversationDir, "tennis"))
+	if historyFile == "" {
+		t.Fatal("history file not written")
+	}
+	b, err := os.ReadFile(historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var turns []genact.APIConversation
+	if err := json.Unmarshal(b, &turns); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(turns), len(history)+2; got != want {
+		t.Errorf("got %d history turns want %d", got, want)
+	}
+	pending, err := filepath.Glob(filepath.Join(dir, conversationDir, "tennis", "*_"+pendingFileBaseName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) > 0 {
+		t.Errorf("pending turn %s not removed", pending[0])
+	}
+}
+
+// TestPickCandidate tests checking the candidate to pick against those
+// requested and falling back to choosing a candidate when fewer are
+// received.
+func TestPickCandidate(t *testing.T) {
+
+	settings := &genact.Settings{CandidateCount: genai.Ptr(int32(3))}
+	if err := checkPick(3, settings); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := checkPick(4, settings); err == nil {
+		t.Error("expected an error picking candidate 4 of 3")
+	}
+	if err := checkPick(2, &genact.Settings{}); err == nil {
+		t.Error("expected an error picking candidate 2 of 1")
+	}
+
+	candidates := []genact.ApiCandidate{{LatestResponse: "one"}, {LatestResponse: "two"}}
+	paths := []string{"output_1.md", "output_2.md"}
+	ctx := context.Background()
+	if got, _ := pickCandidate(ctx, 2, candidates, paths); got != 2 {
+		t.Errorf("pick got %d want 2", got)
+	}
+	// the test's stdin is empty, so the default candidate is chosen
+	if got, _ := pickCandidate(ctx, 3, candidates, paths); got != 1 {
+		t.Errorf("pick of missing candidate got %d want 1", got)
+	}
+}
+
+// TestReadLine tests that reading a line returns once the context is
+// cancelled, as it is on an interrupt, without waiting for input.
+func TestReadLine(t *testing.T) {
+
+	r, w := io.Pipe()
+	defer func() { _ = w.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := readLine(ctx, bufio.NewReader(r)); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v want context.Canceled", err)
+	}
+
+	line, err := readLine(context.Background(), bufio.NewReader(strings.NewReader("2\n")))
+	if err != nil || line != "2\n" {
+		t.Errorf("got line %q error %v want \"2\\n\"", line, err)
+	}
+}
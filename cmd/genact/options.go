@@ -48,16 +48,163 @@ The 20250630T204842-history.json file can be used for the next call to
 the api to "continue" the conversation, which is what will happen by
 default if no apiHistory or studioHistory is specified.
 
+The meta.json file records the model and model version used, the finish
+reason, the latency and the token usage of the turn.
+
+Thought summaries from models supporting thinking are saved to a
+timestamped thoughts.md file alongside the output, and are not kept in
+the history unless the "keepThoughts" setting is true.
+
+A system instruction may be provided with the -i/--systemInstruction
+file flag, from a studio history file, or with the "systemInstruction"
+setting, in that order of precedence. The system instruction is recorded
+in the chat directory as system.txt and reused for later turns of the
+chat unless another is provided.
+
+The prompt is saved as a timestamped "pending" file before it is sent,
+which is removed once a response is received and the prompt file is
+written, so that the prompt is not lost if the request fails, times out
+(see the "requestTimeout" setting) or is cancelled with Ctrl-C.
+
+Use the --stream flag to print the response to the terminal as it is
+received. The streamed output is also appended to the timestamped
+output file as it arrives.
+
+Set "preflight" to true, or use --preflight, to count the tokens of the
+system instruction, history and prompt before each request and check
+them against the context limit of the model and the "tokenBudget"
+setting, if any. A request over budget is refused, sent with a warning
+or sent after confirmation, according to the "overBudget" setting of
+"refuse", "warn" or "prompt". Use --count-only to report the token count
+without sending the request.
+
+Set "cache" to true to use Gemini context caching for the system
+instruction and history. The cache name and expiry are saved in the chat
+directory as cache.json and the cache is reused by later turns until it
+expires (see "cacheTTL") or the history no longer matches it, for
+example after compaction with thinner, when a new cache is made.
+
+Use --attach, which may be repeated, to send files such as screenshots,
+diagrams, pdfs or audio with the prompt. Attachments are saved in an
+"attachments" directory in the chat directory and referenced from the
+history file, so that they are replayed in later turns of the chat.
+Attachments larger than the "uploadThreshold" setting, or which would
+take a request over the 20MB inline limit, are uploaded with the Gemini
+File API instead of being sent inline. Uploads are recorded in the chat
+directory as uploads.json and reused by later turns until they expire.
+
+Use --tool, which may be repeated, to let the model call local tools
+during the chat: read_file and list_dir read files and directories in
+the working directory (see -d), other than the conversations directory
+and the settings file, and run_command runs the commands listed in the
+"toolCommands" setting there. run_command passes the command any
+arguments the model chooses, so only list commands which are safe with
+any arguments: cat, for example, could read the settings file and its
+api key. The function calls and responses are recorded in the history.
+Set "maxToolRounds" to limit the rounds of calls in a turn.
+
+Use --json to request a JSON response, optionally matching the JSON
+Schema file provided with --schema. The response is validated and
+written to output.json and a timestamped _output.json file rather than
+markdown. Set "jsonReasks" to ask the model again, with the validation
+errors, when the response is invalid.
+
+Use --candidates to request several candidate responses, written to
+numbered _output-1.md, _output-2.md files and so on, and choose which
+is kept in the history when prompted, or with --pick. The
+"candidateCount" setting does the same. With --stream only the first
+candidate is printed as it arrives. Function calls, continuations and
+JSON re-asks use the first candidate.
+
+Set "maxContinuations" to continue a response stopped at the
+"maxOutputTokens" limit by asking the model to carry on. The parts are
+joined into a single response in the output and history.
+
+Use --record to save the api requests and responses, with the api key
+redacted, to a cassette file, for example to reproduce a problem. Use
+--replay to serve the recorded responses again without network access;
+a request which no longer matches the cassette fails. The "cassette"
+and "cassetteMode" settings do the same.
+
+Progress, such as retries, tool calls and token usage, is logged to
+stderr unless the "logging" setting is false. Use --log-format json to
+log json records, with fields such as model, attempt, duration and the
+token counts, for collection by other programs.
+
+Use -m/--model to choose the model, by name or by one of the aliases of
+the "modelAliases" setting, such as "fast" or "deep", in place of the
+"modelName" setting. When the model is overloaded, out of quota or not
+found once retries are exhausted, the request falls back to each of the
+"fallbackModels" in turn. The model used is printed and recorded in the
+meta.json file of the turn.
+
+The cost of each turn is estimated in US dollars from its token usage
+and a table of model prices, printed and recorded in the meta.json file
+of the turn. The bundled prices, which may be out of date, are replaced
+or added to with the "pricing" setting. Set "costCapChat" or
+"costCapDay" to refuse requests once the estimated costs of the chat, or
+of all chats today, reach the cap. The costs are totalled in
+conversations/spending.json, the estimated cost of each request being
+reserved while it is sent so that the genact processes and batches
+using the directory do not together pass a cap.
+
+Set "requestsPerMinute" and "tokensPerMinute" to keep within the quota
+of the api. Each request waits until it can be sent within the limits,
+its tokens being estimated from the pre-flight count, or the size of
+the request, and corrected from the usage of the response. Only the
+requests for responses are limited, not those counting tokens, creating
+caches or uploading files. The requests of the last minute are recorded
+in conversations/ratelimit.json so that the limits are shared by all
+the genact processes, including batches, using the directory.
+
+genact exits with 3 if the prompt or response is blocked, 4 if the
+response is empty, 5 if the output token limit is reached before any
+response and 6 if the response is stopped for recitation. The prompt
+is then kept as a pending turn. Other errors exit with 1.
+
+Set "backend" to "openai" to use an OpenAI-compatible chat completions
+api, such as llama.cpp or Ollama serving a self-hosted model, at the
+"endpoint" setting, for example http://localhost:11434/v1. Chats and
+history files may be moved between backends. Token counts are estimated
+and caching and uploads are not available with this backend. Set
+"backend" to "fake" to try genact without an api key; the fake backend
+echoes each prompt.
+
+Use "genact batch" to run many prompts, each in its own chat, from a
+JSONL file or a directory of prompt files. See "genact batch --help".
+
+Each api call is recorded with its chat, model, tokens, estimated cost,
+duration and status in the usage ledger conversations/ledger.jsonl. Use
+"genact report" to total the calls by chat, model, day or week. See
+"genact report --help".
+
 ./genact [-a apiHistory] [-s studioHistory] -c "chat name" \
-         [-d directory] [-y yaml] `, genact.Version)
+         [-d directory] [-y yaml] [-m model] [-i systemInstruction] [--stream] \
+         [--count-only] [--preflight] [--attach file ...] [--tool name ...] \
+         [--json] [--schema file] [--record|--replay cassette] \
+         [--candidates n] [--pick n] [--log-format text|json] `, genact.Version)
 
 // CmdOptions are flag options which consume os.Args input.
 type CmdOptions struct {
-	APIHistory     string `short:"a" long:"apiHistory" description:"path to api history json file"`
-	StudioHistory  string `short:"s" long:"studioHistory" description:"path to studio history json file"`
-	Chat           string `short:"c" long:"chatName" description:"name of this conversation" required:"true"`
-	Directory      string `short:"d" long:"directory" description:"directory" default:"current working directory"`
-	YamlFile       string `short:"y" long:"yamlFile" description:"settings yaml file" default:"settings.yaml"`
+	APIHistory     string   `short:"a" long:"apiHistory" description:"path to api history json file"`
+	StudioHistory  string   `short:"s" long:"studioHistory" description:"path to studio history json file"`
+	Chat           string   `short:"c" long:"chatName" description:"name of this conversation" required:"true"`
+	Directory      string   `short:"d" long:"directory" description:"directory" default:"current working directory"`
+	YamlFile       string   `short:"y" long:"yamlFile" description:"settings yaml file" default:"settings.yaml"`
+	Model          string   `short:"m" long:"model" description:"model name or alias, in place of the modelName setting"`
+	SystemFile     string   `short:"i" long:"systemInstruction" description:"path to system instruction text file"`
+	Stream         bool     `long:"stream" description:"stream the response to the terminal"`
+	CountOnly      bool     `long:"count-only" description:"report the token count of the request without sending it"`
+	Preflight      bool     `long:"preflight" description:"count and check the tokens of the request before sending it"`
+	Attach         []string `long:"attach" description:"file to attach to the prompt, such as an image, pdf or audio file (repeatable)"`
+	Tools          []string `long:"tool" description:"enable a tool the model may call: read_file, list_dir or run_command (repeatable)"`
+	JSON           bool     `long:"json" description:"request a JSON response, written to output.json"`
+	Schema         string   `long:"schema" description:"path to a JSON Schema file for the JSON response (implies --json)"`
+	Record         string   `long:"record" description:"record the api requests and responses to a cassette file"`
+	Replay         string   `long:"replay" description:"replay the api responses from a cassette file"`
+	Candidates     int      `long:"candidates" description:"request several candidate responses, written to numbered output files"`
+	Pick           int      `long:"pick" description:"the candidate kept in the history, otherwise chosen interactively"`
+	LogFormat      string   `long:"log-format" description:"format of the log written to stderr" choice:"text" choice:"json" default:"text"`
 	withoutHistory bool
 
 	// paths
@@ -98,6 +245,19 @@ func checkDirExists(path string) bool {
 	return true
 }
 
+// chatName returns the chat directory name for a chat, in lower case
+// with spaces replaced by underscores.
+func chatName(chat string) (string, error) {
+	if strings.TrimSpace(chat) == "" {
+		return "", errors.New("chat name must be specified")
+	}
+	name := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(chat)), " ", "_")
+	if strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("chat name %s cannot contain path separator %q", name, filepath.Separator)
+	}
+	return name, nil
+}
+
 // ParserError indicates a parser error
 type ParserError struct {
 	err error
@@ -134,6 +294,41 @@ func ParseOptions() (*CmdOptions, error) {
 		return nil, fmt.Errorf("api history file %s could not be found", options.StudioHistory)
 	}
 
+	if options.SystemFile != "" && !checkFileExists(options.SystemFile) {
+		return nil, fmt.Errorf("system instruction file %s could not be found", options.SystemFile)
+	}
+
+	for _, a := range options.Attach {
+		if !checkFileExists(a) {
+			return nil, fmt.Errorf("attachment file %s could not be found", a)
+		}
+	}
+
+	if options.Schema != "" {
+		if !checkFileExists(options.Schema) {
+			return nil, fmt.Errorf("schema file %s could not be found", options.Schema)
+		}
+		options.JSON = true
+	}
+
+	if options.Record != "" && options.Replay != "" {
+		return nil, errors.New("this program cannot both record and replay a cassette")
+	}
+	if options.Replay != "" && !checkFileExists(options.Replay) {
+		return nil, fmt.Errorf("cassette file %s could not be found", options.Replay)
+	}
+
+	if options.Candidates < 0 || options.Candidates > 8 {
+		return nil, fmt.Errorf("candidates %d must be between 1 and 8", options.Candidates)
+	}
+	if options.Pick < 0 || (options.Candidates > 0 && options.Pick > options.Candidates) {
+		return nil, fmt.Errorf("cannot pick candidate %d of %d", options.Pick, options.Candidates)
+	}
+
+	if _, err := genact.BuiltinTools("", nil).Select(options.Tools...); err != nil {
+		return nil, err
+	}
+
 	// directory check
 	if options.Directory == "" || options.Directory == "current working directory" {
 		var err error
@@ -148,12 +343,10 @@ func ParseOptions() (*CmdOptions, error) {
 	}
 
 	// chat
-	if options.Chat == "" {
-		return nil, errors.New("chat name must be specified")
-	}
-	options.Chat = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(options.Chat)), " ", "_")
-	if strings.ContainsRune(options.Chat, filepath.Separator) {
-		return nil, fmt.Errorf("chat name %s cannot contain path separator %q", options.Chat, filepath.Separator)
+	var err error
+	options.Chat, err = chatName(options.Chat)
+	if err != nil {
+		return nil, err
 	}
 
 	// prompt
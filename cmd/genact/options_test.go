@@ -30,6 +30,12 @@ func TestOptions(t *testing.T) {
 		isErr             bool
 		dir               string
 		chatDirPathExists bool
+		stream            bool
+		countOnly         bool
+		attachments       int
+		tools             int
+		json              bool
+		candidates        int
 	}{
 		{
 			desc:              "simple invocation no error",
@@ -83,6 +89,123 @@ func TestOptions(t *testing.T) {
 			dir:               tmpDir,
 			chatDirPathExists: false,
 		},
+		{
+			desc:              "invocation with stream",
+			args:              []string{"prog", "-c", "chat1", "--stream", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+			stream:            true,
+		},
+		{
+			desc:              "invocation with count only",
+			args:              []string{"prog", "-c", "chat1", "--count-only", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+			countOnly:         true,
+		},
+		{
+			desc:              "invocation with attachments",
+			args:              []string{"prog", "-c", "chat1", "--attach", "testdata/optionsdir3/prompt.txt", "--attach", "testdata/optionsdir3/settings.yaml", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+			attachments:       2,
+		},
+		{
+			desc:              "invocation error with missing attachment",
+			args:              []string{"prog", "-c", "chat1", "--attach", "testdata/optionsdir3/unknown.png", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation with tools",
+			args:              []string{"prog", "-c", "chat1", "--tool", "read_file", "--tool", "list_dir", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+			tools:             2,
+		},
+		{
+			desc:              "invocation error with unknown tool",
+			args:              []string{"prog", "-c", "chat1", "--tool", "delete_file", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation with json output",
+			args:              []string{"prog", "-c", "chat1", "--json", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+			json:              true,
+		},
+		{
+			desc:              "invocation with schema implies json output",
+			args:              []string{"prog", "-c", "chat1", "--schema", "testdata/optionsdir3/prompt.txt", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+			json:              true,
+		},
+		{
+			desc:              "invocation error with missing schema",
+			args:              []string{"prog", "-c", "chat1", "--schema", "testdata/optionsdir3/schema.json", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation error with record and replay",
+			args:              []string{"prog", "-c", "chat1", "--record", "c.json", "--replay", "testdata/optionsdir3/prompt.txt", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation error with missing cassette",
+			args:              []string{"prog", "-c", "chat1", "--replay", "testdata/optionsdir3/cassette.json", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation with candidates",
+			args:              []string{"prog", "-c", "chat1", "--candidates", "3", "--pick", "2", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+			candidates:        3,
+		},
+		{
+			desc:              "invocation error with too many candidates",
+			args:              []string{"prog", "-c", "chat1", "--candidates", "9", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation error with pick out of range",
+			args:              []string{"prog", "-c", "chat1", "--candidates", "2", "--pick", "3", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation error with unknown log format",
+			args:              []string{"prog", "-c", "chat1", "--log-format", "xml", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
+		{
+			desc:              "invocation with system instruction file",
+			args:              []string{"prog", "-c", "chat1", "-i", "testdata/optionsdir3/prompt.txt", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             false,
+			dir:               "testdata/optionsdir3",
+			chatDirPathExists: true,
+		},
+		{
+			desc:              "invocation error with missing system instruction file",
+			args:              []string{"prog", "-c", "chat1", "-i", "testdata/optionsdir3/unknown.txt", "-d", "testdata/optionsdir3", "testdata/optionsdir3/prompt.txt"},
+			isErr:             true,
+			chatDirPathExists: false,
+		},
 		{
 			desc:              "invocation with current working directory",
 			args:              []string{"prog", "-c", "chat1", "testdata/optionsdir3/prompt.txt"},
@@ -118,6 +241,24 @@ func TestOptions(t *testing.T) {
 			if got, want := cmdOptions.chatDirPathExists, tt.chatDirPathExists; got != want {
 				t.Errorf("chatDirPathExists got %t want %t", got, want)
 			}
+			if got, want := cmdOptions.Stream, tt.stream; got != want {
+				t.Errorf("stream got %t want %t", got, want)
+			}
+			if got, want := cmdOptions.CountOnly, tt.countOnly; got != want {
+				t.Errorf("countOnly got %t want %t", got, want)
+			}
+			if got, want := len(cmdOptions.Attach), tt.attachments; got != want {
+				t.Errorf("attachments got %d want %d", got, want)
+			}
+			if got, want := len(cmdOptions.Tools), tt.tools; got != want {
+				t.Errorf("tools got %d want %d", got, want)
+			}
+			if got, want := cmdOptions.JSON, tt.json; got != want {
+				t.Errorf("json got %t want %t", got, want)
+			}
+			if got, want := cmdOptions.Candidates, tt.candidates; got != want {
+				t.Errorf("candidates got %d want %d", got, want)
+			}
 			// fmt.Printf("%#v\n", cmdOptions)
 		})
 	}
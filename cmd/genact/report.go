@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/genact"
+)
+
+var reportUsage string = fmt.Sprintf(`report [options]
+
+version %s
+
+Summarise the usage ledger, conversations/ledger.jsonl, in which genact
+records each api call, including retries and the rounds of function
+calls, with its chat, model, tokens, estimated cost, duration and
+status. The calls are totalled by chat, model, day or week, in local
+time, and written as a table or as csv.
+
+./genact report [-d directory] [--by chat|model|day|week] \
+         [--format table|csv] [--since yyyy-mm-dd] [--until yyyy-mm-dd]`, genact.Version)
+
+// ReportOptions are the flag options of the report command.
+type ReportOptions struct {
+	Directory string `short:"d" long:"directory" description:"directory" default:"current working directory"`
+	By        string `long:"by" description:"total the calls by" choice:"chat" choice:"model" choice:"day" choice:"week" default:"chat"`
+	Format    string `long:"format" description:"output format" choice:"table" choice:"csv" default:"table"`
+	Since     string `long:"since" description:"first day reported, such as 2025-07-01"`
+	Until     string `long:"until" description:"last day reported"`
+
+	since, until time.Time
+}
+
+// reportRow is the total of the api calls of a chat, model, day or
+// week.
+type reportRow struct {
+	Key      string
+	Calls    int
+	Errors   int
+	Usage    genact.UsageTotal
+	Cost     float64
+	Duration time.Duration
+}
+
+// ParseReportOptions parses the report command options in args, the
+// command line arguments following "report".
+func ParseReportOptions(args []string) (*ReportOptions, error) {
+
+	var options ReportOptions
+	var parser = flags.NewParser(&options, flags.Default)
+	parser.Name = "genact"
+	parser.Usage = reportUsage
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return nil, ParserError{err}
+	}
+
+	if options.Directory == "" || options.Directory == "current working directory" {
+		var err error
+		options.Directory, err = os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("could not get current working directory: %s", err)
+		}
+	} else if !checkDirExists(options.Directory) {
+		return nil, fmt.Errorf("could not find directory %s", options.Directory)
+	}
+	for _, d := range []struct {
+		value string
+		t     *time.Time
+	}{{options.Since, &options.since}, {options.Until, &options.until}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.ParseInLocation(time.DateOnly, d.value, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("date %s must be in the form yyyy-mm-dd", d.value)
+		}
+		*d.t = t
+	}
+	if !options.until.IsZero() {
+		options.until = options.until.AddDate(0, 0, 1) // the end of the day
+	}
+	return &options, nil
+}
+
+// reportKey returns the key of the row of r when totalling by chat,
+// model, day or week.
+func reportKey(r genact.LedgerRecord, by string) string {
+	t := r.Time.Local()
+	switch by {
+	case "model":
+		return r.Model
+	case "day":
+		return t.Format(time.DateOnly)
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	if r.Chat == "" {
+		return "-"
+	}
+	return r.Chat
+}
+
+// reportRows totals the records between since and until, if not zero,
+// by chat, model, day or week, in the order of the keys.
+func reportRows(records []genact.LedgerRecord, by string, since, until time.Time) []reportRow {
+	rows := map[string]*reportRow{}
+	for _, r := range records {
+		if (!since.IsZero() && r.Time.Before(since)) || (!until.IsZero() && !r.Time.Before(until)) {
+			continue
+		}
+		key := reportKey(r, by)
+		row, ok := rows[key]
+		if !ok {
+			row = &reportRow{Key: key}
+			rows[key] = row
+		}
+		row.Calls++
+		if r.Status != genact.LedgerOK {
+			row.Errors++
+		}
+		row.Usage = row.Usage.Add(r.Usage.Total())
+		row.Cost += r.Cost
+		row.Duration += time.Duration(r.DurationMS) * time.Millisecond
+	}
+	var sorted []reportRow
+	for _, key := range slices.Sorted(maps.Keys(rows)) {
+		sorted = append(sorted, *rows[key])
+	}
+	return sorted
+}
+
+// reportTotal returns the total of rows.
+func reportTotal(rows []reportRow) reportRow {
+	total := reportRow{Key: "total"}
+	for _, r := range rows {
+		total.Calls += r.Calls
+		total.Errors += r.Errors
+		total.Usage = total.Usage.Add(r.Usage)
+		total.Cost += r.Cost
+		total.Duration += r.Duration
+	}
+	return total
+}
+
+// writeReportTable writes rows as a table with a total.
+func writeReportTable(w io.Writer, by string, rows []reportRow) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\tcalls\terrors\tprompt\tcached\toutput\tthoughts\ttotal\tcost\tduration\t\n", by)
+	for _, r := range append(rows, reportTotal(rows)) {
+		u := r.Usage
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t$%.4f\t%s\t\n",
+			r.Key, r.Calls, r.Errors, u.PromptTokens, u.CachedContentTokens, u.CandidatesTokens,
+			u.ThoughtsTokens, u.TotalTokens, r.Cost, r.Duration.Round(time.Second))
+	}
+	return tw.Flush()
+}
+
+// writeReportCSV writes rows as csv with a header.
+func writeReportCSV(w io.Writer, by string, rows []reportRow) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{by, "calls", "errors", "promptTokens", "cachedTokens", "outputTokens", "thoughtsTokens", "totalTokens", "cost", "durationSeconds"})
+	itoa := func(i int64) string { return strconv.FormatInt(i, 10) }
+	for _, r := range rows {
+		u := r.Usage
+		_ = cw.Write([]string{
+			r.Key, strconv.Itoa(r.Calls), strconv.Itoa(r.Errors),
+			itoa(u.PromptTokens), itoa(u.CachedContentTokens), itoa(u.CandidatesTokens),
+			itoa(u.ThoughtsTokens), itoa(u.TotalTokens),
+			strconv.FormatFloat(r.Cost, 'f', 6, 64),
+			strconv.FormatFloat(r.Duration.Seconds(), 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// runReport runs the report command with the command line arguments
+// following "report", writing the report to w and returning the exit
+// code.
+func runReport(args []string, w io.Writer) int {
+
+	options, err := ParseReportOptions(args)
+	if err != nil {
+		var pe ParserError
+		if !errors.As(err, &pe) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return exitError
+	}
+	path := filepath.Join(options.Directory, conversationDir, ledgerFileName)
+	records, err := genact.ReadLedger(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if len(records) == 0 {
+		fmt.Fprintf(os.Stderr, "no api calls recorded in %s\n", path)
+		return exitError
+	}
+
+	rows := reportRows(records, options.By, options.since, options.until)
+	if options.Format == "csv" {
+		err = writeReportCSV(w, options.By, rows)
+	} else {
+		err = writeReportTable(w, options.By, rows)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/rorycl/genact"
+)
+
+// ledgerRecords are the records of a usage ledger for testing, on the
+// 30th of June and the 1st and 7th of July 2025 in local time.
+func ledgerRecords() []genact.LedgerRecord {
+	day := func(d int) time.Time { return time.Date(2025, 6, 30+d, 12, 0, 0, 0, time.Local) }
+	usage := genact.Usage{PromptTokens: 100, CandidatesTokens: 10, TotalTokens: 110}
+	return []genact.LedgerRecord{
+		{Time: day(0), Chat: "a", Model: "gemini-2.5-pro", Status: genact.LedgerError, Error: "overloaded", DurationMS: 500},
+		{Time: day(0), Chat: "a", Model: "gemini-2.5-flash", Usage: usage, Cost: 0.25, DurationMS: 1500, Status: genact.LedgerOK},
+		{Time: day(1), Chat: "b", Model: "gemini-2.5-pro", Usage: usage, Cost: 1, DurationMS: 2000, Status: genact.LedgerOK},
+		{Time: day(7), Chat: "a", Model: "gemini-2.5-pro", Usage: usage, Cost: 2, DurationMS: 1000, Status: genact.LedgerOK},
+	}
+}
+
+// TestReportRows tests totalling ledger records by chat, model, day and
+// week.
+func TestReportRows(t *testing.T) {
+
+	type row struct {
+		Key    string
+		Calls  int
+		Errors int
+		Cost   float64
+	}
+	tests := []struct {
+		by   string
+		want []row
+	}{
+		{"chat", []row{{"a", 3, 1, 2.25}, {"b", 1, 0, 1}}},
+		{"model", []row{{"gemini-2.5-flash", 1, 0, 0.25}, {"gemini-2.5-pro", 3, 1, 3}}},
+		{"day", []row{{"2025-06-30", 2, 1, 0.25}, {"2025-07-01", 1, 0, 1}, {"2025-07-07", 1, 0, 2}}},
+		{"week", []row{{"2025-W27", 3, 1, 1.25}, {"2025-W28", 1, 0, 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.by, func(t *testing.T) {
+			var got []row
+			for _, r := range reportRows(ledgerRecords(), tt.by, time.Time{}, time.Time{}) {
+				got = append(got, row{r.Key, r.Calls, r.Errors, r.Cost})
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("rows mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestReportRowsLarge tests that totals of more tokens than an int32
+// holds do not overflow.
+func TestReportRowsLarge(t *testing.T) {
+
+	usage := genact.Usage{PromptTokens: math.MaxInt32, TotalTokens: math.MaxInt32}
+	records := []genact.LedgerRecord{
+		{Time: time.Now(), Chat: "a", Usage: usage, Status: genact.LedgerOK},
+		{Time: time.Now(), Chat: "a", Usage: usage, Status: genact.LedgerOK},
+		{Time: time.Now(), Chat: "b", Usage: usage, Status: genact.LedgerOK},
+	}
+	rows := reportRows(records, "chat", time.Time{}, time.Time{})
+	if got, want := rows[0].Usage.PromptTokens, int64(2*math.MaxInt32); got != want {
+		t.Errorf("row prompt tokens got %d want %d", got, want)
+	}
+	if got, want := reportTotal(rows).Usage.TotalTokens, int64(3*math.MaxInt32); got != want {
+		t.Errorf("total tokens got %d want %d", got, want)
+	}
+}
+
+// TestRunReport runs the report command on a ledger, as a table and as
+// csv between dates.
+func TestRunReport(t *testing.T) {
+
+	dir := t.TempDir()
+	var b []byte
+	for _, r := range ledgerRecords() {
+		line, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if err := os.MkdirAll(filepath.Join(dir, conversationDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, conversationDir, ledgerFileName), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if code := runReport([]string{"-d", dir, "--by", "model"}, &out); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if got, want := len(lines), 4; got != want {
+		t.Fatalf("got %d table lines want %d:\n%s", got, want, out.String())
+	}
+	if got, want := strings.Fields(lines[3]), []string{"total", "4", "1", "300", "0", "30", "0", "330", "$3.2500", "5s"}; !cmp.Equal(got, want) {
+		t.Errorf("total got %v want %v", got, want)
+	}
+
+	out.Reset()
+	if code := runReport([]string{"-d", dir, "--by", "day", "--format", "csv", "--since", "2025-07-01", "--until", "2025-07-01"}, &out); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	want := "day,calls,errors,promptTokens,cachedTokens,outputTokens,thoughtsTokens,totalTokens,cost,durationSeconds\n" +
+		"2025-07-01,1,0,100,0,10,0,110,1.000000,2.000\n"
+	if got := out.String(); got != want {
+		t.Errorf("csv got %q want %q", got, want)
+	}
+}
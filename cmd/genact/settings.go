@@ -1,15 +1,11 @@
 package main
 
 import (
-	yaml "gopkg.in/yaml.v3"
+	"github.com/rorycl/genact"
 )
 
-type Settings map[string]string
-
-// LoadYaml reads some settings into a Settings map.
-func LoadYaml(yamlByte []byte) (Settings, error) {
-
-	var settings Settings
-	err := yaml.Unmarshal(yamlByte, &settings)
-	return settings, err
+// LoadYaml reads settings from yaml into a genact.Settings struct,
+// reporting unknown keys and invalid values as errors.
+func LoadYaml(yamlByte []byte) (*genact.Settings, error) {
+	return genact.ParseSettings(yamlByte)
 }
@@ -15,7 +15,7 @@ func TestYaml(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got, want := y["modelName"], "gemini-2.5-pro"; got != want {
+	if got, want := y.ModelName, "gemini-2.5-pro"; got != want {
 		t.Errorf("got %s != want %s", got, want)
 	}
 
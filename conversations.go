@@ -10,12 +10,15 @@ import (
 )
 
 // conversation is a record of single user/agent ("model") conversation
-// interaction.
+// interaction. Any function call and response turns between the user
+// prompt and the model response are kept with the conversation.
 type conversation struct {
-	User     string
-	Model    []string
-	Idx      int
-	agentLen int
+	User        string
+	Attachments []APIAttachment   // user attachments
+	Tools       []APIConversation // function call and response turns
+	Model       []string
+	Idx         int
+	agentLen    int
 }
 
 // String is a string representation of a conversation, suitable for
@@ -24,6 +27,18 @@ func (co conversation) String() string {
 	output := fmt.Sprintf("\n`conversation`: %d\n", co.Idx)
 	output += "\n`user`:\n\n"
 	output += co.User
+	for _, a := range co.Attachments {
+		output += fmt.Sprintf("\n\n`attachment`: %s (%s)", a.Path, a.MIMEType)
+	}
+	for _, t := range co.Tools {
+		for _, fc := range t.FunctionCalls {
+			args, _ := json.Marshal(fc.Args)
+			output += fmt.Sprintf("\n\n`tool call`: %s %s", fc.Name, args)
+		}
+		for _, fr := range t.FunctionResponses {
+			output += fmt.Sprintf("\n\n`tool response`: %s", fr.Name)
+		}
+	}
 	output += "\n\n---\n\n`agent`:\n\n"
 	output += strings.Join(co.Model, "\n\n---\n\n")
 	return output
@@ -241,12 +256,10 @@ func (c *Conversations) Compact() {
 // slice of APIConversation.
 func (c *Conversations) Serialize() ([]byte, error) {
 	ajc := []APIConversation{}
-	addContent := func(role string, parts []string) {
-		ajc = append(ajc, APIConversation{role, parts})
-	}
 	for _, conv := range c.conversations {
-		addContent("user", []string{conv.User})
-		addContent("model", conv.Model)
+		ajc = append(ajc, APIConversation{Role: "user", Parts: []string{conv.User}, Attachments: conv.Attachments})
+		ajc = append(ajc, conv.Tools...)
+		ajc = append(ajc, APIConversation{Role: "model", Parts: conv.Model})
 	}
 	return json.MarshalIndent(ajc, "", "  ")
 }
@@ -262,6 +275,10 @@ func NewConversations(filePath string) (*Conversations, error) {
 	idx := 0
 	conv := conversation{Idx: idx}
 	for _, h := range history {
+		if h.IsTool() {
+			conv.Tools = append(conv.Tools, h)
+			continue
+		}
 		if h.Role == "user" {
 			if conv.User != "" {
 				conversations.conversations = append(conversations.conversations, conv)
@@ -269,6 +286,7 @@ func NewConversations(filePath string) (*Conversations, error) {
 				conv = conversation{Idx: idx}
 			}
 			conv.User = strings.Join(h.Parts, "\n\n--\n\n")
+			conv.Attachments = h.Attachments
 		} else { // agent|model
 			conv.Model = h.Parts
 			conv.agentLen = len(h.Parts)
@@ -1,7 +1,10 @@
 package genact
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -187,3 +190,91 @@ func TestConversationsKeepAndReview(t *testing.T) {
 	}
 
 }
+
+// TestConversationsAttachments tests that attachment references are
+// kept when conversations are serialized.
+func TestConversationsAttachments(t *testing.T) {
+
+	history := []APIConversation{
+		{Role: "user", Parts: []string{"What is in this image?"}, Attachments: []APIAttachment{{Path: "attachments/0123456789abcdef.png", MIMEType: "image/png"}}},
+		{Role: "model", Parts: []string{"A diagram."}},
+	}
+	b, err := json.Marshal(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "history.json")
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conversations, err := NewConversations(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(conversations.Get(0)), "`attachment`: attachments/0123456789abcdef.png (image/png)"; !strings.Contains(got, want) {
+		t.Errorf("conversation output %q does not contain %q", got, want)
+	}
+
+	b, err = conversations.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []APIConversation{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(history, got); diff != "" {
+		t.Errorf("history mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestConversationsTools tests that function call and response turns
+// are kept with their conversation when conversations are compacted
+// and serialized.
+func TestConversationsTools(t *testing.T) {
+
+	history := []APIConversation{
+		{Role: "user", Parts: []string{"What is in notes.txt?"}},
+		{Role: "model", FunctionCalls: []APIFunctionCall{{Name: "read_file", Args: map[string]any{"path": "notes.txt"}}}},
+		{Role: "user", FunctionResponses: []APIFunctionResponse{{Name: "read_file", Response: map[string]any{"content": "buy milk"}}}},
+		{Role: "model", Parts: []string{"A shopping list."}},
+		{Role: "user", Parts: []string{"Thanks"}},
+		{Role: "model", Parts: []string{"You're welcome."}},
+	}
+	b, err := json.Marshal(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "history.json")
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	conversations, err := NewConversations(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := conversations.Len(), 2; got != want {
+		t.Fatalf("got %d conversations want %d", got, want)
+	}
+	if got, want := fmt.Sprint(conversations.Get(0)), "`tool call`: read_file {\"path\":\"notes.txt\"}"; !strings.Contains(got, want) {
+		t.Errorf("conversation output %q does not contain %q", got, want)
+	}
+
+	if err := conversations.KeepItems([]int{0}); err != nil {
+		t.Fatal(err)
+	}
+	for range conversations.Iter() {
+	}
+	conversations.Compact()
+	b, err = conversations.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []APIConversation{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(history[:4], got); diff != "" {
+		t.Errorf("history mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,176 @@
+package genact
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+var (
+	// ErrBlocked is returned when the prompt or the response was
+	// blocked, normally for safety reasons.
+	ErrBlocked = errors.New("response blocked")
+
+	// ErrEmptyResponse is returned when the response has no content.
+	ErrEmptyResponse = errors.New("empty response")
+
+	// ErrMaxTokens is returned when the output token limit was reached
+	// before any text was produced, for example when thinking used all
+	// of the "maxOutputTokens" setting. A response truncated at the limit
+	// after text was produced is returned with ApiResponse.Truncated set.
+	ErrMaxTokens = errors.New("output token limit reached")
+
+	// ErrRecitation is returned when the response was stopped because
+	// it recited training data.
+	ErrRecitation = errors.New("response stopped for recitation")
+)
+
+// ResponseError describes a response which was blocked, empty or
+// stopped. Err is one of ErrBlocked, ErrEmptyResponse, ErrMaxTokens or
+// ErrRecitation, so that errors.Is may be used to distinguish them.
+type ResponseError struct {
+	Err           error
+	BlockReason   string // the reason the prompt was blocked, if it was
+	FinishReason  string // the finish reason of the response, if any
+	SafetyRatings []SafetyRating
+}
+
+// SafetyRating is the rating of a prompt or response for a category of
+// harm.
+type SafetyRating struct {
+	Category    string `json:"category"`    // such as HARM_CATEGORY_HARASSMENT
+	Probability string `json:"probability"` // NEGLIGIBLE, LOW, MEDIUM or HIGH
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+// Error reports the error with the block or finish reason and the
+// safety ratings which caused, or may have caused, a block.
+func (e *ResponseError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Err.Error())
+	switch {
+	case e.BlockReason != "":
+		fmt.Fprintf(&b, ": prompt block reason %s", e.BlockReason)
+	case e.FinishReason != "":
+		fmt.Fprintf(&b, ": finish reason %s", e.FinishReason)
+	}
+	var ratings []string
+	for _, r := range e.SafetyRatings {
+		switch {
+		case r.Blocked:
+			ratings = append(ratings, fmt.Sprintf("%s %s (blocked)", r.Category, r.Probability))
+		case r.Probability == "MEDIUM" || r.Probability == "HIGH":
+			ratings = append(ratings, fmt.Sprintf("%s %s", r.Category, r.Probability))
+		}
+	}
+	if len(ratings) > 0 {
+		fmt.Fprintf(&b, "; safety ratings: %s", strings.Join(ratings, ", "))
+	}
+	return b.String()
+}
+
+// Unwrap returns Err.
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// finishReasonError returns the error for a response with a finish
+// reason which stopped it, or which has no content. It returns nil for
+// a response with content which finished normally or at the output
+// token limit.
+func finishReasonError(finishReason string, empty bool, ratings []SafetyRating) error {
+	e := &ResponseError{FinishReason: finishReason, SafetyRatings: ratings}
+	switch {
+	case finishReason == "SAFETY":
+		e.Err = ErrBlocked
+	case finishReason == "RECITATION":
+		e.Err = ErrRecitation
+	case !empty:
+		return nil
+	case finishReason == "MAX_TOKENS":
+		e.Err = ErrMaxTokens
+	default:
+		e.Err = ErrEmptyResponse
+	}
+	return e
+}
+
+// blockReasonNames are the api names of genai.BlockReason values.
+var blockReasonNames = map[genai.BlockReason]string{
+	genai.BlockReasonUnspecified: "BLOCK_REASON_UNSPECIFIED",
+	genai.BlockReasonSafety:      "SAFETY",
+	genai.BlockReasonOther:       "OTHER",
+}
+
+// harmCategoryNames are the api names of genai.HarmCategory values.
+var harmCategoryNames = map[genai.HarmCategory]string{
+	genai.HarmCategoryUnspecified:      "HARM_CATEGORY_UNSPECIFIED",
+	genai.HarmCategoryDerogatory:       "HARM_CATEGORY_DEROGATORY",
+	genai.HarmCategoryToxicity:         "HARM_CATEGORY_TOXICITY",
+	genai.HarmCategoryViolence:         "HARM_CATEGORY_VIOLENCE",
+	genai.HarmCategorySexual:           "HARM_CATEGORY_SEXUAL",
+	genai.HarmCategoryMedical:          "HARM_CATEGORY_MEDICAL",
+	genai.HarmCategoryDangerous:        "HARM_CATEGORY_DANGEROUS",
+	genai.HarmCategoryHarassment:       "HARM_CATEGORY_HARASSMENT",
+	genai.HarmCategoryHateSpeech:       "HARM_CATEGORY_HATE_SPEECH",
+	genai.HarmCategorySexuallyExplicit: "HARM_CATEGORY_SEXUALLY_EXPLICIT",
+	genai.HarmCategoryDangerousContent: "HARM_CATEGORY_DANGEROUS_CONTENT",
+}
+
+// harmProbabilityNames are the api names of genai.HarmProbability
+// values.
+var harmProbabilityNames = map[genai.HarmProbability]string{
+	genai.HarmProbabilityUnspecified: "HARM_PROBABILITY_UNSPECIFIED",
+	genai.HarmProbabilityNegligible:  "NEGLIGIBLE",
+	genai.HarmProbabilityLow:         "LOW",
+	genai.HarmProbabilityMedium:      "MEDIUM",
+	genai.HarmProbabilityHigh:        "HIGH",
+}
+
+// apiName returns the api name of a genai enum value.
+func apiName[T comparable](names map[T]string, v T, prefix string) string {
+	if n, ok := names[v]; ok {
+		return n
+	}
+	return fmt.Sprintf("%s_%v", prefix, v)
+}
+
+// safetyRatings converts genai safety ratings.
+func safetyRatings(ratings []*genai.SafetyRating) []SafetyRating {
+	var sr []SafetyRating
+	for _, r := range ratings {
+		if r == nil {
+			continue
+		}
+		sr = append(sr, SafetyRating{
+			Category:    apiName(harmCategoryNames, r.Category, "HARM_CATEGORY"),
+			Probability: apiName(harmProbabilityNames, r.Probability, "HARM_PROBABILITY"),
+			Blocked:     r.Blocked,
+		})
+	}
+	return sr
+}
+
+// geminiError converts a genai.BlockedError to a ResponseError,
+// returning other errors unchanged.
+func geminiError(err error) error {
+	var blocked *genai.BlockedError
+	if !errors.As(err, &blocked) {
+		return err
+	}
+	if pf := blocked.PromptFeedback; pf != nil {
+		return &ResponseError{
+			Err:           ErrBlocked,
+			BlockReason:   apiName(blockReasonNames, pf.BlockReason, "BLOCK_REASON"),
+			SafetyRatings: safetyRatings(pf.SafetyRatings),
+		}
+	}
+	c := blocked.Candidate
+	rerr := finishReasonError(finishReasonName(c.FinishReason), false, safetyRatings(c.SafetyRatings))
+	if rerr == nil {
+		return err
+	}
+	return rerr
+}
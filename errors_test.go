@@ -0,0 +1,160 @@
+package genact
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestResponseErrors tests that blocked, empty and stopped responses
+// are reported as ResponseErrors matching the sentinel errors.
+func TestResponseErrors(t *testing.T) {
+
+	harassment := []SafetyRating{
+		{Category: "HARM_CATEGORY_HARASSMENT", Probability: "HIGH", Blocked: true},
+		{Category: "HARM_CATEGORY_HATE_SPEECH", Probability: "LOW"},
+	}
+	tests := []struct {
+		desc   string
+		reply  FakeReply
+		target error
+		errMsg string
+	}{
+		{
+			desc:   "prompt blocked",
+			reply:  FakeReply{BlockReason: "SAFETY", SafetyRatings: harassment},
+			target: ErrBlocked,
+			errMsg: "response blocked: prompt block reason SAFETY; safety ratings: HARM_CATEGORY_HARASSMENT HIGH (blocked)",
+		},
+		{
+			desc:   "response stopped for safety",
+			reply:  FakeReply{Text: "Well,", FinishReason: "SAFETY", SafetyRatings: harassment},
+			target: ErrBlocked,
+			errMsg: "response blocked: finish reason SAFETY; safety ratings: HARM_CATEGORY_HARASSMENT HIGH (blocked)",
+		},
+		{
+			desc:   "recitation",
+			reply:  FakeReply{Text: "It was the best of times", FinishReason: "RECITATION"},
+			target: ErrRecitation,
+			errMsg: "response stopped for recitation: finish reason RECITATION",
+		},
+		{
+			desc:   "output token limit reached while thinking",
+			reply:  FakeReply{Thoughts: "Hmm.", FinishReason: "MAX_TOKENS"},
+			target: ErrMaxTokens,
+			errMsg: "output token limit reached: finish reason MAX_TOKENS",
+		},
+		{
+			desc:   "empty",
+			reply:  FakeReply{FinishReason: "OTHER"},
+			target: ErrEmptyResponse,
+			errMsg: "empty response: finish reason OTHER",
+		},
+		{
+			desc:  "truncated response",
+			reply: FakeReply{Text: "Once upon", FinishReason: "MAX_TOKENS"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			settings := fakeSettings()
+			_, err := APIGetResponseContext(context.Background(), settings, nil, "Hi", WithBackend(NewFakeBackend(tt.reply)))
+			if tt.target == nil {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.target) {
+				t.Fatalf("got error %v want %v", err, tt.target)
+			}
+			var re *ResponseError
+			if !errors.As(err, &re) {
+				t.Fatalf("expected a ResponseError, got %T", err)
+			}
+			if got, want := re.Error(), tt.errMsg; got != want {
+				t.Errorf("got message %q want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestGeminiErrors tests the conversion of genai responses and errors
+// to ResponseErrors.
+func TestGeminiErrors(t *testing.T) {
+
+	ratings := []*genai.SafetyRating{
+		{Category: genai.HarmCategoryDangerousContent, Probability: genai.HarmProbabilityMedium},
+	}
+	want := []SafetyRating{{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Probability: "MEDIUM"}}
+
+	err := geminiError(&genai.BlockedError{PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockReasonSafety, SafetyRatings: ratings}})
+	var re *ResponseError
+	if !errors.As(err, &re) || !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected blocked ResponseError, got %v", err)
+	}
+	if got, want := re.BlockReason, "SAFETY"; got != want {
+		t.Errorf("got block reason %s want %s", got, want)
+	}
+	if diff := cmp.Diff(want, re.SafetyRatings); diff != "" {
+		t.Errorf("safety ratings mismatch (-want +got):\n%s", diff)
+	}
+
+	err = geminiError(&genai.BlockedError{Candidate: &genai.Candidate{FinishReason: genai.FinishReasonRecitation}})
+	if !errors.Is(err, ErrRecitation) {
+		t.Errorf("expected ErrRecitation, got %v", err)
+	}
+	other := errors.New("network down")
+	if got := geminiError(other); got != other {
+		t.Errorf("got %v want unchanged error", got)
+	}
+
+	err = checkResponse(&genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{FinishReason: genai.FinishReasonMaxTokens}},
+	}, &wireRecord{})
+	if !errors.Is(err, ErrMaxTokens) {
+		t.Errorf("expected ErrMaxTokens, got %v", err)
+	}
+	if err := checkResponse(&genai.GenerateContentResponse{}, &wireRecord{}); !errors.Is(err, ErrEmptyResponse) {
+		t.Errorf("expected ErrEmptyResponse, got %v", err)
+	}
+}
+
+// TestCheckResponseCandidates tests that a response with several
+// candidates only fails if every candidate was stopped, including those
+// whose finish reasons were hidden from the genai package.
+func TestCheckResponseCandidates(t *testing.T) {
+
+	content := func(text string) *genai.Content {
+		return &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(text)}}
+	}
+	record := &wireRecord{stopped: map[int]string{0: "SAFETY", 2: "RECITATION"}}
+	resp := &genai.GenerateContentResponse{Candidates: []*genai.Candidate{
+		{Index: 0, Content: content("Blocked"), FinishReason: genai.FinishReasonOther},
+		{Index: 1, Content: content("Usable"), FinishReason: genai.FinishReasonStop},
+		{Index: 2, Content: content("Recited"), FinishReason: genai.FinishReasonOther},
+	}}
+	if err := checkResponse(resp, record); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	br, err := geminiResponse(resp, record, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := partsText(br.Content), "Usable"; got != want {
+		t.Errorf("response got %q want %q", got, want)
+	}
+	if got, want := len(br.Candidates), 1; got != want {
+		t.Errorf("got %d candidates want %d", got, want)
+	}
+
+	resp.Candidates = slices.Delete(resp.Candidates, 1, 2)
+	if err := checkResponse(resp, record); !errors.Is(err, ErrBlocked) {
+		t.Errorf("expected ErrBlocked, got %v", err)
+	}
+}
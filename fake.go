@@ -0,0 +1,216 @@
+package genact
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// fakeContextLimit is the context limit reported by a FakeBackend by
+// default.
+const fakeContextLimit = 1048576
+
+// FakeReply is a scripted reply of a FakeBackend.
+type FakeReply struct {
+	Text          string
+	Chunks        []string // the streamed chunks of Text, by default split after spaces
+	Thoughts      string
+	FunctionCalls []genai.FunctionCall
+	FinishReason  string // "STOP" if not provided
+	Usage         *Usage // estimated from the request and reply if nil
+
+	// Candidates are the texts of further candidate responses, returned
+	// as if several candidates had been requested.
+	Candidates []string
+
+	// BlockReason, if provided, is reported as the reason the prompt
+	// was blocked, in place of a response, with the SafetyRatings. A
+	// FinishReason of SAFETY or RECITATION also stops the response.
+	BlockReason   string
+	SafetyRatings []SafetyRating
+
+	// Err, if not nil, is returned in place of a response. When
+	// streaming it is returned after any Chunks, as for a broken stream.
+	Err error
+}
+
+// FakeBackend is a deterministic Backend replying to each request with
+// the next of its scripted replies, for testing and demonstrating
+// programmes using the genact module without network access or an api
+// key. Once the replies are used up, or if none are provided, it echoes
+// the prompt. Provide it to a request with WithBackend, or set the
+// "backend" setting to "fake" for an echoing backend.
+type FakeBackend struct {
+	ModelVersion string // the model version reported, by default the requested model
+	ContextLimit int32  // the context limit reported, by default 1048576
+
+	mu       sync.Mutex
+	replies  []FakeReply
+	requests []BackendRequest
+}
+
+// NewFakeBackend returns a FakeBackend with scripted replies.
+func NewFakeBackend(replies ...FakeReply) *FakeBackend {
+	return &FakeBackend{replies: replies}
+}
+
+// Requests returns the requests received, excluding those to count
+// tokens.
+func (f *FakeBackend) Requests() []BackendRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.requests)
+}
+
+// Remaining returns the number of scripted replies not yet used.
+func (f *FakeBackend) Remaining() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.replies)
+}
+
+// next records a request and returns the reply to it.
+func (f *FakeBackend) next(req *BackendRequest) FakeReply {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := *req
+	r.Contents = slices.Clone(req.Contents)
+	f.requests = append(f.requests, r)
+	if len(f.replies) == 0 {
+		return FakeReply{Text: "echo: " + contentText(req.Contents[len(req.Contents)-1])}
+	}
+	reply := f.replies[0]
+	f.replies = f.replies[1:]
+	return reply
+}
+
+// Send implements Backend.
+func (f *FakeBackend) Send(ctx context.Context, req *BackendRequest) (*BackendResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	reply := f.next(req)
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	return f.response(req, reply)
+}
+
+// Stream implements Backend.
+func (f *FakeBackend) Stream(ctx context.Context, req *BackendRequest, chunkFunc func(string) error) (*BackendResponse, error) {
+	if chunkFunc == nil {
+		return nil, errors.New("stream chunk function not provided")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	reply := f.next(req)
+	chunks := reply.Chunks
+	if chunks == nil && reply.Text != "" {
+		chunks = strings.SplitAfter(reply.Text, " ")
+	}
+	if reply.BlockReason == "" {
+		for _, c := range chunks {
+			if err := chunkFunc(c); err != nil {
+				return nil, fmt.Errorf("stream chunk error: %w", err)
+			}
+		}
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	return f.response(req, reply)
+}
+
+// response makes the response for a reply.
+func (f *FakeBackend) response(req *BackendRequest, reply FakeReply) (*BackendResponse, error) {
+	if reply.BlockReason != "" {
+		return nil, &ResponseError{Err: ErrBlocked, BlockReason: reply.BlockReason, SafetyRatings: reply.SafetyRatings}
+	}
+	content := &genai.Content{Role: "model"}
+	if reply.Text != "" {
+		content.Parts = append(content.Parts, genai.Text(reply.Text))
+	}
+	for _, fc := range reply.FunctionCalls {
+		content.Parts = append(content.Parts, fc)
+	}
+	finishReason := cmp.Or(reply.FinishReason, "STOP")
+	if err := finishReasonError(finishReason, len(content.Parts) == 0, reply.SafetyRatings); err != nil {
+		return nil, err
+	}
+	br := &BackendResponse{
+		Content:      content,
+		FinishReason: finishReason,
+		Thoughts:     reply.Thoughts,
+		ModelVersion: cmp.Or(f.ModelVersion, req.Model),
+	}
+	if len(reply.Candidates) > 0 {
+		br.Candidates = []BackendCandidate{{Content: content, FinishReason: finishReason, Thoughts: reply.Thoughts}}
+		for _, text := range reply.Candidates {
+			br.Candidates = append(br.Candidates, BackendCandidate{
+				Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(text)}},
+				FinishReason: "STOP",
+			})
+		}
+	}
+	if reply.Usage != nil {
+		br.Usage = *reply.Usage
+		return br, nil
+	}
+	br.Usage = Usage{
+		PromptTokens:     fakeTokens(req.SystemInstruction) + fakeTokens(contentsText(req.Contents)),
+		CandidatesTokens: fakeTokens(reply.Text) + fakeTokens(strings.Join(reply.Candidates, " ")),
+		ThoughtsTokens:   fakeTokens(reply.Thoughts),
+	}
+	br.Usage.TotalTokens = br.Usage.PromptTokens + br.Usage.CandidatesTokens + br.Usage.ThoughtsTokens
+	return br, nil
+}
+
+// CountTokens implements Backend, estimating the tokens of a request
+// from the size of its text.
+func (f *FakeBackend) CountTokens(ctx context.Context, req *BackendRequest) (TokenCount, error) {
+	if err := ctx.Err(); err != nil {
+		return TokenCount{}, err
+	}
+	return TokenCount{
+		Tokens:       fakeTokens(req.SystemInstruction) + fakeTokens(contentsText(req.Contents)),
+		ContextLimit: cmp.Or(f.ContextLimit, fakeContextLimit),
+	}, nil
+}
+
+// Close implements Backend.
+func (f *FakeBackend) Close() error {
+	return nil
+}
+
+// fakeTokens estimates the tokens of text as one per word.
+func fakeTokens(text string) int32 {
+	return int32(len(strings.Fields(text)))
+}
+
+// contentText returns the text parts of a content, separated by
+// newlines.
+func contentText(c *genai.Content) string {
+	var texts []string
+	for _, p := range c.Parts {
+		if t, ok := p.(genai.Text); ok {
+			texts = append(texts, string(t))
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// contentsText returns the text of contents, separated by newlines.
+func contentsText(contents []*genai.Content) string {
+	texts := make([]string, len(contents))
+	for i, c := range contents {
+		texts[i] = contentText(c)
+	}
+	return strings.Join(texts, "\n")
+}
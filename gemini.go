@@ -0,0 +1,401 @@
+package genact
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// geminiBackend is the Backend for the Gemini api, using the genai
+// package. In addition to sending requests it uploads large attachments
+// with the File API and, if the "cache" setting is true, caches the
+// system instruction and history.
+type geminiBackend struct {
+	settings *Settings
+	client   *genai.Client
+	record   *wireRecord
+	uploader *uploader
+	cache    *CacheInfo  // the latest cache, initially that of a previous request
+	tokens   *TokenCount // the latest token count, if any
+	logger   *slog.Logger
+}
+
+// newGeminiBackend returns a Gemini backend sending requests with the
+// base http transport, recording uploads in uploads, reusing the cache
+// of a previous request, prev, if possible and logging to logger.
+func newGeminiBackend(ctx context.Context, settings *Settings, base http.RoundTripper, uploads Uploads, prev *CacheInfo, logger *slog.Logger) (*geminiBackend, error) {
+	client, record, err := newClient(ctx, settings, base)
+	if err != nil {
+		return nil, err
+	}
+	if uploads == nil {
+		uploads = Uploads{}
+	}
+	httpClient, _ := newHTTPClient(settings, base)
+	return &geminiBackend{
+		settings: settings,
+		client:   client,
+		record:   record,
+		uploader: newUploader(client, httpClient, settings, uploads, logger),
+		cache:    prev,
+		logger:   logger,
+	}, nil
+}
+
+// newClient starts a genai client using the base http transport. The
+// returned wireRecord records response data, such as thoughts, which is
+// not exposed by the genai package.
+func newClient(ctx context.Context, settings *Settings, base http.RoundTripper) (*genai.Client, *wireRecord, error) {
+	httpClient, record := newHTTPClient(settings, base)
+	opts := []option.ClientOption{
+		option.WithAPIKey(settings.APIKey),
+		option.WithHTTPClient(httpClient),
+	}
+	if settings.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(settings.Endpoint))
+	}
+	client, err := genai.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create client: %v", err)
+	}
+	return client, record, nil
+}
+
+// Close closes the genai client.
+func (b *geminiBackend) Close() error {
+	return b.client.Close()
+}
+
+// configure sets the generation settings, tools and JSON output
+// configuration of a request on a model.
+func (b *geminiBackend) configure(model *genai.GenerativeModel, req *BackendRequest) {
+	model.GenerationConfig = b.settings.GenerationConfig()
+	model.Tools = req.Tools
+	if req.JSONOutput {
+		model.GenerationConfig.ResponseMIMEType = "application/json"
+		model.GenerationConfig.ResponseSchema = req.Schema
+	}
+}
+
+// model returns a model for a request. The system instruction, if any,
+// is set on the model rather than being added to the chat history.
+func (b *geminiBackend) model(req *BackendRequest) *genai.GenerativeModel {
+	model := b.client.GenerativeModel(req.Model)
+	b.configure(model, req)
+	if req.SystemInstruction != "" {
+		model.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(req.SystemInstruction)}}
+	}
+	return model
+}
+
+// prepare returns the model, history and prompt parts with which to
+// send a request, together with the cache used, if any. Large
+// attachments are replaced by uploaded files. If caching is enabled the
+// system instruction and history are cached and only the history
+// following the cached contents is returned.
+func (b *geminiBackend) prepare(ctx context.Context, req *BackendRequest) (*genai.GenerativeModel, []*genai.Content, []genai.Part, *CacheInfo, error) {
+	contents, err := b.uploader.replaceBlobs(ctx, req.Contents)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	history, prompt := contents[:len(contents)-1], contents[len(contents)-1].Parts
+
+	// the tokens of the request are estimated without a pre-flight count
+	tokens := estimateTokens(req)
+	if b.tokens != nil {
+		tokens = b.tokens.Tokens
+	}
+	switch {
+	case !b.settings.Cache:
+	case len(req.Tools) > 0:
+		b.logger.Info("not caching, tools are enabled")
+	case tokens < b.settings.CacheMinTokens:
+		b.logger.Info("not caching, below cacheMinTokens", "tokens", tokens, "cacheMinTokens", b.settings.CacheMinTokens)
+	default:
+		info, err := cacheContents(ctx, b.client, b.settings, req.Model, req.SystemInstruction, history, b.cache, b.logger)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, nil, nil, err
+			}
+			b.logger.Warn("not using cache", "error", err)
+			break
+		}
+		b.cache = info
+		model := b.client.GenerativeModelFromCachedContent(&genai.CachedContent{
+			Name:  info.Name,
+			Model: modelResourceName(info.Model),
+		})
+		b.configure(model, req)
+		return model, history[info.Contents:], prompt, info, nil
+	}
+	return b.model(req), history, prompt, nil, nil
+}
+
+// Send implements Backend.
+func (b *geminiBackend) Send(ctx context.Context, req *BackendRequest) (*BackendResponse, error) {
+	return b.send(ctx, req, nil)
+}
+
+// Stream implements Backend.
+func (b *geminiBackend) Stream(ctx context.Context, req *BackendRequest, chunkFunc func(string) error) (*BackendResponse, error) {
+	if chunkFunc == nil {
+		return nil, errors.New("stream chunk function not provided")
+	}
+	return b.send(ctx, req, chunkFunc)
+}
+
+// send sends a request, streaming the response if chunkFunc is not nil.
+func (b *geminiBackend) send(ctx context.Context, req *BackendRequest, chunkFunc func(string) error) (*BackendResponse, error) {
+	model, history, prompt, cache, err := b.prepare(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	chat := model.StartChat()
+	var resp *genai.GenerateContentResponse
+	if chunkFunc == nil {
+		resp, err = runAPI(ctx, chat, history, prompt, b.record, b.logger)
+	} else {
+		resp, err = runAPIStream(ctx, chat, history, prompt, chunkFunc, b.record, b.logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+	br, err := geminiResponse(resp, b.record, b.logger)
+	if err != nil {
+		return nil, err
+	}
+	br.Cache = cache
+	return br, nil
+}
+
+// runAPI runs the api given a *genai.ChatSession, history (if any) and
+// the prompt parts. The response is checked with the finish reasons in
+// record.
+func runAPI(ctx context.Context, chat *genai.ChatSession, history []*genai.Content, prompt []genai.Part, record *wireRecord, logger *slog.Logger) (*genai.GenerateContentResponse, error) {
+
+	chat.History = history
+
+	logger.Debug("sending prompt", "backend", BackendGemini)
+	resp, err := chat.SendMessage(ctx, prompt...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send message: %w", geminiError(err))
+	}
+	if err := checkResponse(resp, record); err != nil {
+		return nil, err
+	}
+	logger.Debug("response ok", "backend", BackendGemini)
+
+	return resp, nil
+}
+
+// runAPIStream is the streaming equivalent of runAPI. Each text chunk
+// is passed to chunkFunc as it arrives. The merged response returned
+// is equivalent to that from runAPI, and the chat history is updated
+// in the same way.
+func runAPIStream(ctx context.Context, chat *genai.ChatSession, history []*genai.Content, prompt []genai.Part, chunkFunc func(string) error, record *wireRecord, logger *slog.Logger) (*genai.GenerateContentResponse, error) {
+
+	chat.History = history
+
+	logger.Debug("streaming prompt", "backend", BackendGemini)
+	iter := chat.SendMessageStream(ctx, prompt...)
+	for {
+		resp, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stream message: %w", geminiError(err))
+		}
+		c := firstCandidate(resp)
+		if c == nil || c.Content == nil {
+			continue
+		}
+		for _, part := range c.Content.Parts {
+			txt, ok := part.(genai.Text)
+			if !ok || txt == "" {
+				continue
+			}
+			if err := chunkFunc(string(txt)); err != nil {
+				return nil, fmt.Errorf("stream chunk error: %w", err)
+			}
+		}
+	}
+	resp := iter.MergedResponse()
+	if resp == nil {
+		return nil, &ResponseError{Err: ErrEmptyResponse}
+	}
+	if err := checkResponse(resp, record); err != nil {
+		return nil, err
+	}
+	logger.Debug("response ok", "backend", BackendGemini)
+
+	return resp, nil
+}
+
+// checkResponse checks a response for a block reason or empty content,
+// returning a ResponseError if found. A response with several
+// candidates fails only if every candidate was stopped or is empty, the
+// error being that of the first. The finish reasons of the candidates
+// are taken from record.
+func checkResponse(resp *genai.GenerateContentResponse, record *wireRecord) error {
+	if pf := resp.PromptFeedback; pf != nil && pf.BlockReason > 0 {
+		return &ResponseError{
+			Err:           ErrBlocked,
+			BlockReason:   apiName(blockReasonNames, pf.BlockReason, "BLOCK_REASON"),
+			SafetyRatings: safetyRatings(pf.SafetyRatings),
+		}
+	}
+	c := firstCandidate(resp)
+	if c == nil {
+		return &ResponseError{Err: ErrEmptyResponse}
+	}
+	err := candidateError(c, record)
+	if err == nil || len(resp.Candidates) < 2 {
+		return err
+	}
+	for _, c := range resp.Candidates {
+		if candidateError(c, record) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// candidateError returns the error for a candidate which was stopped or
+// is empty, if any.
+func candidateError(c *genai.Candidate, record *wireRecord) error {
+	empty := c.Content == nil || len(c.Content.Parts) == 0
+	reason := record.FinishReason(int(c.Index), finishReasonName(c.FinishReason))
+	return finishReasonError(reason, empty, safetyRatings(c.SafetyRatings))
+}
+
+// firstCandidate returns the candidate with index 0 of a response, or
+// nil if there is none.
+func firstCandidate(resp *genai.GenerateContentResponse) *genai.Candidate {
+	for _, c := range resp.Candidates {
+		if c.Index == 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// geminiResponse makes a BackendResponse from a genai response, the
+// response content being that of the first candidate. Thoughts, which
+// have been removed from the response by the geminiTransport, are taken
+// from the wireRecord, as are the usage metadata and model version if
+// available. When several candidates were returned, those which were
+// not stopped or empty are recorded as the response Candidates, the
+// first of them being the response content, others being logged to
+// logger.
+func geminiResponse(resp *genai.GenerateContentResponse, record *wireRecord, logger *slog.Logger) (*BackendResponse, error) {
+	first := firstCandidate(resp)
+	var usable []*genai.Candidate
+	if len(resp.Candidates) > 1 {
+		candidates := slices.Clone(resp.Candidates)
+		slices.SortFunc(candidates, func(a, b *genai.Candidate) int { return cmp.Compare(a.Index, b.Index) })
+		for _, c := range candidates {
+			if err := candidateError(c, record); err != nil {
+				logger.Warn("candidate omitted", "candidate", c.Index+1, "error", err)
+				continue
+			}
+			usable = append(usable, c)
+		}
+		if len(usable) > 0 {
+			first = usable[0]
+		}
+	}
+	if first == nil || first.Content == nil {
+		return nil, &ResponseError{Err: ErrEmptyResponse}
+	}
+	candidate := func(c *genai.Candidate) BackendCandidate {
+		if c.Content.Role == "" {
+			c.Content.Role = "model"
+		}
+		return BackendCandidate{
+			Content:      c.Content,
+			FinishReason: record.FinishReason(int(c.Index), finishReasonName(c.FinishReason)),
+			Thoughts:     record.CandidateThoughts(int(c.Index)),
+		}
+	}
+	fc := candidate(first)
+	br := &BackendResponse{
+		Content:      fc.Content,
+		FinishReason: fc.FinishReason,
+		Usage:        usageFromMetadata(resp.UsageMetadata),
+		Thoughts:     fc.Thoughts,
+		ModelVersion: record.ModelVersion(),
+	}
+	if usage := record.Usage(); usage != nil {
+		br.Usage = *usage
+	}
+	for _, c := range usable {
+		br.Candidates = append(br.Candidates, candidate(c))
+	}
+	return br, nil
+}
+
+// CountTokens implements Backend, counting the tokens of the request
+// contents including the system instruction and tools. The context
+// limit is taken from the model information provided by the api unless
+// the "contextLimit" setting is provided.
+//
+// The genai CountTokens method counts the parts of a single turn, so the
+// history is counted as part of the prompt turn. The count is therefore
+// a close approximation of that of the chat request.
+func (b *geminiBackend) CountTokens(ctx context.Context, req *BackendRequest) (TokenCount, error) {
+	tc := TokenCount{ContextLimit: b.settings.ContextLimit}
+	contents, err := b.uploader.replaceBlobs(ctx, req.Contents)
+	if err != nil {
+		return tc, err
+	}
+	model := b.model(req)
+	if tc.ContextLimit == 0 {
+		info, err := model.Info(ctx)
+		if err != nil {
+			return tc, fmt.Errorf("could not get model information: %w", err)
+		}
+		tc.ContextLimit = info.InputTokenLimit
+	}
+
+	parts := []genai.Part{}
+	for _, c := range contents {
+		parts = append(parts, countableParts(c.Parts)...)
+	}
+	resp, err := model.CountTokens(ctx, parts...)
+	if err != nil {
+		return tc, fmt.Errorf("could not count tokens: %w", err)
+	}
+	tc.Tokens = resp.TotalTokens
+	b.tokens = &tc
+	return tc, nil
+}
+
+// countableParts returns parts for counting as a single user turn, in
+// which function calls and responses, which are only valid in model and
+// function response turns, are replaced by their json as text.
+func countableParts(parts []genai.Part) []genai.Part {
+	countable := make([]genai.Part, 0, len(parts))
+	for _, p := range parts {
+		switch p.(type) {
+		case genai.FunctionCall, genai.FunctionResponse:
+			b, err := json.Marshal(p)
+			if err != nil {
+				continue
+			}
+			countable = append(countable, genai.Text(b))
+		default:
+			countable = append(countable, p)
+		}
+	}
+	return countable
+}
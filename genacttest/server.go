@@ -0,0 +1,290 @@
+// Package genacttest provides a local stand-in for the Gemini api for
+// testing programmes using the genact module without network access or
+// an api key. Set the genact "endpoint" setting to the URL of a Server
+// to use it.
+//
+// The stand-in supports the File API upload, file and model information
+// requests, token counting and content generation, including streamed
+// generation. Generated responses simply report the parts received.
+package genacttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InputTokenLimit is the input token limit reported for every model.
+const InputTokenLimit = 1048576
+
+// file is a file uploaded to the stand-in File API.
+type file struct {
+	Name           string    `json:"name"`
+	DisplayName    string    `json:"displayName,omitempty"`
+	MIMEType       string    `json:"mimeType"`
+	SizeBytes      string    `json:"sizeBytes"`
+	CreateTime     time.Time `json:"createTime"`
+	UpdateTime     time.Time `json:"updateTime"`
+	ExpirationTime time.Time `json:"expirationTime"`
+	URI            string    `json:"uri"`
+	State          string    `json:"state"`
+	data           []byte
+}
+
+// pendingUpload is a resumable upload which has been started.
+type pendingUpload struct {
+	displayName string
+	mimeType    string
+}
+
+// Server is a local stand-in for the Gemini api.
+type Server struct {
+	*httptest.Server
+
+	// FileTTL is the lifetime of uploaded files, 48 hours by default.
+	FileTTL time.Duration
+
+	mu       sync.Mutex
+	files    map[string]*file
+	pending  map[string]pendingUpload
+	uploads  int
+	requests [][]byte
+	nextID   int
+}
+
+// NewServer starts a stand-in Server. The caller should call Close when
+// finished.
+func NewServer() *Server {
+	s := &Server{
+		FileTTL: 48 * time.Hour,
+		files:   map[string]*file{},
+		pending: map[string]pendingUpload{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /upload/v1beta/files", s.handleUpload)
+	mux.HandleFunc("GET /v1beta/files/{id}", s.handleGetFile)
+	mux.HandleFunc("GET /v1beta/models/{model}", s.handleGetModel)
+	mux.HandleFunc("POST /v1beta/models/{action}", s.handleModelAction)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Uploads returns the number of files uploaded.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads
+}
+
+// ExpireFiles expires all uploaded files, which are then no longer
+// available.
+func (s *Server) ExpireFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = map[string]*file{}
+}
+
+// Requests returns the bodies of the generation requests received.
+func (s *Server) Requests() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte{}, s.requests...)
+}
+
+// writeJSON writes v as a json response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an api error response.
+func writeError(w http.ResponseWriter, code int, status, format string, a ...any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": code, "message": fmt.Sprintf(format, a...), "status": status},
+	})
+}
+
+// handleUpload handles the start and the upload and finalize requests
+// of the resumable upload protocol.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Header.Get("X-Goog-Upload-Command") {
+	case "start":
+		var meta struct {
+			File struct {
+				DisplayName string `json:"displayName"`
+			} `json:"file"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&meta)
+		s.nextID++
+		id := fmt.Sprintf("upload-%d", s.nextID)
+		s.pending[id] = pendingUpload{
+			displayName: meta.File.DisplayName,
+			mimeType:    r.Header.Get("X-Goog-Upload-Header-Content-Type"),
+		}
+		w.Header().Set("X-Goog-Upload-URL", s.URL+"/upload/v1beta/files?upload_id="+id)
+		w.WriteHeader(http.StatusOK)
+
+	case "upload, finalize":
+		id := r.URL.Query().Get("upload_id")
+		p, ok := s.pending[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown upload %s", id)
+			return
+		}
+		delete(s.pending, id)
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "could not read upload: %v", err)
+			return
+		}
+		s.nextID++
+		now := time.Now().UTC()
+		name := fmt.Sprintf("files/file-%d", s.nextID)
+		f := &file{
+			Name:           name,
+			DisplayName:    p.displayName,
+			MIMEType:       p.mimeType,
+			SizeBytes:      fmt.Sprint(len(data)),
+			CreateTime:     now,
+			UpdateTime:     now,
+			ExpirationTime: now.Add(s.FileTTL),
+			URI:            s.URL + "/v1beta/" + name,
+			State:          "ACTIVE",
+			data:           data,
+		}
+		s.files[name] = f
+		s.uploads++
+		writeJSON(w, map[string]any{"file": f})
+
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "unsupported upload command %q", r.Header.Get("X-Goog-Upload-Command"))
+	}
+}
+
+// handleGetFile handles file information requests.
+func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files["files/"+r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "file %s not found", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, f)
+}
+
+// handleGetModel handles model information requests.
+func (s *Server) handleGetModel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"name":             "models/" + r.PathValue("model"),
+		"inputTokenLimit":  InputTokenLimit,
+		"outputTokenLimit": 65536,
+	})
+}
+
+// request is the part of a generation or token count request used by
+// the stand-in.
+type request struct {
+	Contents []struct {
+		Role  string `json:"role"`
+		Parts []struct {
+			Text       string `json:"text"`
+			InlineData *struct {
+				MIMEType string `json:"mimeType"`
+				Data     []byte `json:"data"`
+			} `json:"inlineData"`
+			FileData *struct {
+				MIMEType string `json:"mimeType"`
+				FileURI  string `json:"fileUri"`
+			} `json:"fileData"`
+		} `json:"parts"`
+	} `json:"contents"`
+	GenerateContentRequest *request `json:"generateContentRequest"`
+}
+
+// handleModelAction handles generateContent, streamGenerateContent and
+// countTokens requests.
+func (s *Server) handleModelAction(w http.ResponseWriter, r *http.Request) {
+	model, action, _ := strings.Cut(r.PathValue("action"), ":")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "could not read request: %v", err)
+		return
+	}
+	var req request
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "could not decode request: %v", err)
+		return
+	}
+	if req.GenerateContentRequest != nil {
+		req = *req.GenerateContentRequest
+	}
+
+	// count the request size and check file references
+	s.mu.Lock()
+	size, texts, inline, files := 0, 0, 0, 0
+	for _, c := range req.Contents {
+		for _, p := range c.Parts {
+			switch {
+			case p.InlineData != nil:
+				size += len(p.InlineData.Data)
+				inline++
+			case p.FileData != nil:
+				name := strings.TrimPrefix(p.FileData.FileURI, s.URL+"/v1beta/")
+				f, ok := s.files[name]
+				if !ok || time.Now().After(f.ExpirationTime) {
+					s.mu.Unlock()
+					writeError(w, http.StatusForbidden, "PERMISSION_DENIED", "file %s does not exist or has expired", p.FileData.FileURI)
+					return
+				}
+				size += len(f.data)
+				files++
+			default:
+				size += len(p.Text)
+				texts++
+			}
+		}
+	}
+	if action != "countTokens" {
+		s.requests = append(s.requests, body)
+	}
+	s.mu.Unlock()
+	tokens := max(1, size/4)
+
+	switch action {
+	case "countTokens":
+		writeJSON(w, map[string]any{"totalTokens": tokens})
+	case "generateContent", "streamGenerateContent":
+		reply := fmt.Sprintf("Received %d text, %d inline and %d file parts.", texts, inline, files)
+		resp := map[string]any{
+			"candidates": []any{map[string]any{
+				"content":      map[string]any{"role": "model", "parts": []any{map[string]any{"text": reply}}},
+				"finishReason": "STOP",
+				"index":        0,
+			}},
+			"usageMetadata": map[string]any{
+				"promptTokenCount":     tokens,
+				"candidatesTokenCount": 10,
+				"totalTokenCount":      tokens + 10,
+			},
+			"modelVersion": model,
+		}
+		if action == "streamGenerateContent" {
+			writeJSON(w, []any{resp}) // a stream of one response
+			return
+		}
+		writeJSON(w, resp)
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unsupported action %q", action)
+	}
+}
@@ -5,15 +5,49 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/google/generative-ai-go/genai"
 )
 
 // APIConversation represents each conversation "turn" in an API history
 // file. This struct is used for both reading and writing history files.
+// Attachments, such as images, are saved alongside the history file and
+// referenced by path. Function calls made by the model and the function
+// responses sent back are recorded in their own turns.
 type APIConversation struct {
-	Role  string   `json:"Role"`
-	Parts []string `json:"Parts,omitempty"`
+	Role              string                `json:"Role"`
+	Parts             []string              `json:"Parts,omitempty"`
+	Attachments       []APIAttachment       `json:"Attachments,omitempty"`
+	FunctionCalls     []APIFunctionCall     `json:"FunctionCalls,omitempty"`
+	FunctionResponses []APIFunctionResponse `json:"FunctionResponses,omitempty"`
+}
+
+// IsTool reports whether the turn is a function call or function
+// response turn.
+func (ac APIConversation) IsTool() bool {
+	return len(ac.FunctionCalls) > 0 || len(ac.FunctionResponses) > 0
+}
+
+// APIAttachment is a reference to an attachment in an API history file.
+// The path is relative to the directory of the history file.
+type APIAttachment struct {
+	Path     string `json:"Path"`
+	MIMEType string `json:"MIMEType"`
+}
+
+// APIFunctionCall is a function call made by the model in an API
+// history file.
+type APIFunctionCall struct {
+	Name string         `json:"Name"`
+	Args map[string]any `json:"Args,omitempty"`
+}
+
+// APIFunctionResponse is the response to a function call in an API
+// history file.
+type APIFunctionResponse struct {
+	Name     string         `json:"Name"`
+	Response map[string]any `json:"Response"`
 }
 
 // ReadAPIHistory reads json history from an API history file, returning
@@ -31,8 +65,8 @@ func ReadAPIHistory(filePath string) ([]APIConversation, error) {
 }
 
 // aiAPIToAIContent converts a slice of APIConversation to a slice of
-// genai.Content.
-func apiToAIContent(jc []APIConversation) ([]*genai.Content, error) {
+// genai.Content. Attachments are read relative to dir.
+func apiToAIContent(jc []APIConversation, dir string) ([]*genai.Content, error) {
 	contents := []*genai.Content{}
 	for _, thisContent := range jc {
 		c := genai.Content{}
@@ -43,6 +77,19 @@ func apiToAIContent(jc []APIConversation) ([]*genai.Content, error) {
 			}
 			c.Parts = append(c.Parts, genai.Text(p)) // convert to a Text part type
 		}
+		for _, a := range thisContent.Attachments {
+			b, err := readAttachment(dir, a)
+			if err != nil {
+				return nil, err
+			}
+			c.Parts = append(c.Parts, b)
+		}
+		for _, fc := range thisContent.FunctionCalls {
+			c.Parts = append(c.Parts, genai.FunctionCall{Name: fc.Name, Args: fc.Args})
+		}
+		for _, fr := range thisContent.FunctionResponses {
+			c.Parts = append(c.Parts, genai.FunctionResponse{Name: fr.Name, Response: fr.Response})
+		}
 		if len(c.Parts) == 0 {
 			continue
 		}
@@ -61,5 +108,36 @@ func HistoryAPIToAIContent(filePath string) ([]*genai.Content, error) {
 	if err != nil {
 		return nil, err
 	}
-	return apiToAIContent(aiAPIExport)
+	return apiToAIContent(aiAPIExport, filepath.Dir(filePath))
+}
+
+// aiContentToAPI converts a slice of genai.Content to a slice of
+// APIConversation for writing to a history file. Blob parts are
+// replaced by references to attachments, which should be saved with
+// SaveAttachments alongside the history file. Within a turn, text parts
+// are recorded before attachments and function calls.
+func aiContentToAPI(contents []*genai.Content) ([]APIConversation, error) {
+	jc := []APIConversation{}
+	for _, c := range contents {
+		conv := APIConversation{Role: c.Role}
+		for _, p := range c.Parts {
+			switch part := p.(type) {
+			case genai.Text:
+				conv.Parts = append(conv.Parts, string(part))
+			case genai.Blob:
+				conv.Attachments = append(conv.Attachments, APIAttachment{
+					Path:     attachmentPath(part),
+					MIMEType: part.MIMEType,
+				})
+			case genai.FunctionCall:
+				conv.FunctionCalls = append(conv.FunctionCalls, APIFunctionCall{Name: part.Name, Args: part.Args})
+			case genai.FunctionResponse:
+				conv.FunctionResponses = append(conv.FunctionResponses, APIFunctionResponse{Name: part.Name, Response: part.Response})
+			default:
+				return nil, fmt.Errorf("unsupported history part type %T", p)
+			}
+		}
+		jc = append(jc, conv)
+	}
+	return jc, nil
 }
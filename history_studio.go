@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/google/generative-ai-go/genai"
 )
@@ -19,10 +20,36 @@ type AIStudioChunk struct {
 	// ignore other fields.
 }
 
+// AIStudioSystemInstruction represents the system instruction of a
+// Google AI Studio export file, which may be provided either as text
+// or as a slice of text parts.
+type AIStudioSystemInstruction struct {
+	Text  string `json:"text"`
+	Parts []struct {
+		Text string `json:"text"`
+	} `json:"parts"`
+}
+
+// String returns the text of the system instruction.
+func (si AIStudioSystemInstruction) String() string {
+	texts := []string{}
+	if si.Text != "" {
+		texts = append(texts, si.Text)
+	}
+	for _, p := range si.Parts {
+		if p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
+
 // AIStudioExport represents the top-level structure of the JSON file
-// exported from Google AI Studio containing a slice of AIStudioChunk.
+// exported from Google AI Studio containing a slice of AIStudioChunk
+// and the system instruction, if any.
 type AIStudioExport struct {
-	ChunkedPrompt struct {
+	SystemInstruction AIStudioSystemInstruction `json:"systemInstruction"`
+	ChunkedPrompt     struct {
 		Chunks []AIStudioChunk `json:"chunks"`
 	} `json:"chunkedPrompt"`
 	// ignore other settings etc.
@@ -45,18 +72,28 @@ func readStudioHistory(filePath string) (*AIStudioExport, error) {
 }
 
 // aiStudioToAIContent converts a slice of AIStudioChunk to a slice of
-// genai.Content.
-func aiStudioToAIContent(studioChunks []AIStudioChunk) ([]*genai.Content, error) {
+// genai.Content. Thought chunks are dropped unless keepThoughts is set,
+// in which case they are added as the leading parts of the following
+// model content.
+func aiStudioToAIContent(studioChunks []AIStudioChunk, keepThoughts bool) ([]*genai.Content, error) {
 	contents := []*genai.Content{}
+	thoughts := []genai.Part{}
 	for _, thisContent := range studioChunks {
 		if thisContent.Text == "" {
 			continue
 		}
-		if thisContent.IsThought { // don't load thoughts
+		if thisContent.IsThought { // only load thoughts if wanted
+			if keepThoughts {
+				thoughts = append(thoughts, genai.Text(thisContent.Text))
+			}
 			continue
 		}
 		c := genai.Content{}
 		c.Role = thisContent.Role
+		if c.Role == "model" {
+			c.Parts = append(c.Parts, thoughts...)
+			thoughts = []genai.Part{}
+		}
 		c.Parts = append(c.Parts, genai.Text(thisContent.Text)) // convert to a Text part type
 		contents = append(contents, &c)
 	}
@@ -73,5 +110,27 @@ func HistoryStudioToAIContent(filePath string) ([]*genai.Content, error) {
 	if err != nil {
 		return nil, err
 	}
-	return aiStudioToAIContent(aiStudioExport.ChunkedPrompt.Chunks)
+	return aiStudioToAIContent(aiStudioExport.ChunkedPrompt.Chunks, false)
+}
+
+// HistoryStudioToAIContentWithThoughts is like HistoryStudioToAIContent
+// but keeps the model thoughts recorded in the history file, adding
+// them as the leading parts of the relevant model content.
+func HistoryStudioToAIContentWithThoughts(filePath string) ([]*genai.Content, error) {
+	aiStudioExport, err := readStudioHistory(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return aiStudioToAIContent(aiStudioExport.ChunkedPrompt.Chunks, true)
+}
+
+// StudioSystemInstruction returns the system instruction, if any, from a
+// history file saved from Google Gemini AI Studio. An empty string is
+// returned if the export has no system instruction.
+func StudioSystemInstruction(filePath string) (string, error) {
+	aiStudioExport, err := readStudioHistory(filePath)
+	if err != nil {
+		return "", err
+	}
+	return aiStudioExport.SystemInstruction.String(), nil
 }
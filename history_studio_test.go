@@ -16,3 +16,45 @@ func TestHistoryStudio(t *testing.T) {
 		t.Errorf("got %d want %d contents", got, want)
 	}
 }
+
+// TestHistoryStudioWithThoughts tests the parsing of a history file
+// downloaded from Google AI Studio, keeping thoughts.
+func TestHistoryStudioWithThoughts(t *testing.T) {
+	file := "testdata/studio-history-tennis.json"
+	h, err := HistoryStudioToAIContentWithThoughts(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(h), 6; got != want {
+		t.Fatalf("got %d want %d contents", got, want)
+	}
+	for i, c := range h {
+		want := 1
+		if c.Role == "model" {
+			want = 2 // each model response is preceded by a thought
+		}
+		if got := len(c.Parts); got != want {
+			t.Errorf("content %d (%s) got %d want %d parts", i, c.Role, got, want)
+		}
+	}
+}
+
+// TestStudioSystemInstruction tests extracting the system instruction
+// from a Google AI Studio export.
+func TestStudioSystemInstruction(t *testing.T) {
+	si, err := StudioSystemInstruction("testdata/studio-history-tennis.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if si != "" {
+		t.Errorf("expected empty system instruction, got %q", si)
+	}
+
+	si, err = StudioSystemInstruction("testdata/studio-history-system.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := si, "You are a tennis historian.\n\nAnswer concisely."; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
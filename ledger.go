@@ -0,0 +1,98 @@
+package genact
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Ledger statuses of api calls.
+const (
+	LedgerOK    = "ok"
+	LedgerError = "error"
+)
+
+// LedgerRecord is the record of an api call, including each retry and
+// each round of a request, in a usage Ledger.
+type LedgerRecord struct {
+	Time       time.Time `json:"time"`
+	Chat       string    `json:"chat,omitempty"`
+	Model      string    `json:"model"`
+	Usage      Usage     `json:"usage"`
+	Cost       float64   `json:"cost,omitempty"` // the estimated cost in US dollars
+	DurationMS int64     `json:"durationMs"`
+	Status     string    `json:"status"` // LedgerOK or LedgerError
+	Error      string    `json:"error,omitempty"`
+}
+
+// Ledger is an append-only json lines file recording the api calls of
+// requests made with WithLedger. Each record is appended with a single
+// write so that several processes may share a ledger.
+type Ledger struct {
+	path string
+	mu   sync.Mutex
+}
+
+// OpenLedger returns the Ledger at path, which is made when the first
+// record is appended.
+func OpenLedger(path string) *Ledger {
+	return &Ledger{path: path}
+}
+
+// Append appends a record to the ledger.
+func (l *Ledger) Append(r LedgerRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("could not encode ledger record: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("could not make ledger directory: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open ledger: %w", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("could not write ledger: %w", err)
+	}
+	return f.Close()
+}
+
+// ReadLedger reads the records of the ledger at path, of which there
+// are none if it does not exist.
+func ReadLedger(path string) ([]LedgerRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open ledger: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var records []LedgerRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r LedgerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("ledger %s line %d: %w", path, n, err)
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read ledger: %w", err)
+	}
+	return records, nil
+}
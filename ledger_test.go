@@ -0,0 +1,56 @@
+package genact
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+// TestLedger tests recording the api calls of requests in a ledger,
+// including a failed attempt which was retried.
+func TestLedger(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "conversations", "ledger.jsonl")
+	records, err := ReadLedger(path)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("got %d records and error %v from a missing ledger", len(records), err)
+	}
+
+	ledger := OpenLedger(path)
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "overloaded"}
+	usage := &Usage{PromptTokens: 1000, CandidatesTokens: 100, TotalTokens: 1100}
+	fake := NewFakeBackend(FakeReply{Err: unavailable}, FakeReply{Text: "Fine.", Usage: usage}, FakeReply{Text: "Good.", Usage: usage})
+	for _, prompt := range []string{"How are you?", "And now?"} {
+		_, err := APIGetResponseContext(context.Background(), fakeSettings(), nil, prompt,
+			WithBackend(fake), WithLedger(ledger, "chat1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err = ReadLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(records), 3; got != want {
+		t.Fatalf("got %d records want %d", got, want)
+	}
+	for i, want := range []string{LedgerError, LedgerOK, LedgerOK} {
+		r := records[i]
+		if r.Status != want || r.Chat != "chat1" || r.Model != "gemini-2.5-pro" || r.Time.IsZero() {
+			t.Errorf("record %d unexpected %+v", i, r)
+		}
+	}
+	if records[0].Error == "" || records[0].Usage.TotalTokens != 0 {
+		t.Errorf("failed call recorded as %+v", records[0])
+	}
+	if got, want := records[1].Usage, *usage; got != want {
+		t.Errorf("usage got %+v want %+v", got, want)
+	}
+	if got, want := records[1].Cost, (1000*1.25+100*10.0)/1e6; got != want {
+		t.Errorf("cost got %g want %g", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package genact
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Usage is the token usage reported by the api for a request. The
+// prompt token count includes any cached content tokens.
+type Usage struct {
+	PromptTokens        int32 `json:"promptTokens"`
+	CachedContentTokens int32 `json:"cachedContentTokens"`
+	CandidatesTokens    int32 `json:"candidatesTokens"`
+	ThoughtsTokens      int32 `json:"thoughtsTokens"`
+	ToolUsePromptTokens int32 `json:"toolUsePromptTokens"`
+	TotalTokens         int32 `json:"totalTokens"`
+}
+
+// Add returns the sum of two usages, such as those of the rounds of
+// function calls in a request.
+func (u Usage) Add(o Usage) Usage {
+	return Usage{
+		PromptTokens:        u.PromptTokens + o.PromptTokens,
+		CachedContentTokens: u.CachedContentTokens + o.CachedContentTokens,
+		CandidatesTokens:    u.CandidatesTokens + o.CandidatesTokens,
+		ThoughtsTokens:      u.ThoughtsTokens + o.ThoughtsTokens,
+		ToolUsePromptTokens: u.ToolUsePromptTokens + o.ToolUsePromptTokens,
+		TotalTokens:         u.TotalTokens + o.TotalTokens,
+	}
+}
+
+// UsageTotal is the sum of the usages of many requests, such as those
+// in a usage ledger or a batch, in counts which do not overflow.
+type UsageTotal struct {
+	PromptTokens        int64 `json:"promptTokens"`
+	CachedContentTokens int64 `json:"cachedContentTokens"`
+	CandidatesTokens    int64 `json:"candidatesTokens"`
+	ThoughtsTokens      int64 `json:"thoughtsTokens"`
+	ToolUsePromptTokens int64 `json:"toolUsePromptTokens"`
+	TotalTokens         int64 `json:"totalTokens"`
+}
+
+// Total returns u as a UsageTotal.
+func (u Usage) Total() UsageTotal {
+	return UsageTotal{
+		PromptTokens:        int64(u.PromptTokens),
+		CachedContentTokens: int64(u.CachedContentTokens),
+		CandidatesTokens:    int64(u.CandidatesTokens),
+		ThoughtsTokens:      int64(u.ThoughtsTokens),
+		ToolUsePromptTokens: int64(u.ToolUsePromptTokens),
+		TotalTokens:         int64(u.TotalTokens),
+	}
+}
+
+// Add returns the sum of two totals.
+func (t UsageTotal) Add(o UsageTotal) UsageTotal {
+	return UsageTotal{
+		PromptTokens:        t.PromptTokens + o.PromptTokens,
+		CachedContentTokens: t.CachedContentTokens + o.CachedContentTokens,
+		CandidatesTokens:    t.CandidatesTokens + o.CandidatesTokens,
+		ThoughtsTokens:      t.ThoughtsTokens + o.ThoughtsTokens,
+		ToolUsePromptTokens: t.ToolUsePromptTokens + o.ToolUsePromptTokens,
+		TotalTokens:         t.TotalTokens + o.TotalTokens,
+	}
+}
+
+// usageFromMetadata makes a Usage from genai.UsageMetadata, which does
+// not include thought or tool use token counts.
+func usageFromMetadata(um *genai.UsageMetadata) Usage {
+	if um == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens:        um.PromptTokenCount,
+		CachedContentTokens: um.CachedContentTokenCount,
+		CandidatesTokens:    um.CandidatesTokenCount,
+		TotalTokens:         um.TotalTokenCount,
+	}
+}
+
+// TurnMetadata is a record of the metadata of a single conversation
+// turn, suitable for saving alongside a history file.
+type TurnMetadata struct {
+	Time           time.Time `json:"time"`
+	Model          string    `json:"model"`
+	RequestedModel string    `json:"requestedModel,omitempty"` // the model requested, if the turn fell back to Model
+	ModelVersion   string    `json:"modelVersion,omitempty"`
+	FinishReason   string    `json:"finishReason"`
+	LatencyMS      int64     `json:"latencyMs"`
+	Usage          Usage     `json:"usage"`
+	Cost           float64   `json:"cost,omitempty"` // the estimated cost in US dollars
+	ToolCalls      int       `json:"toolCalls,omitempty"`
+	Continuations  int       `json:"continuations,omitempty"`
+	Candidates     int       `json:"candidates,omitempty"` // the number of candidates, if several
+	Candidate      int       `json:"candidate,omitempty"`  // the candidate selected, numbered from 1
+}
+
+// Metadata returns the TurnMetadata for a response.
+func (r *ApiResponse) Metadata() TurnMetadata {
+	tm := TurnMetadata{
+		Time:           time.Now().UTC().Truncate(time.Second),
+		Model:          r.Model,
+		RequestedModel: r.RequestedModel,
+		ModelVersion:   r.ModelVersion,
+		FinishReason:   r.FinishReason,
+		LatencyMS:      r.Latency.Milliseconds(),
+		Usage:          r.Usage,
+		Cost:           r.Cost,
+		ToolCalls:      r.ToolCalls,
+		Continuations:  r.Continuations,
+	}
+	if len(r.Candidates) > 0 {
+		tm.Candidates, tm.Candidate = len(r.Candidates), r.Selected+1
+	}
+	return tm
+}
+
+// finishReasonNames are the api names of genai.FinishReason values.
+var finishReasonNames = map[genai.FinishReason]string{
+	genai.FinishReasonUnspecified: "FINISH_REASON_UNSPECIFIED",
+	genai.FinishReasonStop:        "STOP",
+	genai.FinishReasonMaxTokens:   "MAX_TOKENS",
+	genai.FinishReasonSafety:      "SAFETY",
+	genai.FinishReasonRecitation:  "RECITATION",
+	genai.FinishReasonOther:       "OTHER",
+}
+
+// finishReasonName returns the api name of a genai.FinishReason.
+func finishReasonName(fr genai.FinishReason) string {
+	if n, ok := finishReasonNames[fr]; ok {
+		return n
+	}
+	return fmt.Sprintf("FINISH_REASON_%d", fr)
+}
@@ -0,0 +1,590 @@
+package genact
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+)
+
+// maxOpenAIChoices is the largest number of choices accepted in a
+// streamed response, that of the "candidateCount" setting.
+const maxOpenAIChoices = 8
+
+// maxErrorBody is the maximum number of bytes read from an error
+// response.
+const maxErrorBody = 64 << 10
+
+// openAIBackend is the Backend for OpenAI-compatible chat completions
+// apis, such as those provided by llama.cpp, Ollama and vLLM for
+// self-hosted models. Requests are sent to the "endpoint" setting, for
+// example http://localhost:11434/v1, with the "apiKey" setting, if any,
+// as a bearer token.
+//
+// Only text and image parts are supported; other attachments and
+// uploaded files are refused.
+type openAIBackend struct {
+	settings *Settings
+	client   *http.Client
+	logger   *slog.Logger
+}
+
+// newOpenAIBackend returns an OpenAI-compatible backend sending
+// requests with the base http transport and logging to logger.
+func newOpenAIBackend(settings *Settings, base http.RoundTripper, logger *slog.Logger) *openAIBackend {
+	return &openAIBackend{
+		settings: settings,
+		client:   &http.Client{Transport: base},
+		logger:   logger,
+	}
+}
+
+// Close implements Backend.
+func (b *openAIBackend) Close() error {
+	return nil
+}
+
+// openAIRequest is a chat completions request.
+type openAIRequest struct {
+	Model          string                `json:"model"`
+	Messages       []openAIMessage       `json:"messages"`
+	Stream         bool                  `json:"stream,omitempty"`
+	StreamOptions  *openAIStreamOptions  `json:"stream_options,omitempty"`
+	Temperature    *float32              `json:"temperature,omitempty"`
+	TopP           *float32              `json:"top_p,omitempty"`
+	TopK           *int32                `json:"top_k,omitempty"` // not standard, but widely supported
+	MaxTokens      *int32                `json:"max_tokens,omitempty"`
+	N              *int32                `json:"n,omitempty"`
+	Stop           []string              `json:"stop,omitempty"`
+	Tools          []openAITool          `json:"tools,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// openAIMessage is a chat message. Content is a string, a list of
+// openAIContentParts or, for an assistant message with only tool calls,
+// nil.
+type openAIMessage struct {
+	Role             string           `json:"role"`
+	Content          any              `json:"content"`
+	ReasoningContent string           `json:"reasoning_content,omitempty"`
+	ToolCalls        []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID       string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIToolCall struct {
+	Index    int                `json:"index,omitempty"` // the position of a streamed tool call
+	ID       string             `json:"id,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Function openAIFunctionCall `json:"function"`
+}
+
+type openAIFunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"` // a json object
+}
+
+type openAITool struct {
+	Type     string         `json:"type"`
+	Function openAIFunction `json:"function"`
+}
+
+type openAIFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type openAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *openAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type openAIJSONSchema struct {
+	Name   string         `json:"name"`
+	Schema map[string]any `json:"schema"`
+}
+
+// openAIResponse is a chat completions response, or a chunk of a
+// streamed response.
+type openAIResponse struct {
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage"`
+}
+
+type openAIChoice struct {
+	Index        int                   `json:"index"`
+	Message      openAIResponseMessage `json:"message"`
+	Delta        openAIResponseMessage `json:"delta"`
+	FinishReason string                `json:"finish_reason"`
+}
+
+type openAIResponseMessage struct {
+	Content          string           `json:"content"`
+	ReasoningContent string           `json:"reasoning_content"`
+	ToolCalls        []openAIToolCall `json:"tool_calls"`
+}
+
+type openAIUsage struct {
+	PromptTokens            int32 `json:"prompt_tokens"`
+	CompletionTokens        int32 `json:"completion_tokens"`
+	TotalTokens             int32 `json:"total_tokens"`
+	CompletionTokensDetails *struct {
+		ReasoningTokens int32 `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+	PromptTokensDetails *struct {
+		CachedTokens int32 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+// openAIFinishReasons maps OpenAI finish reasons to the Gemini names
+// used in metadata.
+var openAIFinishReasons = map[string]string{
+	"stop":           "STOP",
+	"length":         "MAX_TOKENS",
+	"tool_calls":     "STOP",
+	"function_call":  "STOP",
+	"content_filter": "SAFETY",
+}
+
+// request makes the chat completions request for a backend request.
+func (b *openAIBackend) request(req *BackendRequest, stream bool) (*openAIRequest, error) {
+	messages, err := openAIMessages(req)
+	if err != nil {
+		return nil, err
+	}
+	or := &openAIRequest{
+		Model:       req.Model,
+		Messages:    messages,
+		Temperature: b.settings.Temperature,
+		TopP:        b.settings.TopP,
+		TopK:        b.settings.TopK,
+		MaxTokens:   b.settings.MaxOutputTokens,
+		Stop:        b.settings.StopSequences,
+	}
+	if n := b.settings.CandidateCount; n != nil && *n > 1 {
+		or.N = n
+	}
+	if stream {
+		or.Stream = true
+		or.StreamOptions = &openAIStreamOptions{IncludeUsage: true}
+	}
+	for _, t := range req.Tools {
+		for _, fd := range t.FunctionDeclarations {
+			or.Tools = append(or.Tools, openAITool{
+				Type: "function",
+				Function: openAIFunction{
+					Name:        fd.Name,
+					Description: fd.Description,
+					Parameters:  openAISchema(fd.Parameters),
+				},
+			})
+		}
+	}
+	switch {
+	case req.JSONOutput && req.Schema != nil:
+		or.ResponseFormat = &openAIResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: &openAIJSONSchema{Name: "response", Schema: openAISchema(req.Schema)},
+		}
+	case req.JSONOutput:
+		or.ResponseFormat = &openAIResponseFormat{Type: "json_object"}
+	}
+	return or, nil
+}
+
+// openAIMessages converts the system instruction and contents of a
+// request to chat messages. Function calls, which have no ids in genai
+// contents, are given ids by position and matched in order with the
+// function responses of the following user turn.
+func openAIMessages(req *BackendRequest) ([]openAIMessage, error) {
+	var messages []openAIMessage
+	if req.SystemInstruction != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: req.SystemInstruction})
+	}
+	var callIDs []string
+	for i, c := range req.Contents {
+		if c.Role == "model" {
+			msg := openAIMessage{Role: "assistant"}
+			var text strings.Builder
+			callIDs = nil
+			for j, p := range c.Parts {
+				switch x := p.(type) {
+				case genai.Text:
+					text.WriteString(string(x))
+				case genai.FunctionCall:
+					args, err := json.Marshal(x.Args)
+					if err != nil {
+						return nil, fmt.Errorf("could not encode function call %s: %w", x.Name, err)
+					}
+					id := fmt.Sprintf("call_%d_%d", i, j)
+					callIDs = append(callIDs, id)
+					msg.ToolCalls = append(msg.ToolCalls, openAIToolCall{
+						ID:       id,
+						Type:     "function",
+						Function: openAIFunctionCall{Name: x.Name, Arguments: string(args)},
+					})
+				default:
+					return nil, fmt.Errorf("unsupported model part %T", p)
+				}
+			}
+			if text.Len() > 0 {
+				msg.Content = text.String()
+			}
+			messages = append(messages, msg)
+			continue
+		}
+
+		var parts []openAIContentPart
+		for j, p := range c.Parts {
+			switch x := p.(type) {
+			case genai.Text:
+				parts = append(parts, openAIContentPart{Type: "text", Text: string(x)})
+			case genai.Blob:
+				if !strings.HasPrefix(x.MIMEType, "image/") {
+					return nil, fmt.Errorf("%s attachments are not supported by the %s backend", x.MIMEType, BackendOpenAI)
+				}
+				parts = append(parts, openAIContentPart{
+					Type:     "image_url",
+					ImageURL: &openAIImageURL{URL: "data:" + x.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(x.Data)},
+				})
+			case genai.FunctionResponse:
+				response, err := json.Marshal(x.Response)
+				if err != nil {
+					return nil, fmt.Errorf("could not encode function response %s: %w", x.Name, err)
+				}
+				id := fmt.Sprintf("call_%d_%d", i, j)
+				if len(callIDs) > 0 {
+					id, callIDs = callIDs[0], callIDs[1:]
+				}
+				messages = append(messages, openAIMessage{Role: "tool", Content: string(response), ToolCallID: id})
+			case genai.FileData:
+				return nil, fmt.Errorf("uploaded files are not supported by the %s backend", BackendOpenAI)
+			default:
+				return nil, fmt.Errorf("unsupported user part %T", p)
+			}
+		}
+		switch {
+		case len(parts) == 0:
+		case len(parts) == 1 && parts[0].Type == "text":
+			messages = append(messages, openAIMessage{Role: "user", Content: parts[0].Text})
+		default:
+			messages = append(messages, openAIMessage{Role: "user", Content: parts})
+		}
+	}
+	return messages, nil
+}
+
+// openAISchema converts a genai.Schema to a JSON Schema.
+func openAISchema(s *genai.Schema) map[string]any {
+	if s == nil {
+		return nil
+	}
+	m := map[string]any{}
+	for name, t := range schemaTypes {
+		if t == s.Type {
+			m["type"] = name
+			if s.Nullable {
+				m["type"] = []string{name, "null"}
+			}
+		}
+	}
+	if s.Description != "" {
+		m["description"] = s.Description
+	}
+	if s.Format != "" && s.Format != "enum" {
+		m["format"] = s.Format
+	}
+	if len(s.Enum) > 0 {
+		m["enum"] = s.Enum
+	}
+	if len(s.Properties) > 0 {
+		props := map[string]any{}
+		for name, p := range s.Properties {
+			props[name] = openAISchema(p)
+		}
+		m["properties"] = props
+	}
+	if len(s.Required) > 0 {
+		m["required"] = s.Required
+	}
+	if s.Items != nil {
+		m["items"] = openAISchema(s.Items)
+	}
+	return m
+}
+
+// post posts a chat completions request, returning the response body.
+// Responses other than 200 OK are returned as a *googleapi.Error so
+// that transient errors are retried.
+func (b *openAIBackend) post(ctx context.Context, or *openAIRequest) (io.ReadCloser, error) {
+	body, err := json.Marshal(or)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode request: %w", err)
+	}
+	url := strings.TrimSuffix(b.settings.Endpoint, "/") + "/chat/completions"
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	if b.settings.APIKey != "" {
+		hr.Header.Set("Authorization", "Bearer "+b.settings.APIKey)
+	}
+	resp, err := b.client.Do(hr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send message: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		gerr := &googleapi.Error{
+			Code:   resp.StatusCode,
+			Body:   string(errBody),
+			Header: resp.Header,
+		}
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(errBody, &e) == nil {
+			gerr.Message = e.Error.Message
+		}
+		return nil, fmt.Errorf("failed to send message: %w", gerr)
+	}
+	return resp.Body, nil
+}
+
+// Send implements Backend.
+func (b *openAIBackend) Send(ctx context.Context, req *BackendRequest) (*BackendResponse, error) {
+	or, err := b.request(req, false)
+	if err != nil {
+		return nil, err
+	}
+	b.logger.Debug("sending prompt", "backend", BackendOpenAI)
+	body, err := b.post(ctx, or)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = body.Close() }()
+	var resp openAIResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, &ResponseError{Err: ErrEmptyResponse}
+	}
+	choices := make([]openAIResponseMessage, len(resp.Choices))
+	finishReasons := make([]string, len(resp.Choices))
+	for _, c := range resp.Choices {
+		if c.Index < 0 || c.Index >= len(choices) {
+			return nil, fmt.Errorf("choice index %d out of range", c.Index)
+		}
+		choices[c.Index], finishReasons[c.Index] = c.Message, c.FinishReason
+	}
+	return openAIBackendResponse(resp.Model, choices, finishReasons, resp.Usage, b.logger)
+}
+
+// Stream implements Backend. The response is read as server-sent
+// events, each a chunk of the response, ending with "[DONE]".
+func (b *openAIBackend) Stream(ctx context.Context, req *BackendRequest, chunkFunc func(string) error) (*BackendResponse, error) {
+	if chunkFunc == nil {
+		return nil, errors.New("stream chunk function not provided")
+	}
+	or, err := b.request(req, true)
+	if err != nil {
+		return nil, err
+	}
+	b.logger.Debug("streaming prompt", "backend", BackendOpenAI)
+	body, err := b.post(ctx, or)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = body.Close() }()
+
+	// the merged message and finish reason of each choice
+	var model string
+	var choices []openAIResponseMessage
+	var finishReasons []string
+	var usage *openAIUsage
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("could not decode stream chunk: %w", err)
+		}
+		model = cmp.Or(chunk.Model, model)
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			if c.Index < 0 || c.Index >= maxOpenAIChoices {
+				return nil, fmt.Errorf("choice index %d out of range", c.Index)
+			}
+			for len(choices) <= c.Index {
+				choices = append(choices, openAIResponseMessage{})
+				finishReasons = append(finishReasons, "")
+			}
+			merged, delta := &choices[c.Index], c.Delta
+			finishReasons[c.Index] = cmp.Or(c.FinishReason, finishReasons[c.Index])
+			merged.ReasoningContent += delta.ReasoningContent
+			for _, tc := range delta.ToolCalls {
+				for len(merged.ToolCalls) <= tc.Index {
+					merged.ToolCalls = append(merged.ToolCalls, openAIToolCall{Index: len(merged.ToolCalls)})
+				}
+				call := &merged.ToolCalls[tc.Index]
+				call.ID += tc.ID
+				call.Function.Name += tc.Function.Name
+				call.Function.Arguments += tc.Function.Arguments
+			}
+			if delta.Content == "" {
+				continue
+			}
+			merged.Content += delta.Content
+			if c.Index > 0 { // only the first choice is streamed
+				continue
+			}
+			if err := chunkFunc(delta.Content); err != nil {
+				return nil, fmt.Errorf("stream chunk error: %w", err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to stream message: %w", err)
+	}
+	if len(choices) == 0 {
+		return nil, &ResponseError{Err: ErrEmptyResponse}
+	}
+	return openAIBackendResponse(model, choices, finishReasons, usage, b.logger)
+}
+
+// openAIBackendResponse makes a BackendResponse from the response
+// message and finish reason of each choice. When several choices were
+// returned, those which were not stopped or empty are recorded as the
+// response Candidates, the first of them being the response, others
+// being logged to logger. The response fails only if every choice was
+// stopped or empty.
+func openAIBackendResponse(model string, choices []openAIResponseMessage, finishReasons []string, usage *openAIUsage, logger *slog.Logger) (*BackendResponse, error) {
+	first, firstErr := openAICandidate(choices[0], finishReasons[0])
+	var usable []BackendCandidate
+	if len(choices) > 1 {
+		for i := range choices {
+			c, err := openAICandidate(choices[i], finishReasons[i])
+			if err != nil {
+				logger.Warn("candidate omitted", "candidate", i+1, "error", err)
+				continue
+			}
+			usable = append(usable, c)
+		}
+		if len(usable) > 0 {
+			first, firstErr = usable[0], nil
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	logger.Debug("response ok", "backend", BackendOpenAI)
+
+	br := &BackendResponse{
+		Content:      first.Content,
+		FinishReason: first.FinishReason,
+		Thoughts:     first.Thoughts,
+		ModelVersion: model,
+		Candidates:   usable,
+	}
+	if usage != nil {
+		br.Usage = Usage{
+			PromptTokens:     usage.PromptTokens,
+			CandidatesTokens: usage.CompletionTokens,
+			TotalTokens:      usage.TotalTokens,
+		}
+		if d := usage.CompletionTokensDetails; d != nil {
+			br.Usage.ThoughtsTokens = d.ReasoningTokens
+			br.Usage.CandidatesTokens -= d.ReasoningTokens
+		}
+		if d := usage.PromptTokensDetails; d != nil {
+			br.Usage.CachedContentTokens = d.CachedTokens
+		}
+	}
+	return br, nil
+}
+
+// openAICandidate makes a candidate from a response message. Tool calls
+// become function calls and the reasoning content, if any, the
+// thoughts.
+func openAICandidate(msg openAIResponseMessage, finishReason string) (BackendCandidate, error) {
+	content := &genai.Content{Role: "model"}
+	if msg.Content != "" {
+		content.Parts = append(content.Parts, genai.Text(msg.Content))
+	}
+	for _, tc := range msg.ToolCalls {
+		args := map[string]any{}
+		if tc.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+				return BackendCandidate{}, fmt.Errorf("could not decode arguments of tool call %s: %w", tc.Function.Name, err)
+			}
+		}
+		content.Parts = append(content.Parts, genai.FunctionCall{Name: tc.Function.Name, Args: args})
+	}
+	c := BackendCandidate{
+		Content:      content,
+		FinishReason: openAIFinishReasons[finishReason],
+		Thoughts:     msg.ReasoningContent,
+	}
+	if c.FinishReason == "" && finishReason != "" {
+		c.FinishReason = strings.ToUpper(finishReason)
+	}
+	if err := finishReasonError(c.FinishReason, len(content.Parts) == 0, nil); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// CountTokens implements Backend. OpenAI-compatible apis have no
+// standard token counting endpoint, so the count is that estimated by
+// estimateTokens, as is made for the rate limit without a pre-flight
+// count. The context limit is not known, so only that of the
+// "contextLimit" setting, if any, is checked.
+func (b *openAIBackend) CountTokens(ctx context.Context, req *BackendRequest) (TokenCount, error) {
+	var tc TokenCount
+	if _, err := b.request(req, false); err != nil {
+		return tc, err
+	}
+	tc.Tokens = estimateTokens(req)
+	return tc, nil
+}
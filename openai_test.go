@@ -0,0 +1,389 @@
+package genact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/googleapi"
+)
+
+// TestOpenAIMessages tests the conversion of a request to chat
+// messages, including the ids given to function calls and the refusal
+// of unsupported attachments.
+func TestOpenAIMessages(t *testing.T) {
+
+	req := &BackendRequest{
+		SystemInstruction: "Be brief.",
+		Contents: []*genai.Content{
+			{Role: "user", Parts: []genai.Part{genai.Text("What is this?"), genai.Blob{MIMEType: "image/png", Data: []byte("png")}}},
+			{Role: "model", Parts: []genai.Part{genai.FunctionCall{Name: "read_file", Args: map[string]any{"path": "a.txt"}}}},
+			{Role: "user", Parts: []genai.Part{genai.FunctionResponse{Name: "read_file", Response: map[string]any{"content": "a"}}}},
+			{Role: "model", Parts: []genai.Part{genai.Text("A cat.")}},
+			{Role: "user", Parts: []genai.Part{genai.Text("Thanks")}},
+		},
+	}
+	messages, err := openAIMessages(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []openAIMessage{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: []openAIContentPart{
+			{Type: "text", Text: "What is this?"},
+			{Type: "image_url", ImageURL: &openAIImageURL{URL: "data:image/png;base64,cG5n"}},
+		}},
+		{Role: "assistant", ToolCalls: []openAIToolCall{
+			{ID: "call_1_0", Type: "function", Function: openAIFunctionCall{Name: "read_file", Arguments: `{"path":"a.txt"}`}},
+		}},
+		{Role: "tool", Content: `{"content":"a"}`, ToolCallID: "call_1_0"},
+		{Role: "assistant", Content: "A cat."},
+		{Role: "user", Content: "Thanks"},
+	}
+	if diff := cmp.Diff(want, messages); diff != "" {
+		t.Errorf("messages mismatch (-want +got):\n%s", diff)
+	}
+
+	req.Contents = []*genai.Content{{Role: "user", Parts: []genai.Part{genai.Blob{MIMEType: "application/pdf"}}}}
+	if _, err := openAIMessages(req); err == nil || !strings.Contains(err.Error(), "application/pdf attachments are not supported") {
+		t.Errorf("expected unsupported attachment error, got %v", err)
+	}
+}
+
+// openAIServer is a stand-in OpenAI-compatible server replying to each
+// request with the next of its scripted replies, a json response body,
+// a stream of chunks or an error status.
+type openAIServer struct {
+	*httptest.Server
+	replies  []openAIReply
+	requests []openAIRequest
+}
+
+type openAIReply struct {
+	status int      // an error status, if not zero
+	body   string   // a json response
+	chunks []string // server-sent event data, if streaming
+	check  func(*testing.T, openAIRequest)
+}
+
+func newOpenAIServer(t *testing.T, replies ...openAIReply) *openAIServer {
+	s := &openAIServer{replies: replies}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var req openAIRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.requests = append(s.requests, req)
+		if len(s.replies) == 0 {
+			http.Error(w, `{"error": {"message": "no reply scripted"}}`, http.StatusInternalServerError)
+			return
+		}
+		reply := s.replies[0]
+		s.replies = s.replies[1:]
+		if reply.check != nil {
+			reply.check(t, req)
+		}
+		switch {
+		case reply.status != 0:
+			w.WriteHeader(reply.status)
+			_, _ = fmt.Fprint(w, reply.body)
+		case reply.chunks != nil:
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, c := range reply.chunks {
+				_, _ = fmt.Fprintf(w, "data: %s\n\n", c)
+			}
+			_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprint(w, reply.body)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// openAIText returns a chat completions response with text content.
+func openAIText(text string) string {
+	b, _ := json.Marshal(text)
+	return fmt.Sprintf(`{"model": "qwen3:8b", "choices": [{"message": {"role": "assistant", "content": %s}, "finish_reason": "stop"}],
+		"usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}}`, b)
+}
+
+// TestOpenAIBackend tests requests to an OpenAI-compatible server
+// through APIGetResponseContext, including streaming, function calls,
+// JSON output re-asks and retries.
+func TestOpenAIBackend(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("buy milk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	history := []*genai.Content{
+		{Role: "user", Parts: []genai.Part{genai.Text("Hi")}},
+		{Role: "model", Parts: []genai.Part{genai.Text("Hello")}},
+	}
+
+	tests := []struct {
+		desc       string
+		replies    []openAIReply
+		settings   func(*Settings)
+		opts       func(chunks *[]string) []Option
+		response   string
+		chunks     []string
+		thoughts   string
+		candidates []string
+		toolCalls  int
+		usage      Usage
+		errText    string
+	}{
+		{
+			desc: "send",
+			replies: []openAIReply{{
+				body: openAIText("Hi there"),
+				check: func(t *testing.T, req openAIRequest) {
+					if got, want := len(req.Messages), 4; got != want {
+						t.Errorf("got %d messages want %d", got, want)
+					}
+					if req.Messages[0].Role != "system" || req.Stream {
+						t.Errorf("unexpected request %+v", req)
+					}
+				},
+			}},
+			response: "Hi there",
+			usage:    Usage{PromptTokens: 10, CandidatesTokens: 5, TotalTokens: 15},
+		},
+		{
+			desc: "stream",
+			replies: []openAIReply{{chunks: []string{
+				`{"model": "qwen3:8b", "choices": [{"delta": {"reasoning_content": "Greeting."}}]}`,
+				`{"choices": [{"delta": {"content": "Hi "}}]}`,
+				`{"choices": [{"delta": {"content": "there"}, "finish_reason": "stop"}]}`,
+				`{"choices": [], "usage": {"prompt_tokens": 10, "completion_tokens": 7, "total_tokens": 17, "completion_tokens_details": {"reasoning_tokens": 2}}}`,
+			}}},
+			opts: func(chunks *[]string) []Option {
+				return []Option{WithStream(func(s string) error {
+					*chunks = append(*chunks, s)
+					return nil
+				})}
+			},
+			response: "Hi there",
+			chunks:   []string{"Hi ", "there"},
+			thoughts: "Greeting.",
+			usage:    Usage{PromptTokens: 10, CandidatesTokens: 5, ThoughtsTokens: 2, TotalTokens: 17},
+		},
+		{
+			desc: "candidates",
+			replies: []openAIReply{{
+				body: `{"choices": [{"index": 1, "message": {"content": "Hello"}, "finish_reason": "stop"},
+					{"index": 0, "message": {"content": "Hi there"}, "finish_reason": "stop"},
+					{"index": 2, "message": {"content": ""}, "finish_reason": "length"}],
+					"usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}}`,
+				check: func(t *testing.T, req openAIRequest) {
+					if req.N == nil || *req.N != 3 {
+						t.Errorf("got n %v want 3", req.N)
+					}
+				},
+			}},
+			settings:   func(s *Settings) { s.CandidateCount = genai.Ptr[int32](3) },
+			response:   "Hi there",
+			candidates: []string{"Hi there", "Hello"},
+			usage:      Usage{PromptTokens: 10, CandidatesTokens: 5, TotalTokens: 15},
+		},
+		{
+			desc: "candidates with the first filtered",
+			replies: []openAIReply{{
+				body: `{"choices": [{"index": 0, "message": {"content": ""}, "finish_reason": "content_filter"},
+					{"index": 1, "message": {"content": "Hello"}, "finish_reason": "stop"},
+					{"index": 2, "message": {"content": "Hi there"}, "finish_reason": "stop"}],
+					"usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}}`,
+			}},
+			settings:   func(s *Settings) { s.CandidateCount = genai.Ptr[int32](3) },
+			response:   "Hello",
+			candidates: []string{"Hello", "Hi there"},
+			usage:      Usage{PromptTokens: 10, CandidatesTokens: 5, TotalTokens: 15},
+		},
+		{
+			desc: "stream candidates",
+			replies: []openAIReply{{chunks: []string{
+				`{"choices": [{"index": 0, "delta": {"content": "Hi "}}, {"index": 1, "delta": {"content": "Hel"}}]}`,
+				`{"choices": [{"index": 1, "delta": {"content": "lo"}, "finish_reason": "stop"}]}`,
+				`{"choices": [{"index": 0, "delta": {"content": "there"}, "finish_reason": "stop"}]}`,
+			}}},
+			settings: func(s *Settings) { s.CandidateCount = genai.Ptr[int32](2) },
+			opts: func(chunks *[]string) []Option {
+				return []Option{WithStream(func(s string) error {
+					*chunks = append(*chunks, s)
+					return nil
+				})}
+			},
+			response:   "Hi there",
+			chunks:     []string{"Hi ", "there"},
+			candidates: []string{"Hi there", "Hello"},
+		},
+		{
+			desc: "tool call",
+			replies: []openAIReply{
+				{
+					body: `{"choices": [{"message": {"role": "assistant", "tool_calls": [{"id": "x", "type": "function",
+						"function": {"name": "read_file", "arguments": "{\"path\": \"notes.txt\"}"}}]}, "finish_reason": "tool_calls"}],
+						"usage": {"prompt_tokens": 10, "completion_tokens": 5, "total_tokens": 15}}`,
+					check: func(t *testing.T, req openAIRequest) {
+						if got, want := len(req.Tools), 1; got != want {
+							t.Errorf("got %d tools want %d", got, want)
+						}
+					},
+				},
+				{
+					body: openAIText("Buy milk."),
+					check: func(t *testing.T, req openAIRequest) {
+						last := req.Messages[len(req.Messages)-1]
+						if last.Role != "tool" || !strings.Contains(fmt.Sprint(last.Content), "buy milk") {
+							t.Errorf("unexpected tool message %+v", last)
+						}
+					},
+				},
+			},
+			opts: func(*[]string) []Option {
+				tools, _ := BuiltinTools(dir, nil).Select("read_file")
+				return []Option{WithTools(tools)}
+			},
+			response:  "Buy milk.",
+			toolCalls: 1,
+			usage:     Usage{PromptTokens: 20, CandidatesTokens: 10, TotalTokens: 30},
+		},
+		{
+			desc: "json reask",
+			replies: []openAIReply{
+				{
+					body: openAIText("```json\n{}\n```"),
+					check: func(t *testing.T, req openAIRequest) {
+						if req.ResponseFormat == nil || req.ResponseFormat.Type != "json_object" {
+							t.Errorf("unexpected response format %+v", req.ResponseFormat)
+						}
+					},
+				},
+				{body: openAIText(`{"ok": true}`)},
+			},
+			opts: func(*[]string) []Option {
+				return []Option{WithJSONOutput(nil)}
+			},
+			response: `{"ok": true}`,
+			usage:    Usage{PromptTokens: 20, CandidatesTokens: 10, TotalTokens: 30},
+		},
+		{
+			desc: "retry",
+			replies: []openAIReply{
+				{status: http.StatusServiceUnavailable, body: `{"error": {"message": "loading model"}}`},
+				{body: openAIText("Hi there")},
+			},
+			response: "Hi there",
+			usage:    Usage{PromptTokens: 10, CandidatesTokens: 5, TotalTokens: 15},
+		},
+		{
+			desc: "bad request",
+			replies: []openAIReply{
+				{status: http.StatusBadRequest, body: `{"error": {"message": "model not found"}}`},
+			},
+			errText: "model not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			srv := newOpenAIServer(t, tt.replies...)
+			settings := defaultSettings()
+			settings.Backend, settings.ModelName, settings.Endpoint = BackendOpenAI, "qwen3:8b", srv.URL+"/v1"
+			settings.SystemInstruction = "Be brief."
+			settings.Retry.InitialDelay, settings.Retry.MaxDelay = 0, 0
+			settings.JSONReasks = 1
+			if tt.settings != nil {
+				tt.settings(&settings)
+			}
+
+			var chunks []string
+			var opts []Option
+			if tt.opts != nil {
+				opts = tt.opts(&chunks)
+			}
+			r, err := APIGetResponseContext(context.Background(), &settings, history, "Hi again", opts...)
+			if tt.errText != "" {
+				var gerr *googleapi.Error
+				if err == nil || !strings.Contains(err.Error(), tt.errText) || !errors.As(err, &gerr) {
+					t.Fatalf("got error %v want %q", err, tt.errText)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := r.LatestResponse, tt.response; got != want {
+				t.Errorf("response got %q want %q", got, want)
+			}
+			if diff := cmp.Diff(tt.chunks, chunks); diff != "" {
+				t.Errorf("chunks mismatch (-want +got):\n%s", diff)
+			}
+			if got, want := r.Thoughts, tt.thoughts; got != want {
+				t.Errorf("thoughts got %q want %q", got, want)
+			}
+			var candidates []string
+			for _, c := range r.Candidates {
+				candidates = append(candidates, c.LatestResponse)
+			}
+			if diff := cmp.Diff(tt.candidates, candidates); diff != "" {
+				t.Errorf("candidates mismatch (-want +got):\n%s", diff)
+			}
+			if got, want := r.ToolCalls, tt.toolCalls; got != want {
+				t.Errorf("tool calls got %d want %d", got, want)
+			}
+			if got, want := r.Usage, tt.usage; got != want {
+				t.Errorf("usage got %+v want %+v", got, want)
+			}
+			if len(srv.replies) > 0 {
+				t.Errorf("%d replies not sent", len(srv.replies))
+			}
+		})
+	}
+}
+
+// TestOpenAICountTokens tests the estimated token count of a request.
+func TestOpenAICountTokens(t *testing.T) {
+
+	settings := defaultSettings()
+	settings.Backend, settings.ModelName, settings.Endpoint = BackendOpenAI, "qwen3:8b", "http://127.0.0.1:1/v1"
+	settings.ContextLimit = 32768
+
+	tc, err := APICountTokens(context.Background(), &settings, nil, strings.Repeat("word ", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tc.Tokens, int32(125); got != want {
+		t.Errorf("got %d tokens want %d", got, want)
+	}
+	if got, want := tc.ContextLimit, int32(32768); got != want {
+		t.Errorf("got context limit %d want %d", got, want)
+	}
+
+	// an image is estimated per image rather than from its base64 size
+	image := genai.ImageData("png", bytes.Repeat([]byte{1}, 30000))
+	tc, err = APICountTokens(context.Background(), &settings, nil, "describe this", WithAttachments(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tc.Tokens, int32(len("describe this")/estimateCharsPerToken+estimateMediaTokens); got != want {
+		t.Errorf("got %d tokens with an image want %d", got, want)
+	}
+}
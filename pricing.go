@@ -0,0 +1,160 @@
+package genact
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ErrCostCap is returned when the cost of a chat or of the day has
+// reached the "costCapChat" or "costCapDay" setting and the request is
+// not sent.
+var ErrCostCap = errors.New("cost cap reached")
+
+//go:embed pricing.yaml
+var pricingYAML []byte
+
+// TokenRates are the prices of tokens in US dollars per million tokens.
+// A zero Cached rate is the Input rate and a zero Thinking rate the
+// Output rate.
+type TokenRates struct {
+	Input    float64 `yaml:"input"`
+	Output   float64 `yaml:"output"`
+	Cached   float64 `yaml:"cached"`
+	Thinking float64 `yaml:"thinking"`
+}
+
+// PriceTier are the token rates of requests with more than Above prompt
+// tokens.
+type PriceTier struct {
+	Above      int32 `yaml:"above"`
+	TokenRates `yaml:",inline"`
+}
+
+// ModelPrice is the price of a model, with higher rates for requests
+// with more prompt tokens, if any, in Tiers.
+type ModelPrice struct {
+	TokenRates `yaml:",inline"`
+	Tiers      []PriceTier `yaml:"tiers,omitempty"`
+}
+
+// Pricing is a table of model prices by model name, such as the
+// DefaultPricing bundled with genact, used to estimate the cost of
+// requests.
+type Pricing map[string]ModelPrice
+
+// defaultPricing parses the bundled pricing table once.
+var defaultPricing = sync.OnceValues(func() (Pricing, error) {
+	return ParsePricing(pricingYAML)
+})
+
+// DefaultPricing returns the pricing table bundled with genact, which
+// may be out of date. Use the "pricing" setting to change the prices
+// of models or add others.
+func DefaultPricing() Pricing {
+	p, err := defaultPricing()
+	if err != nil {
+		panic(fmt.Sprintf("bundled pricing: %v", err))
+	}
+	return maps.Clone(p)
+}
+
+// ParsePricing parses a yaml pricing table, such as that bundled with
+// genact, of model names to prices.
+func ParsePricing(b []byte) (Pricing, error) {
+	var p Pricing
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("could not parse pricing: %w", err)
+	}
+	return p, p.Validate()
+}
+
+// Validate checks that the rates are not negative and that the tiers
+// of each model are in increasing order.
+func (p Pricing) Validate() error {
+	var errs []error
+	for _, model := range slices.Sorted(maps.Keys(p)) {
+		mp := p[model]
+		rates := []TokenRates{mp.TokenRates}
+		for i, t := range mp.Tiers {
+			if t.Above <= 0 || (i > 0 && t.Above <= mp.Tiers[i-1].Above) {
+				errs = append(errs, fmt.Errorf("pricing %s: tier breakpoints must be positive and increasing", model))
+			}
+			rates = append(rates, t.TokenRates)
+		}
+		for _, r := range rates {
+			if r.Input < 0 || r.Output < 0 || r.Cached < 0 || r.Thinking < 0 {
+				errs = append(errs, fmt.Errorf("pricing %s: rates cannot be negative", model))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Price returns the price of model, matched by name or by the longest
+// name in the table of which model is a version, such as
+// gemini-2.5-pro for gemini-2.5-pro-001.
+func (p Pricing) Price(model string) (ModelPrice, bool) {
+	model = strings.TrimPrefix(model, "models/")
+	if mp, ok := p[model]; ok {
+		return mp, true
+	}
+	match := ""
+	for name := range p {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(match) {
+			match = name
+		}
+	}
+	mp, ok := p[match]
+	return mp, ok && match != ""
+}
+
+// Cost returns the cost in US dollars of a request to model with usage,
+// and false if the model is not in the table. The prompt tokens of the
+// usage include the cached tokens; the tool use prompt tokens, those of
+// the results of tools run by the api such as search, are priced as
+// input tokens.
+func (p Pricing) Cost(model string, u Usage) (float64, bool) {
+	mp, ok := p.Price(model)
+	if !ok {
+		return 0, false
+	}
+	r := mp.TokenRates
+	for _, t := range mp.Tiers {
+		if u.PromptTokens > t.Above {
+			r = t.TokenRates
+		}
+	}
+	cached := r.Cached
+	if cached == 0 {
+		cached = r.Input
+	}
+	thinking := r.Thinking
+	if thinking == 0 {
+		thinking = r.Output
+	}
+	cost := float64(u.PromptTokens-u.CachedContentTokens+u.ToolUsePromptTokens)*r.Input +
+		float64(u.CachedContentTokens)*cached +
+		float64(u.CandidatesTokens)*r.Output +
+		float64(u.ThoughtsTokens)*thinking
+	return cost / 1e6, true
+}
+
+// checkCostCap returns an ErrCostCap error if the cost of the chat or
+// the day, from a Spending, has reached its cap in settings.
+func checkCostCap(settings *Settings, chat, day float64) error {
+	if settings.CostCapChat > 0 && chat >= settings.CostCapChat {
+		return fmt.Errorf("%w: chat cost $%.4f has reached the cap of $%.2f", ErrCostCap, chat, settings.CostCapChat)
+	}
+	if settings.CostCapDay > 0 && day >= settings.CostCapDay {
+		return fmt.Errorf("%w: cost today $%.4f has reached the cap of $%.2f", ErrCostCap, day, settings.CostCapDay)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package genact
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// TestPricingCost tests the cost of requests with the bundled pricing.
+func TestPricingCost(t *testing.T) {
+
+	pricing := DefaultPricing()
+	tests := []struct {
+		name  string
+		model string
+		usage Usage
+		cost  float64
+		ok    bool
+	}{
+		{
+			name:  "input and output",
+			model: "gemini-2.5-pro",
+			usage: Usage{PromptTokens: 100_000, CandidatesTokens: 100_000},
+			cost:  0.125 + 1.0,
+			ok:    true,
+		},
+		{
+			name:  "cached and thinking",
+			model: "models/gemini-2.5-pro",
+			usage: Usage{PromptTokens: 100_000, CachedContentTokens: 60_000, CandidatesTokens: 1000, ThoughtsTokens: 2000},
+			cost:  (40_000*1.25 + 60_000*0.31 + 3000*10.0) / 1e6,
+			ok:    true,
+		},
+		{
+			name:  "tool use prompt",
+			model: "gemini-2.5-pro",
+			usage: Usage{PromptTokens: 100_000, ToolUsePromptTokens: 20_000, CandidatesTokens: 1000},
+			cost:  (120_000*1.25 + 1000*10.0) / 1e6,
+			ok:    true,
+		},
+		{
+			name:  "upper tier",
+			model: "gemini-2.5-pro",
+			usage: Usage{PromptTokens: 300_000, CandidatesTokens: 1000},
+			cost:  (300_000*2.50 + 1000*15.0) / 1e6,
+			ok:    true,
+		},
+		{
+			name:  "model version",
+			model: "gemini-2.5-flash-001",
+			usage: Usage{PromptTokens: 1_000_000},
+			cost:  0.30,
+			ok:    true,
+		},
+		{
+			name:  "longest name",
+			model: "gemini-2.5-flash-lite-preview",
+			usage: Usage{PromptTokens: 1_000_000},
+			cost:  0.10,
+			ok:    true,
+		},
+		{
+			name:  "cached rate defaults to input",
+			model: "gemini-2.0-flash-lite",
+			usage: Usage{PromptTokens: 1_000_000, CachedContentTokens: 1_000_000},
+			cost:  0.075,
+			ok:    true,
+		},
+		{
+			name:  "unknown model",
+			model: "qwen3:8b",
+			usage: Usage{PromptTokens: 1000},
+		},
+		{
+			name:  "name prefix is not a version",
+			model: "gemini-2.5-professional",
+			usage: Usage{PromptTokens: 1000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cost, ok := pricing.Cost(tt.model, tt.usage)
+			if got, want := ok, tt.ok; got != want {
+				t.Fatalf("priced got %t want %t", got, want)
+			}
+			if got, want := cost, tt.cost; math.Abs(got-want) > 1e-9 {
+				t.Errorf("cost got %g want %g", got, want)
+			}
+		})
+	}
+}
+
+// TestParsePricing tests parsing and validating pricing tables.
+func TestParsePricing(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		yaml    string
+		errText string
+	}{
+		{
+			name: "valid",
+			yaml: "m:\n  input: 1\n  output: 2\n  tiers: [{above: 10, input: 2}, {above: 20, input: 3}]",
+		},
+		{
+			name:    "negative rate",
+			yaml:    "m:\n  input: -1",
+			errText: "pricing m: rates cannot be negative",
+		},
+		{
+			name:    "tiers out of order",
+			yaml:    "m:\n  input: 1\n  tiers: [{above: 20, input: 2}, {above: 10, input: 3}]",
+			errText: "pricing m: tier breakpoints must be positive and increasing",
+		},
+		{
+			name:    "not a price",
+			yaml:    "m: [1, 2]",
+			errText: "could not parse pricing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePricing([]byte(tt.yaml))
+			if tt.errText == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("got error %v want %q", err, tt.errText)
+			}
+		})
+	}
+}
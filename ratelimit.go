@@ -0,0 +1,234 @@
+package genact
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateWindow is the window over which requests and tokens are limited.
+const rateWindow = time.Minute
+
+// staleLock is the age after which a rate limit lock file left by a
+// process which exited without removing it is removed. The lock is
+// only held to read and write the rate limit file.
+const staleLock = 10 * time.Second
+
+// RateLimiter limits the requests and tokens sent to the api per
+// minute, so that several requests, or several genact processes, stay
+// within the quota of a project. Each request is counted with an
+// estimate of its tokens, the pre-flight token count or an estimate
+// from the size of the request, which is replaced by the tokens used
+// once the response is received. Only requests generating content are
+// counted: the requests made to count tokens, to create caches and to
+// upload files are not.
+//
+// The requests of the last minute are recorded in a json file, if a
+// path is given, which is locked with a ".lock" file alongside it so
+// that the limit is shared between the processes on a machine. Without
+// a path the limit is shared only by the requests using the RateLimiter.
+//
+// Set the "requestsPerMinute" and "tokensPerMinute" settings to limit
+// requests, or provide a RateLimiter with WithRateLimiter to share it
+// between requests.
+type RateLimiter struct {
+	RequestsPerMinute int // zero for no limit
+	TokensPerMinute   int // zero for no limit
+
+	path    string
+	mu      sync.Mutex
+	entries []rateEntry // the requests when no path is given
+	now     func() time.Time
+}
+
+// rateEntry is a request counted by a RateLimiter.
+type rateEntry struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Tokens int32     `json:"tokens"`
+}
+
+// NewRateLimiter returns a RateLimiter limiting requests and tokens per
+// minute, a zero limit meaning no limit. The requests are recorded in
+// the file at path, if not empty, to share the limit between processes.
+func NewRateLimiter(requestsPerMinute, tokensPerMinute int, path string) *RateLimiter {
+	return &RateLimiter{
+		RequestsPerMinute: requestsPerMinute,
+		TokensPerMinute:   tokensPerMinute,
+		path:              path,
+		now:               time.Now,
+	}
+}
+
+// enabled reports whether the RateLimiter limits requests.
+func (r *RateLimiter) enabled() bool {
+	return r != nil && (r.RequestsPerMinute > 0 || r.TokensPerMinute > 0)
+}
+
+// Wait waits until a request of tokens, an estimate, may be sent within
+// the limits, returning the id of the request for Record. A request
+// over the tokens per minute limit on its own is sent once no other
+// requests have been sent in the last minute.
+func (r *RateLimiter) Wait(ctx context.Context, tokens int32, logger *slog.Logger) (string, error) {
+	if !r.enabled() {
+		return "", ctx.Err()
+	}
+	waited := false
+	for {
+		var id string
+		var delay time.Duration
+		err := r.update(func(entries []rateEntry, now time.Time) []rateEntry {
+			delay = r.delay(entries, tokens, now)
+			if delay > 0 {
+				return entries
+			}
+			id = strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(now.UnixNano(), 36)
+			return append(entries, rateEntry{ID: id, Time: now, Tokens: tokens})
+		})
+		if err != nil {
+			return "", err
+		}
+		if delay == 0 {
+			return id, nil
+		}
+		if !waited {
+			logger.Info("waiting for rate limit",
+				"delay", delay.Round(time.Millisecond),
+				"requestsPerMinute", r.RequestsPerMinute,
+				"tokensPerMinute", r.TokensPerMinute,
+				"tokens", tokens,
+			)
+			waited = true
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Record replaces the estimated tokens of the request id with those
+// used, zero for a failed request.
+func (r *RateLimiter) Record(id string, tokens int32) error {
+	if !r.enabled() || id == "" {
+		return nil
+	}
+	return r.update(func(entries []rateEntry, _ time.Time) []rateEntry {
+		for i, e := range entries {
+			if e.ID == id {
+				entries[i].Tokens = tokens
+			}
+		}
+		return entries
+	})
+}
+
+// delay returns the time to wait before a request of tokens may be sent
+// given the entries of the last minute, zero if it may be sent now.
+func (r *RateLimiter) delay(entries []rateEntry, tokens int32, now time.Time) time.Duration {
+	var delay time.Duration
+	if r.RequestsPerMinute > 0 && len(entries) >= r.RequestsPerMinute {
+		delay = entries[len(entries)-r.RequestsPerMinute].Time.Add(rateWindow).Sub(now)
+	}
+	if r.TokensPerMinute > 0 {
+		// wait for the earliest requests to leave the window until the
+		// tokens fit
+		total := int64(tokens)
+		for _, e := range entries {
+			total += int64(e.Tokens)
+		}
+		for _, e := range entries {
+			if total <= int64(r.TokensPerMinute) {
+				break
+			}
+			total -= int64(e.Tokens)
+			delay = max(delay, e.Time.Add(rateWindow).Sub(now))
+		}
+	}
+	return max(delay, 0)
+}
+
+// update calls fn with the requests of the last minute, in the order
+// sent, saving those returned. The rate limit file, if any, is locked
+// during the update.
+func (r *RateLimiter) update(fn func(entries []rateEntry, now time.Time) []rateEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	prune := func(entries []rateEntry) []rateEntry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if now.Sub(e.Time) < rateWindow {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	}
+	if r.path == "" {
+		r.entries = fn(prune(r.entries), now)
+		return nil
+	}
+
+	unlock, err := lockFile(r.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var entries []rateEntry
+	b, err := os.ReadFile(r.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("could not read rate limit file: %w", err)
+	default:
+		// a corrupt file is replaced
+		_ = json.Unmarshal(b, &entries)
+	}
+	b, err = json.Marshal(fn(prune(entries), now))
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("could not write rate limit file: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("could not write rate limit file: %w", err)
+	}
+	return nil
+}
+
+// lockFile creates the lock file at path, waiting while it is held by
+// another process, and returns a function removing it. A lock file
+// older than staleLock is removed.
+func lockFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not make lock file directory: %w", err)
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("could not lock %s: %w", path, err)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			_ = os.Remove(path)
+			continue
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
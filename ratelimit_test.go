@@ -0,0 +1,118 @@
+package genact
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// TestRateLimiterDelay tests the delay before a request may be sent
+// given the requests of the last minute.
+func TestRateLimiterDelay(t *testing.T) {
+
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+	entries := []rateEntry{
+		{Time: ago(50 * time.Second), Tokens: 600},
+		{Time: ago(30 * time.Second), Tokens: 300},
+		{Time: ago(10 * time.Second), Tokens: 100},
+	}
+
+	tests := []struct {
+		name    string
+		rpm     int
+		tpm     int
+		entries []rateEntry
+		tokens  int32
+		want    time.Duration
+	}{
+		{"no limits", 0, 0, entries, 100, 0},
+		{"under requests", 4, 0, entries, 100, 0},
+		{"at requests", 3, 0, entries, 100, 10 * time.Second},
+		{"over requests", 2, 0, entries, 100, 30 * time.Second},
+		{"under tokens", 0, 1100, entries, 100, 0},
+		{"over tokens", 0, 1000, entries, 100, 10 * time.Second},
+		{"well over tokens", 0, 1000, entries, 800, 30 * time.Second},
+		{"request over tokens", 0, 1000, entries, 2000, 50 * time.Second},
+		{"request over tokens alone", 0, 1000, nil, 2000, 0},
+		{"both", 3, 1000, entries, 800, 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRateLimiter(tt.rpm, tt.tpm, "")
+			if got, want := r.delay(tt.entries, tt.tokens, now), tt.want; got != want {
+				t.Errorf("delay got %s want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestRateLimiterFile tests that two rate limiters sharing a file, as
+// two genact processes would, share the limits.
+func TestRateLimiterFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "conversations", "ratelimit.json")
+	logger := slog.New(slog.DiscardHandler)
+	a := NewRateLimiter(2, 1000, path)
+	b := NewRateLimiter(2, 1000, path)
+
+	id, err := a.Wait(context.Background(), 100, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the estimate is replaced by the usage
+	if err := a.Record(id, 800); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Wait(ctx, 300, logger); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v waiting over the shared token limit, want a deadline error", err)
+	}
+	if _, err := b.Wait(context.Background(), 200, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.Wait(ctx, 0, logger); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v waiting over the shared request limit, want a deadline error", err)
+	}
+
+	// requests leave the window after a minute
+	a.now = func() time.Time { return time.Now().Add(rateWindow) }
+	if _, err := a.Wait(context.Background(), 900, logger); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAPIGetResponseRateLimit tests that each attempt of a request is
+// counted by the rate limiter with the tokens used.
+func TestAPIGetResponseRateLimit(t *testing.T) {
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "overloaded"}
+	fake := NewFakeBackend(FakeReply{Err: unavailable}, FakeReply{Text: "Fine."})
+	limiter := NewRateLimiter(10, 0, "")
+	_, err := APIGetResponseContext(context.Background(), fakeSettings(), nil, "How are you?",
+		WithBackend(fake), WithRateLimiter(limiter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(limiter.entries), 2; got != want {
+		t.Fatalf("got %d requests counted want %d", got, want)
+	}
+	if got, want := limiter.entries[0].Tokens, int32(0); got != want {
+		t.Errorf("failed request got %d tokens want %d", got, want)
+	}
+	if got, want := limiter.entries[1].Tokens, int32(4); got != want {
+		t.Errorf("request got %d tokens want %d", got, want)
+	}
+}
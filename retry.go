@@ -0,0 +1,195 @@
+package genact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+)
+
+// RetryPolicy describes how requests failing with transient errors,
+// such as 429 RESOURCE_EXHAUSTED or 503 overloaded responses from the
+// Gemini api, are retried.
+type RetryPolicy struct {
+	MaxAttempts  int           // total attempts, including the first
+	InitialDelay time.Duration // delay before the first retry
+	MaxDelay     time.Duration // maximum backoff delay
+	Multiplier   float64       // backoff multiplier for each attempt
+	Jitter       float64       // fraction of the delay to randomise (0-1)
+}
+
+// DefaultRetryPolicy is the retry policy used unless overridden by the
+// "retryMaxAttempts", "retryInitialDelay" and "retryMaxDelay" settings,
+// including when the Retry setting is the zero RetryPolicy. Setting
+// retryMaxAttempts to 1 disables retries.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  3,
+	InitialDelay: 2 * time.Second,
+	MaxDelay:     60 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+}
+
+// backoff returns the delay before the retry following attempt (where
+// the first attempt is 1). If the api provided a retry-after delay
+// longer than the computed backoff, that delay is honoured instead.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d = d * (1 - p.Jitter + 2*p.Jitter*rand.Float64())
+	}
+	delay := time.Duration(d)
+	if retryAfter > delay {
+		return retryAfter
+	}
+	return delay
+}
+
+// noRetryError marks an error which should not be retried, regardless
+// of its cause.
+type noRetryError struct {
+	err error
+}
+
+func (e noRetryError) Error() string {
+	return e.err.Error()
+}
+
+func (e noRetryError) Unwrap() error {
+	return e.err
+}
+
+// retryable reports whether err is a transient error worth retrying,
+// together with any retry delay requested by the api. Blocked prompts,
+// invalid keys, bad requests and context cancellation are fatal.
+func retryable(err error) (bool, time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) || errors.Is(err, ErrCassetteMismatch) {
+		return false, 0
+	}
+
+	var retryAfter time.Duration
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Header != nil {
+		retryAfter = retryAfterDelay(gerr.Header.Get("Retry-After"), time.Now())
+	}
+
+	if ae, ok := apierror.FromError(err); ok {
+		if ri := ae.Details().RetryInfo; ri != nil && ri.GetRetryDelay() != nil {
+			retryAfter = max(retryAfter, ri.GetRetryDelay().AsDuration())
+		}
+		switch ae.HTTPCode() {
+		case http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true, retryAfter
+		case -1: // not an http error
+		default:
+			return false, 0
+		}
+		switch ae.GRPCStatus().Code() {
+		case codes.ResourceExhausted, codes.Unavailable, codes.Internal:
+			return true, retryAfter
+		}
+		return false, 0
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true, 0
+	}
+	return false, 0
+}
+
+// retryAfterDelay returns the delay of a Retry-After header value,
+// which is either a number of seconds or an http date, from now.
+func retryAfterDelay(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// modelUnavailable reports whether err shows that the model of a
+// request is unavailable, overloaded or out of quota, or not found, so
+// that the request may fall back to another model.
+func modelUnavailable(err error) bool {
+	if ok, _ := retryable(err); ok {
+		var nerr net.Error
+		return !errors.As(err, &nerr)
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusNotFound
+	}
+	if ae, ok := apierror.FromError(err); ok {
+		return ae.HTTPCode() == http.StatusNotFound || ae.GRPCStatus().Code() == codes.NotFound
+	}
+	return false
+}
+
+// withRetry runs fn, retrying transient errors according to policy,
+// the DefaultRetryPolicy if policy is the zero value. Each failed
+// attempt is logged to logger.
+func withRetry(ctx context.Context, policy RetryPolicy, logger *slog.Logger, fn func() error) error {
+	if policy == (RetryPolicy{}) {
+		policy = DefaultRetryPolicy
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var nr noRetryError
+		if errors.As(err, &nr) {
+			return nr.err
+		}
+		ok, retryAfter := retryable(err)
+		if !ok {
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			if attempt > 1 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+		delay := policy.backoff(attempt, retryAfter)
+		logger.Warn("attempt failed, retrying",
+			"attempt", attempt,
+			"maxAttempts", policy.MaxAttempts,
+			"delay", delay.Round(time.Millisecond),
+			"error", err,
+		)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (retry abandoned: %w)", err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
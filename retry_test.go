@@ -0,0 +1,186 @@
+package genact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+)
+
+// TestRetryable tests the classification of retryable and fatal errors.
+func TestRetryable(t *testing.T) {
+
+	retryInfoBody := `{"error": {"code": 429, "message": "quota", "status": "RESOURCE_EXHAUSTED",
+		"details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "7s"}]}}`
+
+	tests := []struct {
+		desc       string
+		err        error
+		retry      bool
+		retryAfter time.Duration
+	}{
+		{
+			desc:  "resource exhausted",
+			err:   &googleapi.Error{Code: http.StatusTooManyRequests},
+			retry: true,
+		},
+		{
+			desc:  "overloaded",
+			err:   fmt.Errorf("failed to send message: %w", &googleapi.Error{Code: http.StatusServiceUnavailable}),
+			retry: true,
+		},
+		{
+			desc:       "retry-after header",
+			err:        &googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"30"}}},
+			retry:      true,
+			retryAfter: 30 * time.Second,
+		},
+		{
+			desc:       "retry info detail",
+			err:        &googleapi.Error{Code: http.StatusTooManyRequests, Body: retryInfoBody},
+			retry:      true,
+			retryAfter: 7 * time.Second,
+		},
+		{
+			desc:  "bad api key",
+			err:   &googleapi.Error{Code: http.StatusBadRequest, Message: "API key not valid"},
+			retry: false,
+		},
+		{
+			desc:  "permission denied",
+			err:   &googleapi.Error{Code: http.StatusForbidden},
+			retry: false,
+		},
+		{
+			desc:  "blocked prompt",
+			err:   &genai.BlockedError{PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockReasonSafety}},
+			retry: false,
+		},
+		{
+			desc:  "cancelled",
+			err:   fmt.Errorf("failed: %w", context.Canceled),
+			retry: false,
+		},
+		{
+			desc:  "other error",
+			err:   errors.New("received an empty response from the API"),
+			retry: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			retry, retryAfter := retryable(tt.err)
+			if got, want := retry, tt.retry; got != want {
+				t.Errorf("retry got %t want %t", got, want)
+			}
+			if got, want := retryAfter, tt.retryAfter; got != want {
+				t.Errorf("retryAfter got %s want %s", got, want)
+			}
+		})
+	}
+}
+
+// TestRetryAfterDelay tests parsing Retry-After header values given in
+// seconds or as an http date.
+func TestRetryAfterDelay(t *testing.T) {
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"-5", 0},
+		{"Tue, 01 Jul 2025 12:01:30 GMT", 90 * time.Second},
+		{"Tue, 01 Jul 2025 11:59:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := retryAfterDelay(tt.value, now); got != tt.want {
+			t.Errorf("%q got %s want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestBackoff tests exponential backoff, capping and retry-after.
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, InitialDelay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 2}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if got := p.backoff(i+1, 0); got != want {
+			t.Errorf("attempt %d got %s want %s", i+1, got, want)
+		}
+	}
+	if got, want := p.backoff(1, 30*time.Second), 30*time.Second; got != want {
+		t.Errorf("retry-after got %s want %s", got, want)
+	}
+	p.Jitter = 0.5
+	for range 20 {
+		if got := p.backoff(2, 0); got < time.Second || got > 3*time.Second {
+			t.Errorf("jittered backoff %s out of range", got)
+		}
+	}
+}
+
+// TestWithRetry tests the retry loop and the logging of failed
+// attempts.
+func TestWithRetry(t *testing.T) {
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 2}
+	overloaded := &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		desc     string
+		errs     []error
+		attempts int
+		isErr    bool
+	}{
+		{"succeeds first time", []error{nil}, 1, false},
+		{"succeeds after retries", []error{overloaded, overloaded, nil}, 3, false},
+		{"gives up", []error{overloaded, overloaded, overloaded, nil}, 3, true},
+		{"fatal error", []error{errors.New("fatal"), nil}, 1, true},
+		{"no retry error", []error{noRetryError{overloaded}, nil}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&logs, nil))
+			attempts := 0
+			err := withRetry(context.Background(), policy, logger, func() error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			if got, want := (err != nil), tt.isErr; got != want {
+				t.Errorf("error got %t want %t (%v)", got, want, err)
+			}
+			if got, want := attempts, tt.attempts; got != want {
+				t.Errorf("attempts got %d want %d", got, want)
+			}
+			logged := 0
+			dec := json.NewDecoder(&logs)
+			for dec.More() {
+				var record struct {
+					Attempt int `json:"attempt"`
+				}
+				if err := dec.Decode(&record); err != nil {
+					t.Fatal(err)
+				}
+				logged++
+				if got, want := record.Attempt, logged; got != want {
+					t.Errorf("logged attempt got %d want %d", got, want)
+				}
+			}
+			if got, want := logged, tt.attempts-1; got != want {
+				t.Errorf("logged %d failed attempts want %d", got, want)
+			}
+		})
+	}
+}
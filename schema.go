@@ -0,0 +1,300 @@
+package genact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// ErrInvalidJSON is returned when a JSON output response is not valid
+// JSON or does not match the response schema.
+var ErrInvalidJSON = errors.New("invalid JSON response")
+
+// maxSchemaProblems is the maximum number of validation problems
+// reported for a response.
+const maxSchemaProblems = 10
+
+// ResponseSchema is a JSON Schema describing the JSON output required
+// from the model. Only the subset of JSON Schema supported by the
+// Gemini api is accepted: the "type", "properties", "required", "items",
+// "enum", "format" and "description" keywords, together with
+// "minItems", "maxItems" and "additionalProperties", which are only
+// checked locally. A type of ["string", "null"] marks a nullable value.
+type ResponseSchema struct {
+	root *jsonSchema
+}
+
+// jsonSchema is a node of a JSON Schema.
+type jsonSchema struct {
+	Type                 any                    `json:"type"` // a type name or a list of type names
+	Description          string                 `json:"description"`
+	Format               string                 `json:"format"`
+	Enum                 []any                  `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Ref                  string                 `json:"$ref"`
+	AllOf                []any                  `json:"allOf"`
+	AnyOf                []any                  `json:"anyOf"`
+	OneOf                []any                  `json:"oneOf"`
+
+	typeName string // the type, other than null
+	nullable bool
+}
+
+// schemaTypes are the supported JSON Schema types and their genai
+// equivalents.
+var schemaTypes = map[string]genai.Type{
+	"string":  genai.TypeString,
+	"number":  genai.TypeNumber,
+	"integer": genai.TypeInteger,
+	"boolean": genai.TypeBoolean,
+	"array":   genai.TypeArray,
+	"object":  genai.TypeObject,
+}
+
+// LoadResponseSchema reads a JSON Schema file with ParseResponseSchema.
+func LoadResponseSchema(path string) (*ResponseSchema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read schema: %w", err)
+	}
+	rs, err := ParseResponseSchema(b)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s: %w", path, err)
+	}
+	return rs, nil
+}
+
+// ParseResponseSchema parses a JSON Schema, checking that it only uses
+// the supported keywords.
+func ParseResponseSchema(b []byte) (*ResponseSchema, error) {
+	var root jsonSchema
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, fmt.Errorf("could not parse schema: %w", err)
+	}
+	if err := root.resolve("$"); err != nil {
+		return nil, err
+	}
+	return &ResponseSchema{root: &root}, nil
+}
+
+// resolve checks a schema node and its children, determining the type
+// of each.
+func (s *jsonSchema) resolve(path string) error {
+	if s.Ref != "" || s.AllOf != nil || s.AnyOf != nil || s.OneOf != nil {
+		return fmt.Errorf("%s: $ref, allOf, anyOf and oneOf are not supported", path)
+	}
+	var types []string
+	switch t := s.Type.(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, x := range t {
+			name, ok := x.(string)
+			if !ok {
+				return fmt.Errorf("%s: invalid type %v", path, x)
+			}
+			types = append(types, name)
+		}
+	case nil:
+		return fmt.Errorf("%s: type not provided", path)
+	default:
+		return fmt.Errorf("%s: invalid type %v", path, t)
+	}
+	for _, t := range types {
+		switch _, ok := schemaTypes[t]; {
+		case t == "null":
+			s.nullable = true
+		case !ok:
+			return fmt.Errorf("%s: unsupported type %q", path, t)
+		case s.typeName != "":
+			return fmt.Errorf("%s: only one type other than null is supported", path)
+		default:
+			s.typeName = t
+		}
+	}
+	if s.typeName == "" {
+		return fmt.Errorf("%s: type other than null not provided", path)
+	}
+	for _, e := range s.Enum {
+		if _, ok := e.(string); !ok || s.typeName != "string" {
+			return fmt.Errorf("%s: only string enums are supported", path)
+		}
+	}
+	for _, r := range s.Required {
+		if _, ok := s.Properties[r]; !ok {
+			return fmt.Errorf("%s: required property %q not defined", path, r)
+		}
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		p := s.Properties[name]
+		if p == nil {
+			return fmt.Errorf("%s.%s: invalid property schema", path, name)
+		}
+		if err := p.resolve(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.resolve(path + "[]")
+	}
+	return nil
+}
+
+// genai returns the schema as a genai.Schema for the ResponseSchema
+// generation setting.
+func (s *jsonSchema) genai() *genai.Schema {
+	if s == nil {
+		return nil
+	}
+	gs := &genai.Schema{
+		Type:        schemaTypes[s.typeName],
+		Format:      s.Format,
+		Description: s.Description,
+		Nullable:    s.nullable,
+		Items:       s.Items.genai(),
+		Required:    s.Required,
+	}
+	for _, e := range s.Enum {
+		gs.Enum = append(gs.Enum, e.(string))
+	}
+	if len(gs.Enum) > 0 {
+		gs.Format = "enum"
+	}
+	if len(s.Properties) > 0 {
+		gs.Properties = map[string]*genai.Schema{}
+		for name, p := range s.Properties {
+			gs.Properties[name] = p.genai()
+		}
+	}
+	return gs
+}
+
+// Validate checks that data is a single JSON value matching the schema,
+// returning an ErrInvalidJSON error describing the problems found
+// otherwise. A nil ResponseSchema only checks that data is valid JSON.
+func (rs *ResponseSchema) Validate(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("%w: unexpected data after the JSON value", ErrInvalidJSON)
+	}
+	if rs == nil {
+		return nil
+	}
+	problems := []string{}
+	rs.root.validate("$", v, &problems)
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > maxSchemaProblems {
+		problems = append(problems[:maxSchemaProblems], fmt.Sprintf("and %d more", len(problems)-maxSchemaProblems))
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidJSON, strings.Join(problems, "; "))
+}
+
+// jsonTypeName returns the JSON Schema type name of a decoded value.
+func jsonTypeName(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// validate validates a decoded value against the schema node at path,
+// adding any problems found.
+func (s *jsonSchema) validate(path string, v any, problems *[]string) {
+	add := func(format string, a ...any) {
+		*problems = append(*problems, path+": "+fmt.Sprintf(format, a...))
+	}
+	got := jsonTypeName(v)
+	switch {
+	case got == "null" && s.nullable:
+		return
+	case got == s.typeName, got == "integer" && s.typeName == "number":
+	default:
+		add("expected %s, got %s", s.typeName, got)
+		return
+	}
+
+	switch x := v.(type) {
+	case string:
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, any(x)) {
+			add("value %q is not one of the enum values", x)
+		}
+	case []any:
+		if s.MinItems != nil && len(x) < *s.MinItems {
+			add("expected at least %d items, got %d", *s.MinItems, len(x))
+		}
+		if s.MaxItems != nil && len(x) > *s.MaxItems {
+			add("expected at most %d items, got %d", *s.MaxItems, len(x))
+		}
+		if s.Items != nil {
+			for i, item := range x {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, problems)
+			}
+		}
+	case map[string]any:
+		for _, r := range s.Required {
+			if _, ok := x[r]; !ok {
+				add("required property %q missing", r)
+			}
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			p, ok := s.Properties[name]
+			switch {
+			case ok:
+				p.validate(path+"."+name, x[name], problems)
+			case s.AdditionalProperties != nil && !*s.AdditionalProperties:
+				add("unexpected property %q", name)
+			}
+		}
+	}
+}
+
+// genaiSchema returns the genai.Schema for a response schema, or nil.
+func (rs *ResponseSchema) genaiSchema() *genai.Schema {
+	if rs == nil {
+		return nil
+	}
+	return rs.root.genai()
+}
@@ -0,0 +1,195 @@
+package genact
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "review",
+  "type": "object",
+  "properties": {
+    "summary": {"type": "string", "description": "a one line summary"},
+    "severity": {"type": "string", "enum": ["low", "medium", "high"]},
+    "score": {"type": "number"},
+    "issues": {
+      "type": "array",
+      "minItems": 1,
+      "items": {
+        "type": "object",
+        "properties": {
+          "line": {"type": "integer"},
+          "note": {"type": ["string", "null"]}
+        },
+        "required": ["line"],
+        "additionalProperties": false
+      }
+    }
+  },
+  "required": ["summary", "issues"]
+}`
+
+// TestParseResponseSchema tests parsing JSON Schemas, including the
+// refusal of unsupported keywords and types.
+func TestParseResponseSchema(t *testing.T) {
+
+	tests := []struct {
+		desc    string
+		schema  string
+		errText string
+	}{
+		{"review schema", testSchema, ""},
+		{"not json", `{"type": `, "could not parse schema"},
+		{"no type", `{"properties": {}}`, "$: type not provided"},
+		{"unsupported type", `{"type": "date"}`, `$: unsupported type "date"`},
+		{"two types", `{"type": ["string", "integer"]}`, "only one type other than null"},
+		{"only null", `{"type": "null"}`, "type other than null not provided"},
+		{"ref", `{"type": "object", "properties": {"a": {"$ref": "#/$defs/a"}}}`, "$.a: $ref, allOf, anyOf and oneOf are not supported"},
+		{"integer enum", `{"type": "integer", "enum": [1, 2]}`, "only string enums"},
+		{"undefined required", `{"type": "object", "required": ["a"]}`, `required property "a" not defined`},
+		{"bad item", `{"type": "array", "items": {"type": "tuple"}}`, `$[]: unsupported type "tuple"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := ParseResponseSchema([]byte(tt.schema))
+			if tt.errText == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("got error %v want %q", err, tt.errText)
+			}
+		})
+	}
+}
+
+// TestResponseSchemaGenai tests the conversion of a schema to the
+// genai.Schema sent with a request.
+func TestResponseSchemaGenai(t *testing.T) {
+
+	rs, err := ParseResponseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"summary":  {Type: genai.TypeString, Description: "a one line summary"},
+			"severity": {Type: genai.TypeString, Format: "enum", Enum: []string{"low", "medium", "high"}},
+			"score":    {Type: genai.TypeNumber},
+			"issues": {
+				Type: genai.TypeArray,
+				Items: &genai.Schema{
+					Type: genai.TypeObject,
+					Properties: map[string]*genai.Schema{
+						"line": {Type: genai.TypeInteger},
+						"note": {Type: genai.TypeString, Nullable: true},
+					},
+					Required: []string{"line"},
+				},
+			},
+		},
+		Required: []string{"summary", "issues"},
+	}
+	if diff := cmp.Diff(want, rs.genaiSchema()); diff != "" {
+		t.Errorf("schema mismatch (-want +got):\n%s", diff)
+	}
+	var none *ResponseSchema
+	if none.genaiSchema() != nil {
+		t.Error("expected no genai schema from a nil schema")
+	}
+}
+
+// TestResponseSchemaValidate tests validating JSON responses against a
+// schema.
+func TestResponseSchemaValidate(t *testing.T) {
+
+	rs, err := ParseResponseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc    string
+		schema  *ResponseSchema
+		data    string
+		errText string
+	}{
+		{
+			desc:   "valid",
+			schema: rs,
+			data:   `{"summary": "ok", "severity": "low", "score": 7, "issues": [{"line": 3, "note": null}]}`,
+		},
+		{
+			desc:   "valid without schema",
+			schema: nil,
+			data:   `[1, 2, 3]`,
+		},
+		{
+			desc:    "not json",
+			schema:  nil,
+			data:    "```json\n{}\n```",
+			errText: "invalid JSON response: invalid character",
+		},
+		{
+			desc:    "trailing data",
+			schema:  rs,
+			data:    `{"summary": "ok", "issues": [{"line": 1}]} {}`,
+			errText: "unexpected data after the JSON value",
+		},
+		{
+			desc:    "missing required",
+			schema:  rs,
+			data:    `{"issues": [{"line": 1}]}`,
+			errText: `$: required property "summary" missing`,
+		},
+		{
+			desc:    "wrong types",
+			schema:  rs,
+			data:    `{"summary": 1, "score": "high", "issues": [{"line": 1.5}]}`,
+			errText: "$.issues[0].line: expected integer, got number; $.score: expected number, got string; $.summary: expected string, got integer",
+		},
+		{
+			desc:    "enum",
+			schema:  rs,
+			data:    `{"summary": "ok", "severity": "urgent", "issues": [{"line": 1}]}`,
+			errText: `$.severity: value "urgent" is not one of the enum values`,
+		},
+		{
+			desc:    "min items",
+			schema:  rs,
+			data:    `{"summary": "ok", "issues": []}`,
+			errText: "$.issues: expected at least 1 items, got 0",
+		},
+		{
+			desc:    "additional properties",
+			schema:  rs,
+			data:    `{"summary": "ok", "issues": [{"line": 1, "column": 2}]}`,
+			errText: `$.issues[0]: unexpected property "column"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := tt.schema.Validate([]byte(tt.data))
+			if tt.errText == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidJSON) {
+				t.Errorf("expected ErrInvalidJSON, got %v", err)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errText) {
+				t.Errorf("got error %v want %q", err, tt.errText)
+			}
+		})
+	}
+}
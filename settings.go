@@ -0,0 +1,461 @@
+package genact
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Settings are the settings used for interacting with the Gemini api,
+// normally loaded from a yaml settings file using ParseSettings. The
+// generation settings are optional; nil values leave the model
+// defaults in place.
+type Settings struct {
+	APIKey         string
+	ModelName      string // a model name or one of the ModelAliases
+	Endpoint       string // optional api endpoint, such as a local stand-in server
+	Backend        string // BackendGemini (the default), BackendOpenAI or BackendFake
+	Cassette       string // optional cassette file recording or replaying requests
+	CassetteMode   string // CassetteRecord or CassetteReplay, the default
+	Logging        bool
+	RequestTimeout time.Duration // zero means no timeout
+	Retry          RetryPolicy
+
+	// SystemInstruction is an optional system prompt for the model.
+	SystemInstruction string
+
+	// Generation settings.
+	Temperature     *float32
+	TopP            *float32
+	TopK            *int32
+	MaxOutputTokens *int32
+	CandidateCount  *int32
+	StopSequences   []string
+	ThinkingBudget  *int32 // -1 is dynamic, 0 disables thinking
+
+	// IncludeThoughts requests thought summaries from models supporting
+	// thinking. Thoughts are returned separately from the response and
+	// are only kept in the history if KeepThoughts is set.
+	IncludeThoughts bool
+	KeepThoughts    bool
+
+	// Preflight, which is off by default, counts the tokens of each
+	// request before it is sent, checking them against the context limit
+	// of the model, or ContextLimit if set, and the TokenBudget, if any.
+	// OverBudget is one of BudgetRefuse, BudgetWarn or BudgetPrompt.
+	Preflight    bool
+	ContextLimit int32
+	TokenBudget  int32
+	OverBudget   string
+
+	// Cache enables Gemini context caching of the system instruction and
+	// history, which is reused by later requests in a chat until it
+	// expires after CacheTTL or the history no longer matches. Requests
+	// with fewer tokens than CacheMinTokens, by the pre-flight count or,
+	// without one, an estimate, are not cached.
+	Cache          bool
+	CacheTTL       time.Duration
+	CacheMinTokens int32
+
+	// UploadThreshold is the attachment size in bytes above which
+	// attachments are uploaded with the File API rather than being sent
+	// inline with the request.
+	UploadThreshold int
+
+	// ToolCommands are the commands which the run_command built-in tool
+	// may run, with any arguments the model provides. MaxToolRounds
+	// limits the number of rounds of function calls made by the model
+	// in a single request; zero uses defaultMaxToolRounds.
+	ToolCommands  []string
+	MaxToolRounds int
+
+	// JSONReasks is the number of times the model is asked again for a
+	// JSON output response which fails validation against the response
+	// schema. Zero disables re-asking.
+	JSONReasks int
+
+	// MaxContinuations is the number of times a response stopped at the
+	// output token limit is continued by asking the model to carry on.
+	// The parts are joined into a single response. Zero disables
+	// continuing.
+	MaxContinuations int
+
+	// RequestsPerMinute and TokensPerMinute limit the requests sent to
+	// the api, zero meaning no limit. See RateLimiter.
+	RequestsPerMinute int
+	TokensPerMinute   int
+
+	// ModelAliases are names, such as "fast" or "deep", for models,
+	// which may be used in place of the model name in ModelName and
+	// FallbackModels. FallbackModels are the models, in order, to which
+	// a request falls back when the model is unavailable, overloaded or
+	// out of quota once retries are exhausted.
+	ModelAliases   map[string]string
+	FallbackModels []string
+
+	// Pricing is the table of model prices used to estimate the cost of
+	// requests, the DefaultPricing with the models of the "pricing"
+	// setting replaced or added. CostCapChat and CostCapDay are the
+	// costs in US dollars of a chat and of a day at which requests are
+	// refused, zero meaning no cap. See WithSpending.
+	Pricing     Pricing
+	CostCapChat float64
+	CostCapDay  float64
+}
+
+// settingFuncs maps each settings key to a function setting the
+// relevant Settings field from a yaml or string value. The keys are the
+// same as those used by earlier versions of genact, which used a
+// map[string]string for settings.
+var settingFuncs = map[string]func(s *Settings, v any) error{
+	"apiKey":            func(s *Settings, v any) error { return setString(&s.APIKey, v) },
+	"modelName":         func(s *Settings, v any) error { return setString(&s.ModelName, v) },
+	"endpoint":          func(s *Settings, v any) error { return setString(&s.Endpoint, v) },
+	"backend":           func(s *Settings, v any) error { return setString(&s.Backend, v) },
+	"cassette":          func(s *Settings, v any) error { return setString(&s.Cassette, v) },
+	"cassetteMode":      func(s *Settings, v any) error { return setString(&s.CassetteMode, v) },
+	"logging":           func(s *Settings, v any) error { return setBool(&s.Logging, v) },
+	"outputFile":        func(s *Settings, v any) error { return nil }, // unused, kept for compatibility
+	"requestTimeout":    func(s *Settings, v any) error { return setDuration(&s.RequestTimeout, v) },
+	"retryMaxAttempts":  func(s *Settings, v any) error { return setInt(&s.Retry.MaxAttempts, v) },
+	"retryInitialDelay": func(s *Settings, v any) error { return setDuration(&s.Retry.InitialDelay, v) },
+	"retryMaxDelay":     func(s *Settings, v any) error { return setDuration(&s.Retry.MaxDelay, v) },
+	"temperature":       func(s *Settings, v any) error { return setFloat32Ptr(&s.Temperature, v) },
+	"topP":              func(s *Settings, v any) error { return setFloat32Ptr(&s.TopP, v) },
+	"topK":              func(s *Settings, v any) error { return setInt32Ptr(&s.TopK, v) },
+	"maxOutputTokens":   func(s *Settings, v any) error { return setInt32Ptr(&s.MaxOutputTokens, v) },
+	"candidateCount":    func(s *Settings, v any) error { return setInt32Ptr(&s.CandidateCount, v) },
+	"stopSequences":     func(s *Settings, v any) error { return setStrings(&s.StopSequences, v) },
+	"systemInstruction": func(s *Settings, v any) error { return setString(&s.SystemInstruction, v) },
+	"thinkingBudget":    func(s *Settings, v any) error { return setInt32Ptr(&s.ThinkingBudget, v) },
+	"includeThoughts":   func(s *Settings, v any) error { return setBool(&s.IncludeThoughts, v) },
+	"keepThoughts":      func(s *Settings, v any) error { return setBool(&s.KeepThoughts, v) },
+	"preflight":         func(s *Settings, v any) error { return setBool(&s.Preflight, v) },
+	"contextLimit":      func(s *Settings, v any) error { return setInt32(&s.ContextLimit, v) },
+	"tokenBudget":       func(s *Settings, v any) error { return setInt32(&s.TokenBudget, v) },
+	"overBudget":        func(s *Settings, v any) error { return setString(&s.OverBudget, v) },
+	"cache":             func(s *Settings, v any) error { return setBool(&s.Cache, v) },
+	"cacheTTL":          func(s *Settings, v any) error { return setDuration(&s.CacheTTL, v) },
+	"cacheMinTokens":    func(s *Settings, v any) error { return setInt32(&s.CacheMinTokens, v) },
+	"uploadThreshold":   func(s *Settings, v any) error { return setInt(&s.UploadThreshold, v) },
+	"toolCommands":      func(s *Settings, v any) error { return setStrings(&s.ToolCommands, v) },
+	"maxToolRounds":     func(s *Settings, v any) error { return setInt(&s.MaxToolRounds, v) },
+	"jsonReasks":        func(s *Settings, v any) error { return setInt(&s.JSONReasks, v) },
+	"maxContinuations":  func(s *Settings, v any) error { return setInt(&s.MaxContinuations, v) },
+	"requestsPerMinute": func(s *Settings, v any) error { return setInt(&s.RequestsPerMinute, v) },
+	"tokensPerMinute":   func(s *Settings, v any) error { return setInt(&s.TokensPerMinute, v) },
+	"modelAliases":      func(s *Settings, v any) error { return setStringMap(&s.ModelAliases, v) },
+	"fallbackModels":    func(s *Settings, v any) error { return setStrings(&s.FallbackModels, v) },
+	"pricing":           func(s *Settings, v any) error { return setPricing(&s.Pricing, v) },
+	"costCapChat":       func(s *Settings, v any) error { return setFloat64(&s.CostCapChat, v) },
+	"costCapDay":        func(s *Settings, v any) error { return setFloat64(&s.CostCapDay, v) },
+}
+
+func setString(f *string, v any) error {
+	switch v.(type) {
+	case []any, map[string]any, nil:
+		return fmt.Errorf("expected a string, got %v", v)
+	}
+	*f = fmt.Sprint(v)
+	return nil
+}
+
+func setBool(f *bool, v any) error {
+	b, err := strconv.ParseBool(fmt.Sprint(v))
+	if err != nil {
+		return fmt.Errorf("expected true or false, got %v", v)
+	}
+	*f = b
+	return nil
+}
+
+func setDuration(f *time.Duration, v any) error {
+	d, err := time.ParseDuration(fmt.Sprint(v))
+	if err != nil {
+		return fmt.Errorf("expected a duration such as \"90s\" or \"10m\", got %v", v)
+	}
+	*f = d
+	return nil
+}
+
+func setInt(f *int, v any) error {
+	i, err := strconv.Atoi(fmt.Sprint(v))
+	if err != nil {
+		return fmt.Errorf("expected an integer, got %v", v)
+	}
+	*f = i
+	return nil
+}
+
+func setInt32(f *int32, v any) error {
+	i, err := strconv.ParseInt(fmt.Sprint(v), 10, 32)
+	if err != nil {
+		return fmt.Errorf("expected an integer, got %v", v)
+	}
+	*f = int32(i)
+	return nil
+}
+
+func setInt32Ptr(f **int32, v any) error {
+	i, err := strconv.ParseInt(fmt.Sprint(v), 10, 32)
+	if err != nil {
+		return fmt.Errorf("expected an integer, got %v", v)
+	}
+	*f = genai.Ptr(int32(i))
+	return nil
+}
+
+func setFloat32Ptr(f **float32, v any) error {
+	x, err := strconv.ParseFloat(fmt.Sprint(v), 32)
+	if err != nil {
+		return fmt.Errorf("expected a number, got %v", v)
+	}
+	*f = genai.Ptr(float32(x))
+	return nil
+}
+
+func setFloat64(f *float64, v any) error {
+	x, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+	if err != nil {
+		return fmt.Errorf("expected a number, got %v", v)
+	}
+	*f = x
+	return nil
+}
+
+// setPricing adds the model prices of v, a map of model names to
+// prices, to those of f.
+func setPricing(f *Pricing, v any) error {
+	if _, ok := v.(map[string]any); !ok {
+		return fmt.Errorf("expected a map of model names to prices, got %v", v)
+	}
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p, err := ParsePricing(b)
+	if err != nil {
+		return err
+	}
+	if *f == nil {
+		*f = Pricing{}
+	}
+	maps.Copy(*f, p)
+	return nil
+}
+
+func setStrings(f *[]string, v any) error {
+	switch vs := v.(type) {
+	case string:
+		*f = []string{vs}
+	case []any:
+		*f = nil
+		for _, x := range vs {
+			s, ok := x.(string)
+			if !ok {
+				return fmt.Errorf("expected a list of strings, got %v", x)
+			}
+			*f = append(*f, s)
+		}
+	default:
+		return fmt.Errorf("expected a list of strings, got %v", v)
+	}
+	return nil
+}
+
+func setStringMap(f *map[string]string, v any) error {
+	vm, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("expected a map of names to strings, got %v", v)
+	}
+	*f = make(map[string]string, len(vm))
+	for k, x := range vm {
+		s, ok := x.(string)
+		if !ok {
+			return fmt.Errorf("expected a string for %s, got %v", k, x)
+		}
+		(*f)[k] = s
+	}
+	return nil
+}
+
+// defaultSettings returns the settings used for keys which are not
+// provided.
+func defaultSettings() Settings {
+	return Settings{
+		Logging:         true,
+		Retry:           DefaultRetryPolicy,
+		IncludeThoughts: true,
+		OverBudget:      BudgetRefuse,
+		CacheTTL:        time.Hour,
+		CacheMinTokens:  4096,
+		UploadThreshold: 8 << 20,
+		MaxToolRounds:   defaultMaxToolRounds,
+		CassetteMode:    CassetteReplay,
+		Pricing:         DefaultPricing(),
+	}
+}
+
+// NewSettings makes Settings from a map of settings keys to values,
+// such as that decoded from a yaml settings file. Values may be native
+// yaml types or strings. Unknown keys, invalid values and settings
+// failing validation are reported as errors.
+func NewSettings(m map[string]any) (*Settings, error) {
+	settings := defaultSettings()
+	var errs []error
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		f, ok := settingFuncs[k]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown setting %q", k))
+			continue
+		}
+		if err := f(&settings, m[k]); err != nil {
+			errs = append(errs, fmt.Errorf("setting %s: %w", k, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SettingsFromMap makes Settings from a map of string settings, as used
+// by earlier versions of genact.
+func SettingsFromMap(m map[string]string) (*Settings, error) {
+	am := make(map[string]any, len(m))
+	for k, v := range m {
+		am[k] = v
+	}
+	return NewSettings(am)
+}
+
+// ParseSettings parses yaml settings, such as those in a settings.yaml
+// file.
+func ParseSettings(yamlBytes []byte) (*Settings, error) {
+	var m map[string]any
+	if err := yaml.Unmarshal(yamlBytes, &m); err != nil {
+		return nil, fmt.Errorf("could not parse settings: %w", err)
+	}
+	if len(m) == 0 {
+		return nil, errors.New("no settings found")
+	}
+	return NewSettings(m)
+}
+
+// Validate checks that the required settings are present and that the
+// settings values are in range.
+func (s *Settings) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, a ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, a...))
+		}
+	}
+	check(slices.Contains([]string{"", BackendGemini, BackendOpenAI, BackendFake}, s.Backend),
+		"backend %q must be one of %s, %s or %s", s.Backend, BackendGemini, BackendOpenAI, BackendFake)
+	replay := s.Cassette != "" && s.CassetteMode == CassetteReplay
+	check(s.APIKey != "" || s.Backend == BackendOpenAI || s.Backend == BackendFake || replay, "apiKey not provided")
+	check(s.Cassette == "" || s.CassetteMode == CassetteRecord || s.CassetteMode == CassetteReplay,
+		"cassetteMode %q must be %s or %s", s.CassetteMode, CassetteRecord, CassetteReplay)
+	check(s.Endpoint != "" || s.Backend != BackendOpenAI, "endpoint not provided for the %s backend", BackendOpenAI)
+	check(s.ModelName != "", "modelName not provided")
+	check(s.RequestTimeout >= 0, "requestTimeout %s cannot be negative", s.RequestTimeout)
+	if s.Retry != (RetryPolicy{}) { // a zero policy is the DefaultRetryPolicy
+		check(s.Retry.MaxAttempts >= 1, "retryMaxAttempts %d must be at least 1", s.Retry.MaxAttempts)
+		check(s.Retry.InitialDelay >= 0, "retryInitialDelay %s cannot be negative", s.Retry.InitialDelay)
+		check(s.Retry.MaxDelay >= s.Retry.InitialDelay, "retryMaxDelay %s is less than retryInitialDelay %s", s.Retry.MaxDelay, s.Retry.InitialDelay)
+	}
+	if s.Temperature != nil {
+		check(*s.Temperature >= 0 && *s.Temperature <= 2, "temperature %g must be between 0 and 2", *s.Temperature)
+	}
+	if s.TopP != nil {
+		check(*s.TopP >= 0 && *s.TopP <= 1, "topP %g must be between 0 and 1", *s.TopP)
+	}
+	if s.TopK != nil {
+		check(*s.TopK >= 1, "topK %d must be at least 1", *s.TopK)
+	}
+	if s.MaxOutputTokens != nil {
+		check(*s.MaxOutputTokens >= 1, "maxOutputTokens %d must be at least 1", *s.MaxOutputTokens)
+	}
+	if s.CandidateCount != nil {
+		check(*s.CandidateCount >= 1 && *s.CandidateCount <= 8, "candidateCount %d must be between 1 and 8", *s.CandidateCount)
+	}
+	if s.ThinkingBudget != nil {
+		check(*s.ThinkingBudget >= -1, "thinkingBudget %d must be -1 (dynamic), 0 (off) or a positive number of tokens", *s.ThinkingBudget)
+	}
+	check(s.ContextLimit >= 0, "contextLimit %d cannot be negative", s.ContextLimit)
+	check(s.TokenBudget >= 0, "tokenBudget %d cannot be negative", s.TokenBudget)
+	check(slices.Contains([]string{"", BudgetRefuse, BudgetWarn, BudgetPrompt}, s.OverBudget),
+		"overBudget %q must be one of %s, %s or %s", s.OverBudget, BudgetRefuse, BudgetWarn, BudgetPrompt)
+	check(!s.Cache || s.CacheTTL >= time.Minute, "cacheTTL %s must be at least 1m", s.CacheTTL)
+	check(s.CacheMinTokens >= 0, "cacheMinTokens %d cannot be negative", s.CacheMinTokens)
+	check(s.UploadThreshold >= 0 && s.UploadThreshold <= MaxInlineSize, "uploadThreshold %d must be between 0 and %d", s.UploadThreshold, MaxInlineSize)
+	check(s.MaxToolRounds >= 0, "maxToolRounds %d cannot be negative", s.MaxToolRounds)
+	check(s.JSONReasks >= 0, "jsonReasks %d cannot be negative", s.JSONReasks)
+	check(s.MaxContinuations >= 0, "maxContinuations %d cannot be negative", s.MaxContinuations)
+	check(s.RequestsPerMinute >= 0, "requestsPerMinute %d cannot be negative", s.RequestsPerMinute)
+	check(s.TokensPerMinute >= 0, "tokensPerMinute %d cannot be negative", s.TokensPerMinute)
+	for alias, model := range s.ModelAliases {
+		check(model != "", "modelAliases %s has no model name", alias)
+	}
+	for _, model := range s.FallbackModels {
+		check(model != "", "fallbackModels cannot include an empty model name")
+	}
+	check(s.CostCapChat >= 0, "costCapChat %g cannot be negative", s.CostCapChat)
+	check(s.CostCapDay >= 0, "costCapDay %g cannot be negative", s.CostCapDay)
+	return errors.Join(errs...)
+}
+
+// Model returns the name of the model requested, resolving an alias.
+func (s *Settings) Model() string {
+	return s.resolveModel(s.ModelName)
+}
+
+// Models returns the model requested followed by the fallback models,
+// with aliases resolved and without repeats.
+func (s *Settings) Models() []string {
+	models := []string{s.Model()}
+	for _, m := range s.FallbackModels {
+		if m = s.resolveModel(m); !slices.Contains(models, m) {
+			models = append(models, m)
+		}
+	}
+	return models
+}
+
+// resolveModel returns the model name for name, which may be one of
+// the ModelAliases.
+func (s *Settings) resolveModel(name string) string {
+	if model, ok := s.ModelAliases[name]; ok {
+		return model
+	}
+	return name
+}
+
+// GenerationConfig maps the generation settings onto a
+// genai.GenerationConfig. The thinking budget is not supported by the
+// genai package and is instead set on the wire (see geminiTransport).
+func (s *Settings) GenerationConfig() genai.GenerationConfig {
+	return genai.GenerationConfig{
+		CandidateCount:  s.CandidateCount,
+		StopSequences:   s.StopSequences,
+		MaxOutputTokens: s.MaxOutputTokens,
+		Temperature:     s.Temperature,
+		TopP:            s.TopP,
+		TopK:            s.TopK,
+	}
+}
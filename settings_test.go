@@ -0,0 +1,359 @@
+package genact
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+)
+
+// withDefaults returns the default settings modified by f.
+func withDefaults(f func(s *Settings)) *Settings {
+	s := defaultSettings()
+	f(&s)
+	return &s
+}
+
+// TestParseSettings tests parsing yaml settings into Settings.
+func TestParseSettings(t *testing.T) {
+
+	tests := []struct {
+		desc     string
+		yaml     string
+		settings *Settings
+		errText  string
+	}{
+		{
+			desc: "string map settings",
+			yaml: `
+outputFile : "output.txt"
+modelName  : "gemini-2.5-pro"
+apiKey     : "xxxxxxxxx"
+logging    : "false"
+requestTimeout : "10m"
+retryMaxAttempts : "5"
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "xxxxxxxxx"
+				s.ModelName = "gemini-2.5-pro"
+				s.Logging = false
+				s.RequestTimeout = 10 * time.Minute
+				s.Retry.MaxAttempts = 5
+			}),
+		},
+		{
+			desc: "generation settings",
+			yaml: `
+modelName       : gemini-2.5-pro
+apiKey          : xxxxxxxxx
+temperature     : 0.5
+topP            : 0.9
+topK            : 40
+maxOutputTokens : 8192
+candidateCount  : 1
+stopSequences   : ["END", "STOP"]
+thinkingBudget  : -1
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "xxxxxxxxx"
+				s.ModelName = "gemini-2.5-pro"
+				s.Temperature = genai.Ptr[float32](0.5)
+				s.TopP = genai.Ptr[float32](0.9)
+				s.TopK = genai.Ptr[int32](40)
+				s.MaxOutputTokens = genai.Ptr[int32](8192)
+				s.CandidateCount = genai.Ptr[int32](1)
+				s.StopSequences = []string{"END", "STOP"}
+				s.ThinkingBudget = genai.Ptr[int32](-1)
+			}),
+		},
+		{
+			desc: "pre-flight settings",
+			yaml: `
+modelName    : gemini-2.5-pro
+apiKey       : xxxxxxxxx
+contextLimit : 1048576
+tokenBudget  : 500000
+overBudget   : prompt
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "xxxxxxxxx"
+				s.ModelName = "gemini-2.5-pro"
+				s.ContextLimit = 1048576
+				s.TokenBudget = 500000
+				s.OverBudget = BudgetPrompt
+			}),
+		},
+		{
+			desc: "cache settings",
+			yaml: `
+modelName      : gemini-2.5-pro
+apiKey         : xxxxxxxxx
+cache          : true
+cacheTTL       : 30m
+cacheMinTokens : 32768
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "xxxxxxxxx"
+				s.ModelName = "gemini-2.5-pro"
+				s.Cache = true
+				s.CacheTTL = 30 * time.Minute
+				s.CacheMinTokens = 32768
+			}),
+		},
+		{
+			desc: "upload settings",
+			yaml: `
+modelName       : gemini-2.5-pro
+apiKey          : xxxxxxxxx
+endpoint        : http://127.0.0.1:8080
+uploadThreshold : 1048576
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "xxxxxxxxx"
+				s.ModelName = "gemini-2.5-pro"
+				s.Endpoint = "http://127.0.0.1:8080"
+				s.UploadThreshold = 1 << 20
+			}),
+		},
+		{
+			desc: "tool and json settings",
+			yaml: `
+modelName     : gemini-2.5-pro
+apiKey        : xxxxxxxxx
+toolCommands  : ["go", "git"]
+maxToolRounds : 5
+jsonReasks    : 2
+maxContinuations : 3
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "xxxxxxxxx"
+				s.ModelName = "gemini-2.5-pro"
+				s.ToolCommands = []string{"go", "git"}
+				s.MaxToolRounds = 5
+				s.JSONReasks = 2
+				s.MaxContinuations = 3
+			}),
+		},
+		{
+			desc: "openai backend",
+			yaml: `
+modelName : qwen3:8b
+backend   : openai
+endpoint  : http://localhost:11434/v1
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.ModelName = "qwen3:8b"
+				s.Backend = BackendOpenAI
+				s.Endpoint = "http://localhost:11434/v1"
+			}),
+		},
+		{
+			desc: "cassette replay without api key",
+			yaml: `
+modelName    : gemini-2.5-pro
+cassette     : testdata/cassette.json
+cassetteMode : replay
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.ModelName = "gemini-2.5-pro"
+				s.Cassette = "testdata/cassette.json"
+			}),
+		},
+		{
+			desc:    "empty",
+			yaml:    ``,
+			errText: "no settings found",
+		},
+		{
+			desc:    "unknown key",
+			yaml:    "modelName: m\napiKey: k\ntemprature: 0.5",
+			errText: `unknown setting "temprature"`,
+		},
+		{
+			desc:    "bad value",
+			yaml:    "modelName: m\napiKey: k\ntopK: many",
+			errText: "setting topK: expected an integer, got many",
+		},
+		{
+			desc:    "bad duration",
+			yaml:    "modelName: m\napiKey: k\nrequestTimeout: ten minutes",
+			errText: "setting requestTimeout: expected a duration",
+		},
+		{
+			desc:    "out of range",
+			yaml:    "modelName: m\napiKey: k\ntemperature: 3",
+			errText: "temperature 3 must be between 0 and 2",
+		},
+		{
+			desc:    "missing api key",
+			yaml:    "modelName: m",
+			errText: "apiKey not provided",
+		},
+		{
+			desc:    "negative timeout",
+			yaml:    "modelName: m\napiKey: k\nrequestTimeout: -1m",
+			errText: "requestTimeout -1m0s cannot be negative",
+		},
+		{
+			desc:    "bad retry delays",
+			yaml:    "modelName: m\napiKey: k\nretryInitialDelay: 20s\nretryMaxDelay: 10s",
+			errText: "retryMaxDelay 10s is less than retryInitialDelay 20s",
+		},
+		{
+			desc:    "bad over budget action",
+			yaml:    "modelName: m\napiKey: k\noverBudget: ignore",
+			errText: `overBudget "ignore" must be one of refuse, warn or prompt`,
+		},
+		{
+			desc:    "short cache ttl",
+			yaml:    "modelName: m\napiKey: k\ncache: true\ncacheTTL: 10s",
+			errText: "cacheTTL 10s must be at least 1m",
+		},
+		{
+			desc:    "negative json reasks",
+			yaml:    "modelName: m\napiKey: k\njsonReasks: -1",
+			errText: "jsonReasks -1 cannot be negative",
+		},
+		{
+			desc:    "large upload threshold",
+			yaml:    "modelName: m\napiKey: k\nuploadThreshold: 30000000",
+			errText: "uploadThreshold 30000000 must be between 0 and 20971520",
+		},
+		{
+			desc:    "unknown backend",
+			yaml:    "modelName: m\napiKey: k\nbackend: claude",
+			errText: `backend "claude" must be one of gemini, openai or fake`,
+		},
+		{
+			desc:    "openai backend without endpoint",
+			yaml:    "modelName: m\nbackend: openai",
+			errText: "endpoint not provided for the openai backend",
+		},
+		{
+			desc:    "bad cassette mode",
+			yaml:    "modelName: m\napiKey: k\ncassette: c.json\ncassetteMode: rewind",
+			errText: `cassetteMode "rewind" must be record or replay`,
+		},
+		{
+			desc: "model aliases and fallbacks",
+			yaml: `
+modelName      : deep
+apiKey         : k
+modelAliases   : {fast: gemini-2.5-flash, deep: gemini-2.5-pro}
+fallbackModels : [fast, gemini-2.0-flash]
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "k"
+				s.ModelName = "deep"
+				s.ModelAliases = map[string]string{"fast": "gemini-2.5-flash", "deep": "gemini-2.5-pro"}
+				s.FallbackModels = []string{"fast", "gemini-2.0-flash"}
+			}),
+		},
+		{
+			desc: "pricing and cost caps",
+			yaml: `
+modelName   : m
+apiKey      : k
+pricing     : {m: {input: 1, output: 2}, gemini-2.5-flash: {input: 0.5, output: 3}}
+costCapChat : 5
+costCapDay  : 20.5
+`,
+			settings: withDefaults(func(s *Settings) {
+				s.APIKey = "k"
+				s.ModelName = "m"
+				s.Pricing["m"] = ModelPrice{TokenRates: TokenRates{Input: 1, Output: 2}}
+				s.Pricing["gemini-2.5-flash"] = ModelPrice{TokenRates: TokenRates{Input: 0.5, Output: 3}}
+				s.CostCapChat = 5
+				s.CostCapDay = 20.5
+			}),
+		},
+		{
+			desc:    "negative cost cap",
+			yaml:    "modelName: m\napiKey: k\ncostCapDay: -1",
+			errText: "costCapDay -1 cannot be negative",
+		},
+		{
+			desc:    "bad model aliases",
+			yaml:    "modelName: m\napiKey: k\nmodelAliases: [fast]",
+			errText: "setting modelAliases: expected a map of names to strings",
+		},
+		{
+			desc:    "bad retry attempts",
+			yaml:    "modelName: m\napiKey: k\nretryMaxAttempts: 0",
+			errText: "retryMaxAttempts 0 must be at least 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			settings, err := ParseSettings([]byte(tt.yaml))
+			if tt.errText != "" {
+				if err == nil {
+					t.Fatalf("expected error containing %q", tt.errText)
+				}
+				if !strings.Contains(err.Error(), tt.errText) {
+					t.Fatalf("error %q does not contain %q", err, tt.errText)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.settings, settings); diff != "" {
+				t.Errorf("settings mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestSettingsValidateZeroRetry tests that settings made without a
+// retry policy are valid, the zero policy being the DefaultRetryPolicy.
+func TestSettingsValidateZeroRetry(t *testing.T) {
+	settings := &Settings{APIKey: "k", ModelName: "m"}
+	if err := settings.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	settings.Retry = RetryPolicy{InitialDelay: time.Second}
+	if err := settings.Validate(); err == nil || !strings.Contains(err.Error(), "retryMaxAttempts 0 must be at least 1") {
+		t.Errorf("got error %v want retryMaxAttempts error", err)
+	}
+}
+
+// TestSettingsModels tests resolving the model and fallback model
+// aliases.
+func TestSettingsModels(t *testing.T) {
+
+	settings := &Settings{
+		ModelName:      "deep",
+		ModelAliases:   map[string]string{"fast": "gemini-2.5-flash", "deep": "gemini-2.5-pro"},
+		FallbackModels: []string{"fast", "gemini-2.5-pro", "gemini-2.0-flash", "gemini-2.5-flash"},
+	}
+	if got, want := settings.Model(), "gemini-2.5-pro"; got != want {
+		t.Errorf("model got %s want %s", got, want)
+	}
+	want := []string{"gemini-2.5-pro", "gemini-2.5-flash", "gemini-2.0-flash"}
+	if diff := cmp.Diff(want, settings.Models()); diff != "" {
+		t.Errorf("models mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestSettingsFromMap tests the backwards compatible string map
+// settings.
+func TestSettingsFromMap(t *testing.T) {
+	settings, err := SettingsFromMap(map[string]string{
+		"apiKey":      "k",
+		"modelName":   "gemini-2.5-pro",
+		"temperature": "0.25",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := settings.GenerationConfig()
+	if gc.Temperature == nil || *gc.Temperature != 0.25 {
+		t.Errorf("unexpected temperature %v", gc.Temperature)
+	}
+	if gc.TopK != nil {
+		t.Errorf("expected nil topK, got %d", *gc.TopK)
+	}
+}
@@ -0,0 +1,187 @@
+package genact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// staleReservation is the age after which the reserved cost of a
+// request which was never recorded, such as that of a process which
+// exited during the request, is dropped.
+const staleReservation = time.Hour
+
+// Spending keeps running totals of the estimated costs of each chat and
+// of the current day, in local time, so that requests are refused once
+// the "costCapChat" or "costCapDay" setting is reached. The estimated
+// cost of a request is reserved before it is sent and replaced by its
+// cost once it is complete, so that requests sent at once, such as
+// those of a batch, do not together pass a cap.
+//
+// The totals are recorded in a json file, if a path is given, which is
+// locked with a ".lock" file alongside it, as is that of a RateLimiter,
+// so that they are shared between processes. Without a path the totals
+// are shared only by the requests using the Spending.
+//
+// Provide a Spending with WithSpending.
+type Spending struct {
+	path  string
+	mu    sync.Mutex
+	state spendState // the totals when no path is given
+	now   func() time.Time
+}
+
+// spendState is the running totals of a Spending.
+type spendState struct {
+	Day      string             `json:"day"` // the local date of DayCost
+	DayCost  float64            `json:"dayCost"`
+	Chats    map[string]float64 `json:"chats"`
+	Reserved []spendReservation `json:"reserved,omitempty"`
+}
+
+// spendReservation is the estimated cost reserved for a request.
+type spendReservation struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Chat string    `json:"chat"`
+	Cost float64   `json:"cost"`
+}
+
+// OpenSpending returns a Spending recording its totals in the file at
+// path, if not empty, which is made when the first cost is reserved.
+func OpenSpending(path string) *Spending {
+	return &Spending{path: path, now: time.Now}
+}
+
+// Spent returns the costs of chat and of today, including the costs
+// reserved for requests in progress.
+func (s *Spending) Spent(chat string) (chatCost, dayCost float64, err error) {
+	if s == nil {
+		return 0, 0, nil
+	}
+	err = s.update(func(st *spendState, _ time.Time) {
+		chatCost, dayCost = st.spent(chat)
+	})
+	return chatCost, dayCost, err
+}
+
+// Reserve reserves the estimated cost of a request in chat, returning
+// the id of the reservation for Record. The request is refused with an
+// ErrCostCap error if the costs of the chat or of today, including
+// those reserved, have reached the "costCapChat" or "costCapDay"
+// setting.
+func (s *Spending) Reserve(settings *Settings, chat string, cost float64) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	var id string
+	var capErr error
+	err := s.update(func(st *spendState, now time.Time) {
+		chatCost, dayCost := st.spent(chat)
+		if capErr = checkCostCap(settings, chatCost, dayCost); capErr != nil {
+			return
+		}
+		id = strconv.Itoa(os.Getpid()) + "-" + strconv.FormatInt(now.UnixNano(), 36)
+		st.Reserved = append(st.Reserved, spendReservation{ID: id, Time: now, Chat: chat, Cost: cost})
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, capErr
+}
+
+// Record replaces the reservation id, if any, with the cost of the
+// request in chat.
+func (s *Spending) Record(id, chat string, cost float64) error {
+	if s == nil {
+		return nil
+	}
+	return s.update(func(st *spendState, _ time.Time) {
+		for i, r := range st.Reserved {
+			if r.ID == id {
+				st.Reserved = append(st.Reserved[:i], st.Reserved[i+1:]...)
+				break
+			}
+		}
+		st.Chats[chat] += cost
+		st.DayCost += cost
+	})
+}
+
+// spent returns the costs of chat and of the day, including those
+// reserved.
+func (st *spendState) spent(chat string) (chatCost, dayCost float64) {
+	chatCost, dayCost = st.Chats[chat], st.DayCost
+	for _, r := range st.Reserved {
+		if r.Chat == chat {
+			chatCost += r.Cost
+		}
+		dayCost += r.Cost
+	}
+	return chatCost, dayCost
+}
+
+// update calls fn with the totals, starting a new day and dropping
+// stale reservations, saving them once fn returns. The file, if any, is
+// locked during the update.
+func (s *Spending) update(fn func(st *spendState, now time.Time)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	prepare := func(st *spendState) {
+		if day := now.Format(time.DateOnly); st.Day != day {
+			st.Day, st.DayCost = day, 0
+		}
+		if st.Chats == nil {
+			st.Chats = map[string]float64{}
+		}
+		kept := st.Reserved[:0]
+		for _, r := range st.Reserved {
+			if now.Sub(r.Time) < staleReservation {
+				kept = append(kept, r)
+			}
+		}
+		st.Reserved = kept
+	}
+	if s.path == "" {
+		prepare(&s.state)
+		fn(&s.state, now)
+		return nil
+	}
+
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var st spendState
+	b, err := os.ReadFile(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("could not read spending file: %w", err)
+	default:
+		if err := json.Unmarshal(b, &st); err != nil {
+			return fmt.Errorf("could not decode spending file %s: %w", s.path, err)
+		}
+	}
+	prepare(&st)
+	fn(&st, now)
+	b, err = json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("could not write spending file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("could not write spending file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package genact
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSpending tests reserving and recording the costs of requests
+// shared through a file, refusing requests once a cap is reached with
+// the costs reserved, and starting a new day.
+func TestSpending(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "conversations", "spending.json")
+	now := time.Date(2025, 7, 1, 12, 0, 0, 0, time.Local)
+	a, b := OpenSpending(path), OpenSpending(path)
+	a.now = func() time.Time { return now }
+	b.now = a.now
+	settings := &Settings{CostCapChat: 1, CostCapDay: 3}
+
+	id, err := a.Reserve(settings, "chat1", 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reservation of a counts towards the chat cap for b
+	if _, err := b.Reserve(settings, "chat1", 0.6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Reserve(settings, "chat1", 0.1); !errors.Is(err, ErrCostCap) {
+		t.Errorf("got error %v want ErrCostCap", err)
+	}
+	if _, err := b.Reserve(settings, "chat2", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Record(id, "chat1", 0.25); err != nil {
+		t.Fatal(err)
+	}
+	chat, day, err := b.Spent("chat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat != 0.85 || day != 1.35 {
+		t.Errorf("got chat %g and day %g costs want 0.85 and 1.35", chat, day)
+	}
+
+	// a new day, after the reservations have become stale
+	now = now.AddDate(0, 0, 1)
+	chat, day, err = a.Spent("chat1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat != 0.25 || day != 0 {
+		t.Errorf("got chat %g and day %g costs want 0.25 and 0", chat, day)
+	}
+}
@@ -0,0 +1,155 @@
+package genact
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Over budget actions, for the "overBudget" setting, determining what
+// happens when the pre-flight token count of a request exceeds the
+// "tokenBudget" setting.
+const (
+	BudgetRefuse = "refuse" // return an ErrTokenBudget error
+	BudgetWarn   = "warn"   // log a warning and send the request
+	BudgetPrompt = "prompt" // ask for confirmation (see WithConfirm)
+)
+
+var (
+	// ErrContextLimit is returned when the pre-flight token count of a
+	// request exceeds the input token limit of the model.
+	ErrContextLimit = errors.New("context limit exceeded")
+
+	// ErrTokenBudget is returned when the pre-flight token count of a
+	// request exceeds the token budget and the request is not sent.
+	ErrTokenBudget = errors.New("token budget exceeded")
+)
+
+// TokenCount is the result of a pre-flight token count of a request.
+type TokenCount struct {
+	Tokens       int32 // the system instruction, history and prompt tokens
+	ContextLimit int32 // the input token limit of the model
+	Budget       int32 // the token budget, zero if none
+}
+
+// String reports the token count with the context limit and budget.
+func (tc TokenCount) String() string {
+	s := fmt.Sprintf("%d tokens of a %d token context limit", tc.Tokens, tc.ContextLimit)
+	if tc.Budget > 0 {
+		s += fmt.Sprintf(" (budget %d)", tc.Budget)
+	}
+	return s
+}
+
+// Check compares the count with the context limit and budget, returning
+// an ErrContextLimit or ErrTokenBudget error if either is exceeded.
+func (tc TokenCount) Check() error {
+	if tc.ContextLimit > 0 && tc.Tokens > tc.ContextLimit {
+		return fmt.Errorf("%w: %d tokens exceeds the %d token limit of the model", ErrContextLimit, tc.Tokens, tc.ContextLimit)
+	}
+	if tc.Budget > 0 && tc.Tokens > tc.Budget {
+		return fmt.Errorf("%w: %d tokens exceeds the budget of %d tokens", ErrTokenBudget, tc.Tokens, tc.Budget)
+	}
+	return nil
+}
+
+// estimateCharsPerToken is the approximate number of characters per
+// token used by estimateTokens.
+const estimateCharsPerToken = 4
+
+// estimateMediaTokens is the approximate number of tokens of an
+// attachment used by estimateTokens. It assumes each attachment is a
+// small image, counted by Gemini as 258 tokens per 768 pixel tile.
+// Image tokens follow the dimensions rather than the size of the data,
+// so the estimate is fixed per attachment, and not taken from the size
+// of the data or, for the OpenAI backend, its base64 encoding, which
+// would overstate the tokens by a third.
+const estimateMediaTokens = 258
+
+// estimateTokens estimates the tokens of a request from the size of its
+// system instruction, contents and tools, for use when no pre-flight
+// count has been made and as the count of backends without a token
+// counting endpoint.
+func estimateTokens(req *BackendRequest) int32 {
+	size, media := len(req.SystemInstruction), 0
+	for _, c := range req.Contents {
+		for _, p := range c.Parts {
+			switch p := p.(type) {
+			case genai.Text:
+				size += len(p)
+			case genai.Blob, genai.FileData:
+				media++
+			default:
+				b, _ := json.Marshal(p)
+				size += len(b)
+			}
+		}
+	}
+	if len(req.Tools) > 0 {
+		b, _ := json.Marshal(req.Tools)
+		size += len(b)
+	}
+	return int32(size/estimateCharsPerToken + media*estimateMediaTokens)
+}
+
+// countTokens counts the tokens of a request with the backend,
+// retrying transient errors, which are logged to logger. The context
+// limit reported by the backend is replaced by the "contextLimit"
+// setting, if any, and the budget is that of the "tokenBudget" setting.
+func countTokens(ctx context.Context, backend Backend, settings *Settings, req *BackendRequest, logger *slog.Logger) (TokenCount, error) {
+	var tc TokenCount
+	err := withRetry(ctx, settings.Retry, logger, func() error {
+		var err error
+		tc, err = backend.CountTokens(ctx, req)
+		return err
+	})
+	if err != nil {
+		return tc, err
+	}
+	if settings.ContextLimit > 0 {
+		tc.ContextLimit = settings.ContextLimit
+	}
+	tc.Budget = settings.TokenBudget
+	return tc, nil
+}
+
+// preflight counts the tokens of a request with countTokens and checks
+// them against the context limit and budget using checkBudget.
+func preflight(ctx context.Context, backend Backend, settings *Settings, req *BackendRequest, confirm func(TokenCount) bool, logger *slog.Logger) (TokenCount, error) {
+	tc, err := countTokens(ctx, backend, settings, req, logger)
+	if err != nil {
+		return tc, err
+	}
+	logger.Info("pre-flight count",
+		"model", req.Model,
+		"tokens", tc.Tokens,
+		"contextLimit", tc.ContextLimit,
+		"budget", tc.Budget,
+	)
+	return tc, checkBudget(tc, settings.OverBudget, confirm, logger)
+}
+
+// checkBudget checks a token count, returning an error if the request
+// should not be sent. A request over budget is refused, sent with a
+// warning or sent if confirm returns true, according to the overBudget
+// action. A request exceeding the context limit is always refused.
+func checkBudget(tc TokenCount, overBudget string, confirm func(TokenCount) bool, logger *slog.Logger) error {
+	err := tc.Check()
+	if err == nil || errors.Is(err, ErrContextLimit) {
+		return err
+	}
+	switch overBudget {
+	case BudgetWarn:
+		logger.Warn("sending request over budget", "error", err)
+		return nil
+	case BudgetPrompt:
+		if confirm != nil && confirm(tc) {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package genact
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// TestCheckBudget tests checking token counts against the context limit
+// and budget for each over budget action.
+func TestCheckBudget(t *testing.T) {
+
+	yes := func(TokenCount) bool { return true }
+	no := func(TokenCount) bool { return false }
+
+	tests := []struct {
+		desc       string
+		tc         TokenCount
+		overBudget string
+		confirm    func(TokenCount) bool
+		err        error
+	}{
+		{"within limit", TokenCount{Tokens: 100, ContextLimit: 1000}, BudgetRefuse, nil, nil},
+		{"within budget", TokenCount{Tokens: 100, ContextLimit: 1000, Budget: 200}, BudgetRefuse, nil, nil},
+		{"over context limit", TokenCount{Tokens: 1001, ContextLimit: 1000}, BudgetRefuse, nil, ErrContextLimit},
+		{"over context limit warn", TokenCount{Tokens: 1001, ContextLimit: 1000}, BudgetWarn, nil, ErrContextLimit},
+		{"over context limit confirmed", TokenCount{Tokens: 1001, ContextLimit: 1000}, BudgetPrompt, yes, ErrContextLimit},
+		{"over budget refuse", TokenCount{Tokens: 300, ContextLimit: 1000, Budget: 200}, BudgetRefuse, yes, ErrTokenBudget},
+		{"over budget warn", TokenCount{Tokens: 300, ContextLimit: 1000, Budget: 200}, BudgetWarn, nil, nil},
+		{"over budget confirmed", TokenCount{Tokens: 300, ContextLimit: 1000, Budget: 200}, BudgetPrompt, yes, nil},
+		{"over budget declined", TokenCount{Tokens: 300, ContextLimit: 1000, Budget: 200}, BudgetPrompt, no, ErrTokenBudget},
+		{"over budget no confirm func", TokenCount{Tokens: 300, ContextLimit: 1000, Budget: 200}, BudgetPrompt, nil, ErrTokenBudget},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := checkBudget(tt.tc, tt.overBudget, tt.confirm, slog.New(slog.DiscardHandler))
+			if tt.err == nil && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got, want := errors.Is(err, tt.err), true; got != want {
+				t.Errorf("error got %v want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestTokenCountString tests the reporting of a token count.
+func TestTokenCountString(t *testing.T) {
+	tc := TokenCount{Tokens: 900000, ContextLimit: 1048576}
+	if got, want := tc.String(), "900000 tokens of a 1048576 token context limit"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+	tc.Budget = 500000
+	if got, want := tc.String(), "900000 tokens of a 1048576 token context limit (budget 500000)"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+// TestEstimateTokens tests estimating the tokens of a request from its
+// size.
+func TestEstimateTokens(t *testing.T) {
+	req := &BackendRequest{
+		SystemInstruction: "Be brief.", // 9 characters
+		Contents: []*genai.Content{
+			genai.NewUserContent(genai.Text("How are you today?")),                                 // 18 characters
+			{Role: "model", Parts: []genai.Part{genai.Text("Very well.")}},                         // 10 characters
+			genai.NewUserContent(genai.Text("And this?"), genai.ImageData("png", []byte{1, 2, 3})), // 9 characters and an image
+		},
+	}
+	if got, want := estimateTokens(req), int32(46/estimateCharsPerToken+estimateMediaTokens); got != want {
+		t.Errorf("estimate got %d want %d", got, want)
+	}
+}
@@ -0,0 +1,393 @@
+package genact
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// maxToolOutput is the maximum number of bytes of file content or
+// command output returned to the model by the built-in tools. Longer
+// output is truncated.
+const maxToolOutput = 256 << 10
+
+// commandTimeout is the maximum run time of a command run by the
+// run_command tool.
+const commandTimeout = time.Minute
+
+// defaultMaxToolRounds is the default maximum number of rounds of
+// function calls in a request.
+const defaultMaxToolRounds = 10
+
+// ToolFunc runs a tool with the arguments provided by the model,
+// returning the result to be sent back to the model.
+type ToolFunc func(ctx context.Context, args map[string]any) (map[string]any, error)
+
+// Tool is a local function which the model may call, described to the
+// model by its function declaration.
+type Tool struct {
+	Declaration *genai.FunctionDeclaration
+	Run         ToolFunc
+}
+
+// ToolRegistry is a set of tools, keyed by name, which may be provided
+// to the model with WithTools.
+type ToolRegistry struct {
+	tools map[string]Tool
+	names []string // in registration order
+}
+
+// NewToolRegistry returns a registry of the provided tools.
+func NewToolRegistry(tools ...Tool) (*ToolRegistry, error) {
+	r := &ToolRegistry{tools: map[string]Tool{}}
+	for _, t := range tools {
+		if err := r.Register(t); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Register adds a tool to the registry. Tool names must be unique.
+func (r *ToolRegistry) Register(t Tool) error {
+	if t.Declaration == nil || t.Declaration.Name == "" || t.Run == nil {
+		return errors.New("tool must have a named declaration and a run function")
+	}
+	if _, ok := r.tools[t.Declaration.Name]; ok {
+		return fmt.Errorf("tool %s already registered", t.Declaration.Name)
+	}
+	r.tools[t.Declaration.Name] = t
+	r.names = append(r.names, t.Declaration.Name)
+	return nil
+}
+
+// Names returns the names of the registered tools in registration
+// order.
+func (r *ToolRegistry) Names() []string {
+	return slices.Clone(r.names)
+}
+
+// Select returns a registry of the named tools only.
+func (r *ToolRegistry) Select(names ...string) (*ToolRegistry, error) {
+	selected := &ToolRegistry{tools: map[string]Tool{}}
+	for _, n := range names {
+		t, ok := r.tools[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown tool %q, expected one of %s", n, strings.Join(r.names, ", "))
+		}
+		if _, ok := selected.tools[n]; ok {
+			continue
+		}
+		_ = selected.Register(t)
+	}
+	return selected, nil
+}
+
+// Len returns the number of registered tools.
+func (r *ToolRegistry) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.names)
+}
+
+// genaiTools returns the function declarations of the registered tools
+// for a genai.GenerativeModel.
+func (r *ToolRegistry) genaiTools() []*genai.Tool {
+	if r.Len() == 0 {
+		return nil
+	}
+	tool := &genai.Tool{}
+	for _, n := range r.names {
+		tool.FunctionDeclarations = append(tool.FunctionDeclarations, r.tools[n].Declaration)
+	}
+	return []*genai.Tool{tool}
+}
+
+// call runs a function call from the model, returning the function
+// response. Errors, including calls to unknown tools, are reported to
+// the model in the response so that it may recover. Calls are logged to
+// logger.
+func (r *ToolRegistry) call(ctx context.Context, fc genai.FunctionCall, logger *slog.Logger) genai.FunctionResponse {
+	t, ok := r.tools[fc.Name]
+	if !ok {
+		return genai.FunctionResponse{Name: fc.Name, Response: map[string]any{"error": "unknown tool " + fc.Name}}
+	}
+	start := time.Now()
+	result, err := t.Run(ctx, fc.Args)
+	if err != nil {
+		logger.Warn("tool call failed", "tool", fc.Name, "duration", time.Since(start), "error", err)
+		return genai.FunctionResponse{Name: fc.Name, Response: map[string]any{"error": err.Error()}}
+	}
+	logger.Info("tool call", "tool", fc.Name, "duration", time.Since(start))
+	return genai.FunctionResponse{Name: fc.Name, Response: result}
+}
+
+// BuiltinTools returns a registry of the built-in tools working in the
+// directory root:
+//
+//   - read_file reads a file under root
+//   - list_dir lists a directory under root
+//   - run_command runs one of the whitelisted commands in root
+//
+// Paths outside root, including those reached by symbolic links, are
+// refused, as are the files and directories under root named by deny,
+// such as the settings file holding the api key. Denied entries are
+// left out of directory listings.
+//
+// Commands are run directly rather than by a shell, but are passed any
+// arguments the model provides, so a whitelisted command able to read
+// or write arbitrary paths, such as cat or git, can reach past root and
+// deny. Only whitelist commands whose every use is safe.
+func BuiltinTools(root string, commands []string, deny ...string) *ToolRegistry {
+	denied := make([]string, len(deny))
+	for i, d := range deny {
+		denied[i] = cleanToolPath(d)
+	}
+	r, _ := NewToolRegistry(
+		readFileTool(root, denied),
+		listDirTool(root, denied),
+		runCommandTool(root, commands),
+	)
+	return r
+}
+
+// stringArg returns a string argument provided by the model.
+func stringArg(args map[string]any, name string, required bool) (string, error) {
+	v, ok := args[name]
+	if !ok {
+		if required {
+			return "", fmt.Errorf("argument %s not provided", name)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %s must be a string", name)
+	}
+	return s, nil
+}
+
+// cleanToolPath returns a model provided path as a path relative to the
+// tool root.
+func cleanToolPath(p string) string {
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	if p == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// isDenied reports whether the root relative path p is, or is under,
+// one of the denied paths.
+func isDenied(p string, denied []string) bool {
+	for _, d := range denied {
+		if d == "." || p == d || strings.HasPrefix(p, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// openToolPath opens the model provided path p under root, refusing
+// denied paths, including those reached through symbolic links within
+// root.
+func openToolPath(root, p string, denied []string) (*os.File, error) {
+	rel := cleanToolPath(p)
+	if len(denied) > 0 {
+		resolved, err := resolveToolPath(root, rel)
+		if err != nil {
+			return nil, err
+		}
+		if isDenied(rel, denied) || isDenied(resolved, denied) {
+			return nil, fmt.Errorf("path %s is not permitted", p)
+		}
+	}
+	dir, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = dir.Close() }()
+	return dir.Open(rel)
+}
+
+// resolveToolPath returns the root relative path rel with any symbolic
+// links resolved. Paths resolving outside root are left to os.Root to
+// refuse.
+func resolveToolPath(root, rel string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.Rel(realRoot, real)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(resolved), nil
+}
+
+// truncate truncates tool output to maxToolOutput bytes, reporting
+// whether the output was truncated.
+func truncate(b []byte) (string, bool) {
+	if len(b) <= maxToolOutput {
+		return string(b), false
+	}
+	return strings.ToValidUTF8(string(b[:maxToolOutput]), ""), true
+}
+
+// readFileTool returns the read_file tool.
+func readFileTool(root string, denied []string) Tool {
+	return Tool{
+		Declaration: &genai.FunctionDeclaration{
+			Name:        "read_file",
+			Description: "Read a text file from the working directory.",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"path": {Type: genai.TypeString, Description: "the file path relative to the working directory"},
+				},
+				Required: []string{"path"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			p, err := stringArg(args, "path", true)
+			if err != nil {
+				return nil, err
+			}
+			f, err := openToolPath(root, p, denied)
+			if err != nil {
+				return nil, err
+			}
+			defer func() { _ = f.Close() }()
+			b, err := io.ReadAll(io.LimitReader(f, maxToolOutput+1))
+			if err != nil {
+				return nil, err
+			}
+			content, truncated := truncate(b)
+			return map[string]any{"content": content, "truncated": truncated}, nil
+		},
+	}
+}
+
+// listDirTool returns the list_dir tool.
+func listDirTool(root string, denied []string) Tool {
+	return Tool{
+		Declaration: &genai.FunctionDeclaration{
+			Name:        "list_dir",
+			Description: "List the entries of a directory in the working directory. Directory names end with a slash.",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"path": {Type: genai.TypeString, Description: "the directory path relative to the working directory, the working directory itself if empty"},
+				},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			p, err := stringArg(args, "path", false)
+			if err != nil {
+				return nil, err
+			}
+			f, err := openToolPath(root, p, denied)
+			if err != nil {
+				return nil, err
+			}
+			defer func() { _ = f.Close() }()
+			entries, err := f.ReadDir(-1)
+			if err != nil {
+				return nil, err
+			}
+			names := []string{}
+			for _, e := range entries {
+				if isDenied(path.Join(cleanToolPath(p), e.Name()), denied) {
+					continue
+				}
+				if e.IsDir() {
+					names = append(names, e.Name()+"/")
+					continue
+				}
+				names = append(names, e.Name())
+			}
+			slices.Sort(names)
+			return map[string]any{"entries": names}, nil
+		},
+	}
+}
+
+// runCommandTool returns the run_command tool, which only runs the
+// whitelisted commands.
+func runCommandTool(root string, commands []string) Tool {
+	description := "Run a command in the working directory, returning its combined output and exit code."
+	if len(commands) == 0 {
+		description += " No commands are permitted."
+	} else {
+		description += " The permitted commands are: " + strings.Join(commands, ", ") + "."
+	}
+	return Tool{
+		Declaration: &genai.FunctionDeclaration{
+			Name:        "run_command",
+			Description: description,
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"command": {Type: genai.TypeString, Description: "the command name"},
+					"args":    {Type: genai.TypeArray, Items: &genai.Schema{Type: genai.TypeString}, Description: "the command arguments"},
+				},
+				Required: []string{"command"},
+			},
+		},
+		Run: func(ctx context.Context, args map[string]any) (map[string]any, error) {
+			name, err := stringArg(args, "command", true)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(commands, name) {
+				return nil, fmt.Errorf("command %q is not permitted", name)
+			}
+			var cmdArgs []string
+			if v, ok := args["args"]; ok {
+				list, ok := v.([]any)
+				if !ok {
+					return nil, errors.New("argument args must be a list of strings")
+				}
+				for _, a := range list {
+					s, ok := a.(string)
+					if !ok {
+						return nil, errors.New("argument args must be a list of strings")
+					}
+					cmdArgs = append(cmdArgs, s)
+				}
+			}
+			ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+			defer cancel()
+			cmd := exec.CommandContext(ctx, name, cmdArgs...)
+			cmd.Dir = root
+			var out bytes.Buffer
+			cmd.Stdout, cmd.Stderr = &out, &out
+			err = cmd.Run()
+			var exitErr *exec.ExitError
+			switch {
+			case errors.As(err, &exitErr):
+			case err != nil:
+				return nil, err
+			}
+			output, truncated := truncate(out.Bytes())
+			return map[string]any{"output": output, "exitCode": cmd.ProcessState.ExitCode(), "truncated": truncated}, nil
+		},
+	}
+}
@@ -0,0 +1,271 @@
+package genact
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestToolRegistry tests registering and selecting tools.
+func TestToolRegistry(t *testing.T) {
+
+	tools := BuiltinTools(t.TempDir(), nil)
+	if got, want := tools.Names(), []string{"read_file", "list_dir", "run_command"}; !cmp.Equal(got, want) {
+		t.Errorf("got tools %v want %v", got, want)
+	}
+	if err := tools.Register(readFileTool("", nil)); err == nil {
+		t.Error("expected duplicate tool error")
+	}
+	if err := tools.Register(Tool{Declaration: &genai.FunctionDeclaration{Name: "x"}}); err == nil {
+		t.Error("expected missing run function error")
+	}
+
+	selected, err := tools.Select("list_dir", "read_file", "list_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := selected.Names(), []string{"list_dir", "read_file"}; !cmp.Equal(got, want) {
+		t.Errorf("got selected tools %v want %v", got, want)
+	}
+	if got, want := len(selected.genaiTools()[0].FunctionDeclarations), 2; got != want {
+		t.Errorf("got %d function declarations want %d", got, want)
+	}
+	if _, err := tools.Select("delete_file"); err == nil {
+		t.Error("expected unknown tool error")
+	}
+
+	var none *ToolRegistry
+	if none.Len() != 0 || none.genaiTools() != nil {
+		t.Error("expected no tools from a nil registry")
+	}
+}
+
+// TestBuiltinTools tests the built-in tools, including the refusal of
+// paths outside the working directory and of commands which are not
+// whitelisted.
+func TestBuiltinTools(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docs", "notes.txt"), []byte("buy milk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(dir), "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Remove(filepath.Join(filepath.Dir(dir), "secret.txt")) }()
+	tools := BuiltinTools(dir, []string{"echo"})
+
+	tests := []struct {
+		desc     string
+		name     string
+		args     map[string]any
+		response map[string]any
+		errText  string
+	}{
+		{
+			desc:     "read file",
+			name:     "read_file",
+			args:     map[string]any{"path": "docs/notes.txt"},
+			response: map[string]any{"content": "buy milk\n", "truncated": false},
+		},
+		{
+			desc:     "read file with absolute path",
+			name:     "read_file",
+			args:     map[string]any{"path": "/docs/notes.txt"},
+			response: map[string]any{"content": "buy milk\n", "truncated": false},
+		},
+		{
+			desc:    "read file outside directory",
+			name:    "read_file",
+			args:    map[string]any{"path": "../secret.txt"},
+			errText: "no such file",
+		},
+		{
+			desc:    "read file without path",
+			name:    "read_file",
+			args:    map[string]any{},
+			errText: "argument path not provided",
+		},
+		{
+			desc:     "list directory",
+			name:     "list_dir",
+			args:     map[string]any{},
+			response: map[string]any{"entries": []string{"docs/"}},
+		},
+		{
+			desc:     "list subdirectory",
+			name:     "list_dir",
+			args:     map[string]any{"path": "docs"},
+			response: map[string]any{"entries": []string{"notes.txt"}},
+		},
+		{
+			desc:     "run command",
+			name:     "run_command",
+			args:     map[string]any{"command": "echo", "args": []any{"hello"}},
+			response: map[string]any{"output": "hello\n", "exitCode": 0, "truncated": false},
+		},
+		{
+			desc:    "run command not whitelisted",
+			name:    "run_command",
+			args:    map[string]any{"command": "rm", "args": []any{"-rf", "docs"}},
+			errText: `command "rm" is not permitted`,
+		},
+		{
+			desc:    "unknown tool",
+			name:    "delete_file",
+			args:    map[string]any{"path": "docs/notes.txt"},
+			errText: "unknown tool delete_file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fr := tools.call(context.Background(), genai.FunctionCall{Name: tt.name, Args: tt.args}, slog.New(slog.DiscardHandler))
+			if got, want := fr.Name, tt.name; got != want {
+				t.Errorf("got response name %s want %s", got, want)
+			}
+			if tt.errText != "" {
+				errText, _ := fr.Response["error"].(string)
+				if !strings.Contains(errText, tt.errText) {
+					t.Errorf("got error %q want %q", errText, tt.errText)
+				}
+				return
+			}
+			if diff := cmp.Diff(tt.response, fr.Response); diff != "" {
+				t.Errorf("response mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docs")); err != nil {
+		t.Errorf("docs directory removed: %v", err)
+	}
+}
+
+// TestBuiltinToolsDenied tests that the built-in tools refuse denied
+// paths, including those reached through symbolic links, and leave them
+// out of directory listings.
+func TestBuiltinToolsDenied(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conversations", "other"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"settings.yaml":                    "apiKey: secret\n",
+		"notes.txt":                        "buy milk\n",
+		"conversations/spending.json":      "{}",
+		"conversations/other/history.json": "[]",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("settings.yaml", filepath.Join(dir, "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	tools := BuiltinTools(dir, nil, "conversations", "settings.yaml")
+
+	tests := []struct {
+		desc     string
+		name     string
+		args     map[string]any
+		response map[string]any
+		errText  string
+	}{
+		{
+			desc:    "read settings",
+			name:    "read_file",
+			args:    map[string]any{"path": "settings.yaml"},
+			errText: "path settings.yaml is not permitted",
+		},
+		{
+			desc:    "read settings through a link",
+			name:    "read_file",
+			args:    map[string]any{"path": "link.yaml"},
+			errText: "path link.yaml is not permitted",
+		},
+		{
+			desc:    "read other conversation",
+			name:    "read_file",
+			args:    map[string]any{"path": "./docs/../conversations/other/history.json"},
+			errText: "is not permitted",
+		},
+		{
+			desc:     "read permitted file",
+			name:     "read_file",
+			args:     map[string]any{"path": "notes.txt"},
+			response: map[string]any{"content": "buy milk\n", "truncated": false},
+		},
+		{
+			desc:    "list conversations",
+			name:    "list_dir",
+			args:    map[string]any{"path": "conversations/"},
+			errText: "path conversations/ is not permitted",
+		},
+		{
+			desc:     "list directory",
+			name:     "list_dir",
+			args:     map[string]any{},
+			response: map[string]any{"entries": []string{"link.yaml", "notes.txt"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			fr := tools.call(context.Background(), genai.FunctionCall{Name: tt.name, Args: tt.args}, slog.New(slog.DiscardHandler))
+			if tt.errText != "" {
+				errText, _ := fr.Response["error"].(string)
+				if !strings.Contains(errText, tt.errText) {
+					t.Errorf("got error %q want %q", errText, tt.errText)
+				}
+				return
+			}
+			if diff := cmp.Diff(tt.response, fr.Response); diff != "" {
+				t.Errorf("response mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestToolHistory tests that function calls and responses are recorded
+// in a history file and replayed when it is read.
+func TestToolHistory(t *testing.T) {
+
+	history := []*genai.Content{
+		{Role: "user", Parts: []genai.Part{genai.Text("What is in notes.txt?")}},
+		{Role: "model", Parts: []genai.Part{genai.FunctionCall{Name: "read_file", Args: map[string]any{"path": "notes.txt"}}}},
+		{Role: "user", Parts: []genai.Part{genai.FunctionResponse{Name: "read_file", Response: map[string]any{"content": "buy milk"}}}},
+		{Role: "model", Parts: []genai.Part{genai.Text("A shopping list.")}},
+	}
+	apiHistory, err := aiContentToAPI(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !apiHistory[1].IsTool() || !apiHistory[2].IsTool() || apiHistory[3].IsTool() {
+		t.Errorf("unexpected tool turns in %+v", apiHistory)
+	}
+
+	b, err := json.Marshal(apiHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyFile := filepath.Join(t.TempDir(), "history.json")
+	if err := os.WriteFile(historyFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := HistoryAPIToAIContent(historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(history, got); diff != "" {
+		t.Errorf("history mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,376 @@
+package genact
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// geminiTransport is an http.RoundTripper used by the genai client. It
+// adds the api key to each request and adjusts requests and responses
+// on the wire for Gemini features which are not exposed by the genai
+// package, such as the thinking configuration and thought summaries.
+//
+// The api key is sent as a header since the key provided with
+// option.WithAPIKey is not applied when a custom http client is used.
+type geminiTransport struct {
+	base            http.RoundTripper
+	apiKey          string
+	thinkingBudget  *int32
+	includeThoughts bool
+	candidateCount  *int32
+	record          *wireRecord
+}
+
+// wireRecord records response data removed from, or not exposed by,
+// the genai package for the latest generation request.
+type wireRecord struct {
+	mu           sync.Mutex
+	thoughts     map[int]string // by candidate index
+	stopped      map[int]string // finish reasons hidden from the genai package, by candidate index
+	usage        *Usage         // the last usage metadata in the stream
+	modelVersion string
+}
+
+// reset clears the record for a new request.
+func (w *wireRecord) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.thoughts = nil
+	w.stopped = nil
+	w.usage = nil
+	w.modelVersion = ""
+}
+
+// Usage returns the last usage metadata recorded for the latest
+// request, or nil if none was recorded. Unlike the genai package, which
+// keeps the usage metadata of the first streamed response, this
+// includes the final candidate and thought token counts.
+func (w *wireRecord) Usage() *Usage {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.usage
+}
+
+// ModelVersion returns the model version reported for the latest
+// request.
+func (w *wireRecord) ModelVersion() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.modelVersion
+}
+
+// Thoughts returns the thought summaries recorded for the latest
+// request.
+func (w *wireRecord) Thoughts() string {
+	return w.CandidateThoughts(0)
+}
+
+// CandidateThoughts returns the thought summaries recorded for a
+// candidate of the latest request.
+func (w *wireRecord) CandidateThoughts(index int) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.thoughts[index]
+}
+
+// FinishReason returns the finish reason of a candidate of the latest
+// request, which is reason unless it was hidden from the genai package.
+func (w *wireRecord) FinishReason(index int, reason string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if stopped, ok := w.stopped[index]; ok {
+		return stopped
+	}
+	return reason
+}
+
+// newHTTPClient returns an http client using a geminiTransport
+// configured from settings, together with the wireRecord of the
+// transport. Requests are made with base, or http.DefaultTransport if
+// base is nil.
+func newHTTPClient(settings *Settings, base http.RoundTripper) (*http.Client, *wireRecord) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	record := &wireRecord{}
+	return &http.Client{
+		Transport: &geminiTransport{
+			base:            base,
+			apiKey:          settings.APIKey,
+			thinkingBudget:  settings.ThinkingBudget,
+			includeThoughts: settings.IncludeThoughts,
+			candidateCount:  settings.CandidateCount,
+			record:          record,
+		},
+	}, record
+}
+
+// supportsThinking reports if a model is likely to support thinking
+// and thought summaries. Gemini 2.5 and later models, and the earlier
+// "thinking" models, support thinking.
+func supportsThinking(model string) bool {
+	model = strings.TrimPrefix(model, "models/")
+	if strings.Contains(model, "thinking") {
+		return true
+	}
+	for _, prefix := range []string{"gemini-1.", "gemini-2.0", "gemini-pro", "gemini-exp"} {
+		if strings.HasPrefix(model, prefix) {
+			return false
+		}
+	}
+	return strings.HasPrefix(model, "gemini-")
+}
+
+// pathModel returns the model of a request path such as
+// /v1beta/models/gemini-2.5-pro:generateContent.
+func pathModel(path string) string {
+	_, model, _ := strings.Cut(path, "/models/")
+	model, _, _ = strings.Cut(model, ":")
+	return model
+}
+
+// isGenerateRequest reports if the request path is for content
+// generation.
+func isGenerateRequest(path string) bool {
+	return strings.HasSuffix(path, ":generateContent") || strings.HasSuffix(path, ":streamGenerateContent")
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *geminiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("x-goog-api-key", t.apiKey)
+	generate := req.Method == http.MethodPost && req.Body != nil && isGenerateRequest(req.URL.Path)
+	if generate {
+		t.record.reset()
+		if err := t.rewriteRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !generate || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	resp.Body = t.filterResponse(resp.Body)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// rewriteRequest adds the thinking configuration, if any, to a
+// generation request body, and the candidate count, which the genai
+// package sets to 1 for chats. Thoughts are only requested from models
+// supporting thinking.
+func (t *geminiTransport) rewriteRequest(req *http.Request) error {
+	candidates := t.candidateCount != nil && *t.candidateCount > 1
+	includeThoughts := t.includeThoughts && supportsThinking(pathModel(req.URL.Path))
+	if t.thinkingBudget == nil && !includeThoughts && !candidates {
+		return nil
+	}
+	body, err := io.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("could not read request body: %w", err)
+	}
+
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return fmt.Errorf("could not decode request body: %w", err)
+	}
+	gc, ok := m["generationConfig"].(map[string]any)
+	if !ok {
+		gc = map[string]any{}
+		m["generationConfig"] = gc
+	}
+	if t.thinkingBudget != nil || includeThoughts {
+		tc := map[string]any{}
+		if t.thinkingBudget != nil {
+			tc["thinkingBudget"] = *t.thinkingBudget
+		}
+		if includeThoughts {
+			tc["includeThoughts"] = true
+		}
+		gc["thinkingConfig"] = tc
+	}
+	if candidates {
+		gc["candidateCount"] = *t.candidateCount
+	}
+
+	body, err = json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("could not encode request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
+// filterResponse returns a reader over a generation response, a single
+// GenerateContentResponse object or, when streamed, a json array of
+// them, from which thought parts have been removed and recorded. Each
+// object is passed on as soon as it is decoded so that streaming is not
+// held up.
+func (t *geminiTransport) filterResponse(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer func() { _ = body.Close() }()
+		pw.CloseWithError(t.filterStream(body, pw))
+	}()
+	return pr
+}
+
+// filterStream copies the json response object, or array stream of
+// objects, in r to w, removing and recording the thought parts of each
+// response.
+func (t *geminiTransport) filterStream(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	first, err := firstNonSpace(br)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+	if first == '{' {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		t.recordResponse(m)
+		return json.NewEncoder(w).Encode(m)
+	}
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('[') {
+		return fmt.Errorf("unexpected response token %v", tok)
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := 0; dec.More(); i++ {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		t.recordResponse(m)
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b = append([]byte(",\n"), b...)
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]")
+	return err
+}
+
+// firstNonSpace returns the first byte of r which is not json white
+// space, leaving it unread.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, r.UnreadByte()
+	}
+}
+
+// wireInt32 returns the integer value of key in a decoded json map.
+func wireInt32(m map[string]any, key string) int32 {
+	n, _ := m[key].(json.Number)
+	i, _ := n.Int64()
+	return int32(i)
+}
+
+// wireFinishReason returns the name of the finish reason of a decoded
+// candidate, which may be sent as a name or a number.
+func wireFinishReason(candidate map[string]any) string {
+	switch reason := candidate["finishReason"].(type) {
+	case string:
+		return reason
+	case json.Number:
+		return finishReasonName(genai.FinishReason(wireInt32(candidate, "finishReason")))
+	}
+	return ""
+}
+
+// recordResponse removes thought parts from the candidates of a
+// decoded GenerateContentResponse, recording their text, and records
+// the usage metadata and model version.
+//
+// The genai package fails a response if any candidate was stopped for
+// safety or recitation. When several candidates were requested, the
+// finish reasons of such candidates are recorded and replaced with
+// OTHER, so that the remaining candidates may be used.
+func (t *geminiTransport) recordResponse(m map[string]any) {
+	t.record.mu.Lock()
+	defer t.record.mu.Unlock()
+	if um, ok := m["usageMetadata"].(map[string]any); ok {
+		t.record.usage = &Usage{
+			PromptTokens:        wireInt32(um, "promptTokenCount"),
+			CachedContentTokens: wireInt32(um, "cachedContentTokenCount"),
+			CandidatesTokens:    wireInt32(um, "candidatesTokenCount"),
+			ThoughtsTokens:      wireInt32(um, "thoughtsTokenCount"),
+			ToolUsePromptTokens: wireInt32(um, "toolUsePromptTokenCount"),
+			TotalTokens:         wireInt32(um, "totalTokenCount"),
+		}
+	}
+	if mv, ok := m["modelVersion"].(string); ok && mv != "" {
+		t.record.modelVersion = mv
+	}
+	candidates, _ := m["candidates"].([]any)
+	for _, c := range candidates {
+		candidate, _ := c.(map[string]any)
+		index := int(wireInt32(candidate, "index"))
+		if reason := wireFinishReason(candidate); t.candidateCount != nil && *t.candidateCount > 1 &&
+			(reason == "SAFETY" || reason == "RECITATION") {
+			if t.record.stopped == nil {
+				t.record.stopped = map[int]string{}
+			}
+			t.record.stopped[index] = reason
+			candidate["finishReason"] = "OTHER"
+		}
+		content, _ := candidate["content"].(map[string]any)
+		parts, _ := content["parts"].([]any)
+		if parts == nil {
+			continue
+		}
+		kept := []any{}
+		for _, p := range parts {
+			part, _ := p.(map[string]any)
+			if thought, _ := part["thought"].(bool); !thought {
+				kept = append(kept, p)
+				continue
+			}
+			text, _ := part["text"].(string)
+			if t.record.thoughts == nil {
+				t.record.thoughts = map[int]string{}
+			}
+			t.record.thoughts[index] += text
+		}
+		content["parts"] = kept
+	}
+}
@@ -0,0 +1,246 @@
+package genact
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// TestGeminiTransport tests that the api key header and thinking
+// configuration are added to generation requests.
+func TestGeminiTransport(t *testing.T) {
+
+	var header http.Header
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body = nil
+		b, _ := io.ReadAll(r.Body)
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &body); err != nil {
+				t.Errorf("could not decode body: %v", err)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	client, _ := newHTTPClient(&Settings{
+		APIKey:          "secret",
+		ModelName:       "gemini-2.5-pro",
+		ThinkingBudget:  genai.Ptr[int32](1024),
+		IncludeThoughts: true,
+	}, nil)
+	reqBody := `{"contents":[{"parts":[{"text":"hi"}],"role":"user"}],"generationConfig":{"candidateCount":1}}`
+
+	// generation requests have the thinking budget added
+	resp, err := client.Post(srv.URL+"/v1beta/models/gemini-2.5-pro:streamGenerateContent", "application/json", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if got, want := header.Get("x-goog-api-key"), "secret"; got != want {
+		t.Errorf("api key header got %q want %q", got, want)
+	}
+	gc, _ := body["generationConfig"].(map[string]any)
+	tc, _ := gc["thinkingConfig"].(map[string]any)
+	if got, want := tc["thinkingBudget"], float64(1024); got != want {
+		t.Errorf("thinking budget got %v want %v", got, want)
+	}
+	if got, want := tc["includeThoughts"], true; got != want {
+		t.Errorf("include thoughts got %v want %v", got, want)
+	}
+	if got, want := gc["candidateCount"], float64(1); got != want {
+		t.Errorf("candidate count got %v want %v", got, want)
+	}
+
+	// the candidate count, which the genai package sets to 1, is replaced
+	client, _ = newHTTPClient(&Settings{APIKey: "secret", ModelName: "gemini-2.0-flash", CandidateCount: genai.Ptr[int32](3)}, nil)
+	resp, err = client.Post(srv.URL+"/v1beta/models/gemini-2.0-flash:generateContent", "application/json", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	gc, _ = body["generationConfig"].(map[string]any)
+	if got, want := gc["candidateCount"], float64(3); got != want {
+		t.Errorf("candidate count got %v want %v", got, want)
+	}
+	if _, ok := gc["thinkingConfig"]; ok {
+		t.Error("unexpected thinkingConfig for a model without thinking")
+	}
+
+	// thoughts are only requested from the models of requests supporting
+	// thinking, such as a fallback model
+	client, _ = newHTTPClient(&Settings{APIKey: "secret", ModelName: "gemini-2.5-pro", IncludeThoughts: true}, nil)
+	resp, err = client.Post(srv.URL+"/v1beta/models/gemini-2.0-flash:generateContent", "application/json", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	gc, _ = body["generationConfig"].(map[string]any)
+	if _, ok := gc["thinkingConfig"]; ok {
+		t.Error("unexpected thinkingConfig for a fallback model without thinking")
+	}
+
+	// other requests are not altered
+	resp, err = client.Post(srv.URL+"/v1beta/models/gemini-2.5-pro:countTokens", "application/json", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	gc, _ = body["generationConfig"].(map[string]any)
+	if _, ok := gc["thinkingConfig"]; ok {
+		t.Error("unexpected thinkingConfig in countTokens request")
+	}
+}
+
+// TestGeminiTransportThoughts tests that thought parts are removed from
+// the response stream and recorded.
+func TestGeminiTransportThoughts(t *testing.T) {
+
+	stream := `[{"candidates": [{"content": {"role": "model", "parts": [{"text": "Considering ", "thought": true}]}}]}
+,
+{"candidates": [{"content": {"role": "model", "parts": [{"text": "the question.", "thought": true}, {"text": "Hello"}]}}]}
+,
+{"candidates": [{"content": {"role": "model", "parts": [{"text": " there"}]}, "finishReason": 1},
+  {"index": 1, "content": {"role": "model", "parts": [{"text": "Pondering.", "thought": true}, {"text": "Hi"}]}, "finishReason": 1}],
+ "usageMetadata": {"promptTokenCount": 3, "candidatesTokenCount": 2, "totalTokenCount": 12, "thoughtsTokenCount": 7},
+ "modelVersion": "gemini-2.5-pro-001"}
+]`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, stream)
+	}))
+	defer srv.Close()
+
+	client, record := newHTTPClient(&Settings{APIKey: "k", ModelName: "gemini-2.5-pro", IncludeThoughts: true}, nil)
+	resp, err := client.Post(srv.URL+"/v1beta/models/gemini-2.5-pro:streamGenerateContent", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var responses []map[string]any
+	if err := json.Unmarshal(b, &responses); err != nil {
+		t.Fatalf("could not decode filtered stream: %v\n%s", err, b)
+	}
+	if got, want := len(responses), 3; got != want {
+		t.Fatalf("got %d responses want %d", got, want)
+	}
+	if strings.Contains(string(b), `"thought":`) {
+		t.Errorf("filtered stream contains thoughts: %s", b)
+	}
+	if !strings.Contains(string(b), `"Hello"`) || !strings.Contains(string(b), `" there"`) {
+		t.Errorf("filtered stream missing response text: %s", b)
+	}
+	if got, want := record.Thoughts(), "Considering the question."; got != want {
+		t.Errorf("thoughts got %q want %q", got, want)
+	}
+	if got, want := record.CandidateThoughts(1), "Pondering."; got != want {
+		t.Errorf("second candidate thoughts got %q want %q", got, want)
+	}
+	wantUsage := Usage{PromptTokens: 3, CandidatesTokens: 2, ThoughtsTokens: 7, TotalTokens: 12}
+	if got := record.Usage(); got == nil || *got != wantUsage {
+		t.Errorf("usage got %+v want %+v", got, wantUsage)
+	}
+	if got, want := record.ModelVersion(), "gemini-2.5-pro-001"; got != want {
+		t.Errorf("model version got %q want %q", got, want)
+	}
+}
+
+// TestSupportsThinking tests the detection of thinking models.
+func TestSupportsThinking(t *testing.T) {
+	for model, want := range map[string]bool{
+		"gemini-2.5-pro":                true,
+		"models/gemini-2.5-flash":       true,
+		"gemini-2.0-flash-thinking-exp": true,
+		"gemini-2.0-flash":              false,
+		"gemini-1.5-pro":                false,
+		"gemini-3-pro-preview":          true,
+		"gemma-3-27b-it":                false,
+	} {
+		if got := supportsThinking(model); got != want {
+			t.Errorf("%s got %t want %t", model, got, want)
+		}
+	}
+}
+
+// TestGeminiTransportObject tests that thought parts are removed from a
+// non-streaming response, a single json object.
+func TestGeminiTransportObject(t *testing.T) {
+
+	response := `{"candidates": [{"content": {"role": "model", "parts": [{"text": "Considering.", "thought": true}, {"text": "Hello"}]}, "finishReason": 1}],
+ "usageMetadata": {"promptTokenCount": 3, "candidatesTokenCount": 1, "totalTokenCount": 9, "thoughtsTokenCount": 5}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	client, record := newHTTPClient(&Settings{APIKey: "k", ModelName: "gemini-2.5-pro", IncludeThoughts: true}, nil)
+	resp, err := client.Post(srv.URL+"/v1beta/models/gemini-2.5-pro:generateContent", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var filtered map[string]any
+	if err := json.Unmarshal(b, &filtered); err != nil {
+		t.Fatalf("could not decode filtered response: %v\n%s", err, b)
+	}
+	if strings.Contains(string(b), `"thought":`) || !strings.Contains(string(b), `"Hello"`) {
+		t.Errorf("unexpected filtered response: %s", b)
+	}
+	if got, want := record.Thoughts(), "Considering."; got != want {
+		t.Errorf("thoughts got %q want %q", got, want)
+	}
+	if got := record.Usage(); got == nil || got.ThoughtsTokens != 5 {
+		t.Errorf("usage got %+v", got)
+	}
+}
+
+// TestGeminiTransportStopped tests that, when several candidates are
+// requested, the finish reasons of candidates stopped for safety or
+// recitation are recorded and hidden from the genai package.
+func TestGeminiTransportStopped(t *testing.T) {
+
+	response := `{"candidates": [{"content": {"role": "model", "parts": [{"text": "No"}]}, "finishReason": "SAFETY"},
+  {"index": 1, "content": {"role": "model", "parts": [{"text": "Yes"}]}, "finishReason": 1},
+  {"index": 2, "content": {"role": "model", "parts": [{"text": "Quote"}]}, "finishReason": 4}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, response)
+	}))
+	defer srv.Close()
+
+	client, record := newHTTPClient(&Settings{APIKey: "k", ModelName: "gemini-2.5-pro", CandidateCount: genai.Ptr(int32(3))}, nil)
+	resp, err := client.Post(srv.URL+"/v1beta/models/gemini-2.5-pro:generateContent", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "SAFETY") || strings.Count(string(b), `"OTHER"`) != 2 {
+		t.Errorf("stopped finish reasons not replaced: %s", b)
+	}
+	for i, want := range []string{"SAFETY", "STOP", "RECITATION"} {
+		if got := record.FinishReason(i, "STOP"); got != want {
+			t.Errorf("candidate %d finish reason got %s want %s", i, got, want)
+		}
+	}
+}
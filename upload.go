@@ -0,0 +1,227 @@
+package genact
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+)
+
+// defaultEndpoint is the Gemini api endpoint used unless the "endpoint"
+// setting is provided.
+const defaultEndpoint = "https://generativelanguage.googleapis.com"
+
+// uploadExpiryMargin is the time before its expiry after which an
+// uploaded file is no longer reused.
+const uploadExpiryMargin = 10 * time.Minute
+
+// Upload records a file uploaded with the Gemini File API. Uploaded
+// files expire, normally after 48 hours.
+type Upload struct {
+	Name     string    `json:"name"` // the file name, such as files/xyz
+	URI      string    `json:"uri"`
+	MIMEType string    `json:"mimeType"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Uploads records the attachments of a chat uploaded with the Gemini
+// File API, keyed by attachment path (see APIAttachment). Uploads is
+// suitable for saving as json in a chat directory.
+type Uploads map[string]Upload
+
+// uploader uploads attachments with the Gemini File API, replacing
+// large attachment blobs in requests with file references. Attachments
+// are only uploaded if they have not been uploaded before or their
+// upload has expired.
+type uploader struct {
+	client     *genai.Client
+	httpClient *http.Client
+	endpoint   string
+	threshold  int
+	retry      RetryPolicy
+	uploads    Uploads
+	logger     *slog.Logger
+}
+
+// newUploader returns an uploader for settings, making upload requests
+// with httpClient, recording uploads in uploads and logging to logger.
+func newUploader(client *genai.Client, httpClient *http.Client, settings *Settings, uploads Uploads, logger *slog.Logger) *uploader {
+	endpoint := settings.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	return &uploader{
+		client:     client,
+		httpClient: httpClient,
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		threshold:  settings.UploadThreshold,
+		retry:      settings.Retry,
+		uploads:    uploads,
+		logger:     logger,
+	}
+}
+
+// replaceBlobs returns copies of contents in which attachment blobs
+// larger than the upload threshold are replaced by genai.FileData parts
+// referring to uploaded files. Further blobs, largest first, are also
+// replaced if the remaining inline blobs exceed MaxInlineSize.
+func (u *uploader) replaceBlobs(ctx context.Context, contents []*genai.Content) ([]*genai.Content, error) {
+	type ref struct{ content, part int }
+	refs := []ref{}
+	inline := 0
+	for i, c := range contents {
+		for j, p := range c.Parts {
+			if b, ok := p.(genai.Blob); ok {
+				refs = append(refs, ref{i, j})
+				inline += len(b.Data)
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return contents, nil
+	}
+	blob := func(r ref) genai.Blob {
+		return contents[r.content].Parts[r.part].(genai.Blob)
+	}
+	slices.SortStableFunc(refs, func(a, b ref) int {
+		return cmp.Compare(len(blob(b).Data), len(blob(a).Data))
+	})
+
+	replaced := slices.Clone(contents)
+	for _, r := range refs {
+		b := blob(r)
+		if len(b.Data) <= u.threshold && inline <= MaxInlineSize {
+			continue
+		}
+		fd, err := u.fileData(ctx, b)
+		if err != nil {
+			return nil, err
+		}
+		if replaced[r.content] == contents[r.content] {
+			c := *contents[r.content]
+			c.Parts = slices.Clone(c.Parts)
+			replaced[r.content] = &c
+		}
+		replaced[r.content].Parts[r.part] = fd
+		inline -= len(b.Data)
+	}
+	return replaced, nil
+}
+
+// fileData returns a genai.FileData part for a blob, uploading the blob
+// if it has not been uploaded or its upload has expired.
+func (u *uploader) fileData(ctx context.Context, b genai.Blob) (genai.FileData, error) {
+	path := attachmentPath(b)
+	if up, ok := u.uploads[path]; ok && time.Now().Add(uploadExpiryMargin).Before(up.Expires) {
+		return genai.FileData{MIMEType: up.MIMEType, URI: up.URI}, nil
+	}
+	var up Upload
+	err := withRetry(ctx, u.retry, u.logger, func() error {
+		var err error
+		up, err = u.upload(ctx, path, b)
+		return err
+	})
+	if err != nil {
+		return genai.FileData{}, fmt.Errorf("could not upload attachment %s: %w", path, err)
+	}
+	u.uploads[path] = up
+	return genai.FileData{MIMEType: up.MIMEType, URI: up.URI}, nil
+}
+
+// upload uploads a blob using the resumable upload protocol of the File
+// API and waits for the file to become active.
+func (u *uploader) upload(ctx context.Context, name string, b genai.Blob) (Upload, error) {
+
+	// start the upload
+	meta, err := json.Marshal(map[string]any{"file": map[string]string{"displayName": name}})
+	if err != nil {
+		return Upload{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint+"/upload/v1beta/files", bytes.NewReader(meta))
+	if err != nil {
+		return Upload{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Upload-Protocol", "resumable")
+	req.Header.Set("X-Goog-Upload-Command", "start")
+	req.Header.Set("X-Goog-Upload-Header-Content-Length", strconv.Itoa(len(b.Data)))
+	req.Header.Set("X-Goog-Upload-Header-Content-Type", b.MIMEType)
+	resp, err := u.do(req)
+	if err != nil {
+		return Upload{}, err
+	}
+	_ = resp.Body.Close()
+	uploadURL := resp.Header.Get("X-Goog-Upload-URL")
+	if uploadURL == "" {
+		return Upload{}, errors.New("no upload url provided")
+	}
+
+	// upload the data
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(b.Data))
+	if err != nil {
+		return Upload{}, err
+	}
+	req.Header.Set("X-Goog-Upload-Offset", "0")
+	req.Header.Set("X-Goog-Upload-Command", "upload, finalize")
+	resp, err = u.do(req)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var uploaded struct {
+		File struct {
+			Name string `json:"name"`
+		} `json:"file"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil {
+		return Upload{}, fmt.Errorf("could not decode upload response: %w", err)
+	}
+	u.logger.Info("uploaded attachment", "attachment", name, "bytes", len(b.Data), "file", uploaded.File.Name)
+
+	// wait for the file to be processed
+	for delay := time.Second; ; delay = min(2*delay, 10*time.Second) {
+		f, err := u.client.GetFile(ctx, uploaded.File.Name)
+		if err != nil {
+			return Upload{}, fmt.Errorf("could not get uploaded file: %w", err)
+		}
+		switch f.State {
+		case genai.FileStateActive:
+			return Upload{Name: f.Name, URI: f.URI, MIMEType: f.MIMEType, Expires: f.ExpirationTime}, nil
+		case genai.FileStateFailed:
+			return Upload{}, fmt.Errorf("processing of uploaded file %s failed", f.Name)
+		}
+		u.logger.Debug("waiting for uploaded file to be processed", "file", f.Name)
+		select {
+		case <-ctx.Done():
+			return Upload{}, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// do sends an upload request, returning a googleapi.Error for responses
+// other than 200 OK so that transient errors may be retried.
+func (u *uploader) do(req *http.Request) (*http.Response, error) {
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		return nil, &googleapi.Error{Code: resp.StatusCode, Body: string(body), Header: resp.Header}
+	}
+	return resp, nil
+}
@@ -0,0 +1,78 @@
+package genact
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/rorycl/genact/genacttest"
+)
+
+// TestUploads tests that large attachments are uploaded with the File
+// API and that uploads are reused until they expire, using the
+// genacttest stand-in.
+func TestUploads(t *testing.T) {
+
+	srv := genacttest.NewServer()
+	defer srv.Close()
+
+	settings := defaultSettings()
+	settings.APIKey, settings.ModelName, settings.Endpoint = "key", "gemini-2.5-pro", srv.URL
+	settings.Retry.MaxAttempts = 1
+	settings.UploadThreshold = 1024
+
+	large := genai.Blob{MIMEType: "application/pdf", Data: bytes.Repeat([]byte("x"), 4096)}
+	small := genai.Blob{MIMEType: "image/png", Data: []byte("\x89PNG\r\n\x1a\n")}
+	history := []*genai.Content{
+		{Role: "user", Parts: []genai.Part{genai.Text("describe this"), large}},
+		{Role: "model", Parts: []genai.Part{genai.Text("a document")}},
+	}
+
+	uploads := Uploads{}
+	count := func() {
+		t.Helper()
+		_, err := APICountTokens(context.Background(), &settings, history, "and this",
+			WithAttachments(small), WithUploads(uploads))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc    string
+		expire  bool
+		uploads int
+	}{
+		{"first request uploads large attachment", false, 1},
+		{"second request reuses upload", false, 1},
+		{"expired upload is uploaded again", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.expire {
+				srv.ExpireFiles()
+				for k, u := range uploads {
+					u.Expires = u.Expires.Add(-48 * time.Hour)
+					uploads[k] = u
+				}
+			}
+			count()
+			if got, want := srv.Uploads(), tt.uploads; got != want {
+				t.Errorf("got %d uploads want %d", got, want)
+			}
+			up, ok := uploads[attachmentPath(large)]
+			if !ok {
+				t.Fatalf("upload of %s not recorded", attachmentPath(large))
+			}
+			if !strings.HasPrefix(up.URI, srv.URL) || up.MIMEType != large.MIMEType {
+				t.Errorf("unexpected upload record %+v", up)
+			}
+			if _, ok := uploads[attachmentPath(small)]; ok {
+				t.Error("small attachment unexpectedly uploaded")
+			}
+		})
+	}
+}